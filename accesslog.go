@@ -0,0 +1,74 @@
+package cjsocks
+
+import (
+	"context"
+	"log/slog"
+	"net"
+
+	"github.com/haxii/socks5"
+)
+
+type accessLogRequestKey struct{}
+
+// accessLogRules logs each socks5 request with the client address, destination and result.
+// Allowed connect requests are logged by accessLogDial once the outcome of the dial is known.
+type accessLogRules struct {
+	rules socks5.RuleSet
+}
+
+func (r accessLogRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	ctx, ok := r.rules.Allow(ctx, req)
+	switch {
+	case !ok:
+		logAccess(req, "denied", nil)
+	case req.Command == socks5.CommandConnect:
+		ctx = context.WithValue(ctx, accessLogRequestKey{}, req)
+	default:
+		logAccess(req, "allowed", nil)
+	}
+	return ctx, ok
+}
+
+// accessLogDial wraps dial to log the connect request stored in ctx by accessLogRules
+func accessLogDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if req, ok := ctx.Value(accessLogRequestKey{}).(*socks5.Request); ok {
+			if err != nil {
+				logAccess(req, "error", err)
+			} else {
+				logAccess(req, "allowed", nil)
+			}
+		}
+		return conn, err
+	}
+}
+
+// logAccess logs a socks5 request at info level, or warn level when it failed
+func logAccess(req *socks5.Request, result string, err error) {
+	attrs := []any{"result", result, "command", commandName(req.Command)}
+	if req.RemoteAddr != nil {
+		attrs = append(attrs, "client", req.RemoteAddr.String())
+	}
+	if req.DestAddr != nil {
+		attrs = append(attrs, "fqdn", req.DestAddr.FQDN, "ip", req.DestAddr.IP.String(), "port", req.DestAddr.Port)
+	}
+	if err != nil {
+		slog.Warn("Socks5 connection failed", append(attrs, "error", err)...)
+		return
+	}
+	slog.Info("Socks5 connection", attrs...)
+}
+
+// commandName returns the name of a socks5 command for logging
+func commandName(command uint8) string {
+	switch command {
+	case socks5.CommandConnect:
+		return "connect"
+	case socks5.CommandBind:
+		return "bind"
+	case socks5.CommandAssociate:
+		return "associate"
+	}
+	return "unknown"
+}
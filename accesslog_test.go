@@ -0,0 +1,70 @@
+package cjsocks
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	logs := captureLogs(t)
+	cfg := socksTestConfig(t)
+	cfg.UnixSocket = "" // For a client address
+	cfg.ListenIP = "127.0.0.1"
+	cfg.Port = freeTCPPort(t)
+	cfg.DenyCIDR = []string{"127.0.0.2/32"}
+	app := newTestApp(t, cfg)
+	app.registerContainer("web1", containerMeta{}, []string{"web.container"}, "127.0.0.1")
+	startApp(t, app)
+	port := echoServer(t).Addr().(*net.TCPAddr).Port
+	closed := freeTCPPort(t)
+
+	conn := dialSocks(t, cfg, net.JoinHostPort("web.container", strconv.Itoa(port)))
+	echo(t, conn, "ping")
+	client := conn.LocalAddr().String()
+	conn.Close()
+	// Names resolving to a denied address are refused by Resolve, before the rules see the request
+	if conn, err := trySocks(cfg, net.JoinHostPort("127.0.0.2", strconv.Itoa(port)), time.Second); err == nil {
+		conn.Close()
+		t.Error("127.0.0.2 was allowed")
+	}
+	if conn, err := trySocks(cfg, net.JoinHostPort("web.container", strconv.Itoa(closed)), time.Second); err == nil {
+		conn.Close()
+		t.Error("dialing a closed port succeeded")
+	}
+
+	tests := []struct {
+		msg    string
+		fqdn   string
+		ip     string
+		port   int
+		result string
+	}{
+		{"Socks5 connection", "web.container", "127.0.0.1", port, "allowed"},
+		{"Socks5 connection", "", "127.0.0.2", port, "denied"},
+		{"Socks5 connection failed", "web.container", "127.0.0.1", closed, "error"},
+	}
+	for _, tt := range tests {
+		var found map[string]interface{}
+		for _, record := range logs.records(tt.msg) {
+			if record["fqdn"] == tt.fqdn && record["result"] == tt.result {
+				found = record
+			}
+		}
+		if found == nil {
+			t.Errorf("no %q log record for %v with result %v in %v", tt.msg, tt.fqdn, tt.result, logs.records(tt.msg))
+			continue
+		}
+		want := map[string]interface{}{"command": "connect", "ip": tt.ip, "port": fmt.Sprint(tt.port)}
+		got := map[string]interface{}{"command": found["command"], "ip": found["ip"], "port": fmt.Sprint(found["port"])}
+		assertEqual(t, tt.fqdn+" "+tt.result, got, want)
+		if tt.result == "allowed" && found["client"] != client {
+			t.Errorf("client = %v, want %v", found["client"], client)
+		}
+		if tt.result == "error" && found["error"] == nil {
+			t.Errorf("%v has no error", tt.msg)
+		}
+	}
+}
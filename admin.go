@@ -0,0 +1,95 @@
+package cjsocks
+
+// Admin HTTP server.  Exposes what cjsocks currently knows for debugging resolution problems.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// serveAdmin starts the admin HTTP server on ip:port.  It blocks until the server fails or ctx is cancelled.
+func (app *App) serveAdmin(ctx context.Context, ip string, port int) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/domains", app.handleDomains)
+	mux.HandleFunc("/metrics", app.handleMetrics)
+	mux.HandleFunc("/stats", app.handleStats)
+	mux.HandleFunc("/resync", app.handleResync)
+	mux.HandleFunc("/livez", handleLivez)
+	mux.HandleFunc("/version", handleVersion)
+	mux.HandleFunc("/healthz", app.handleHealthz)
+
+	server := &http.Server{
+		Addr:    net.JoinHostPort(ip, strconv.Itoa(port)),
+		Handler: mux,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	slog.Info("Starting admin server", "addr", server.Addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// handleDomains writes the FQDN to IP map as JSON.  The keys are sorted by FQDN.
+func (app *App) handleDomains(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, app.Domains())
+}
+
+// handleResync re-registers the running containers, for when the names drifted from what docker reports
+func (app *App) handleResync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// The docker event loop runs the resync
+	if !app.ready.Load() {
+		http.Error(w, "not connected to docker", http.StatusServiceUnavailable)
+		return
+	}
+	slog.Info("Resyncing containers", "remote", r.RemoteAddr)
+	count, err := app.requestResync(r.Context())
+	if err != nil {
+		slog.Error("Could not resync containers", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, map[string]int{"domains": count})
+}
+
+// handleLivez reports that the process is up
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleHealthz reports whether cjsocks is listening for docker events and has registered the running containers.
+// It fails while reconnecting to docker, since names may be missing or stale until the resync completes.
+func (app *App) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !app.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// writeJSON writes v as the JSON response body.  Map keys are sorted by encoding/json.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		slog.Warn("Could not write admin response", "error", err)
+	}
+}
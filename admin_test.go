@@ -0,0 +1,153 @@
+package cjsocks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestResync(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+	f.addContainer(fakeContainer("api1", "api", "172.17.0.3", nil))
+
+	// Drifted from docker: web1 has a stale IP and lost a label change, api1 was missed and ghost1 is long gone
+	app.registerContainer("web1", containerMeta{}, []string{"web.container"}, "10.9.9.9")
+	app.registerContainer("ghost1", containerMeta{}, []string{"ghost.container"}, "172.17.0.9")
+	f.changeContainer("web1", func(c *docker.Container) { c.Config.Labels = map[string]string{label_cj_aliases: "www"} })
+
+	count, err := app.resync(f)
+	if err != nil {
+		t.Fatalf("resync: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("resync = %v names, want 3", count)
+	}
+	assertRegistered(t, app,
+		registration{ID: "web1", ip: "172.17.0.2", domains: []string{"web.container", "www.container"}},
+		registration{ID: "api1", ip: "172.17.0.3", domains: []string{"api.container"}},
+	)
+}
+
+func TestHandleResync(t *testing.T) {
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+	app := newTestApp(t, socksTestConfig(t))
+	app.dockerClient = func() (dockerAPI, error) { return f, nil }
+
+	// Resyncs run on the docker event loop, so there is nothing to do them before it starts
+	w := httptest.NewRecorder()
+	app.handleResync(w, httptest.NewRequest(http.MethodPost, "/resync", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST /resync before connecting = %v, want %v", w.Code, http.StatusServiceUnavailable)
+	}
+
+	startApp(t, app)
+	waitFor(t, "the docker events listener", app.ready.Load)
+	f.removeContainer("web1") // Without an event
+
+	w = httptest.NewRecorder()
+	app.handleResync(w, httptest.NewRequest(http.MethodPost, "/resync", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /resync = %v %v, want 200", w.Code, w.Body)
+	}
+	var summary map[string]int
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("POST /resync body %q: %v", w.Body, err)
+	}
+	assertEqual(t, "POST /resync summary", summary, map[string]int{"domains": 0})
+	assertRegistered(t, app)
+
+	w = httptest.NewRecorder()
+	app.handleResync(w, httptest.NewRequest(http.MethodGet, "/resync", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /resync = %v, want %v", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHandleDomains(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+	app.registerContainer("web1", containerMeta{}, []string{"web.container", "www.container"}, "172.17.0.2")
+	app.registerContainer("api1", containerMeta{}, []string{"api.container"}, "172.17.0.3")
+
+	w := httptest.NewRecorder()
+	app.handleDomains(w, httptest.NewRequest(http.MethodGet, "/domains", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /domains = %v %v, want 200 JSON", w.Code, w.Header().Get("Content-Type"))
+	}
+	want := `{
+  "api.container": "172.17.0.3",
+  "web.container": "172.17.0.2",
+  "www.container": "172.17.0.2"
+}
+`
+	if got := w.Body.String(); got != want {
+		t.Errorf("GET /domains = %v, want %v", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	app.handleDomains(w, httptest.NewRequest(http.MethodPost, "/domains", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /domains = %v, want %v", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	app.registerContainer("broken1", containerMeta{}, []string{"broken.container"}, "not-an-ip")
+
+	ctx := context.Background()
+	for _, name := range []string{"web.container", "web.container", "localhost", "broken.container"} {
+		app.Resolve(ctx, name)
+	}
+
+	w := httptest.NewRecorder()
+	app.handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics = %v, want 200", w.Code)
+	}
+	for _, want := range []string{
+		`cjsocks_resolve_total{result="hit"} 2`,
+		`cjsocks_resolve_total{result="miss"} 1`,
+		`cjsocks_resolve_total{result="error"} 1`,
+		`cjsocks_domains_active 2`,
+		`cjsocks_docker_events_total{action="start"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want+"\n") {
+			t.Errorf("GET /metrics = %v, want %v", w.Body, want)
+		}
+	}
+}
+
+func TestHandleHealthz(t *testing.T) {
+	f := newFakeDocker()
+	app := newTestApp(t, socksTestConfig(t))
+	app.dockerClient = func() (dockerAPI, error) { return f, nil }
+
+	get := func(handler http.HandlerFunc, path string) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+	if code := get(app.handleHealthz, "/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("GET /healthz before connecting = %v, want %v", code, http.StatusServiceUnavailable)
+	}
+	if code := get(handleLivez, "/livez"); code != http.StatusOK {
+		t.Errorf("GET /livez = %v, want 200", code)
+	}
+
+	startApp(t, app)
+	waitFor(t, "the docker events listener", app.ready.Load)
+	if code := get(app.handleHealthz, "/healthz"); code != http.StatusOK {
+		t.Errorf("GET /healthz once connected = %v, want 200", code)
+	}
+}
@@ -0,0 +1,158 @@
+package cjsocks_test
+
+// The library used the way another program embeds it, through the exported API only
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/king-perseus/cjsocks"
+	"golang.org/x/net/proxy"
+)
+
+// newConfig returns the default configuration with the socks5 server on a unix socket in a temporary directory,
+// and a docker host nothing listens on
+func newConfig(t *testing.T) cjsocks.Config {
+	t.Helper()
+	cfg, err := cjsocks.ParseFlags([]string{
+		"-unix-socket", filepath.Join(t.TempDir(), "cjsocks.sock"),
+		"-docker-host", "unix://" + filepath.Join(t.TempDir(), "docker.sock"),
+		"-drain-timeout", "1s",
+	})
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	return cfg
+}
+
+// echoServer accepts connections on a local port and sends back what it reads
+func echoServer(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+// dialSocks connects to addr through the socks5 server on the unix socket at path, retrying while it starts
+func dialSocks(t *testing.T, path string, addr string) net.Conn {
+	t.Helper()
+	dialer, err := proxy.SOCKS5("unix", path, nil, proxy.Direct)
+	if err != nil {
+		t.Fatalf("proxy.SOCKS5: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := dialer.Dial("tcp", addr)
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Dial %v through socks5: %v", addr, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestNewResolve(t *testing.T) {
+	app, err := cjsocks.New(newConfig(t))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if domains := app.Domains(); len(domains) != 0 {
+		t.Errorf("Domains() = %v before any container, want none", domains)
+	}
+	_, ip, err := app.Resolve(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Resolve = %v, want 127.0.0.1", ip)
+	}
+}
+
+func TestRunWithoutDocker(t *testing.T) {
+	cfg := newConfig(t)
+	app, err := cjsocks.New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- app.Run(ctx) }()
+
+	// Names that aren't containers are proxied even though docker is unreachable
+	echo := echoServer(t)
+	conn := dialSocks(t, cfg.UnixSocket, echo.Addr().String())
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(reply) != "ping" {
+		t.Errorf("echo = %q, want %q", reply, "ping")
+	}
+	conn.Close()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run = %v, want nil after cancelling", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return after cancelling")
+	}
+}
+
+func TestRunFailsOnBadListenAddress(t *testing.T) {
+	cfg := newConfig(t)
+	cfg.UnixSocket = filepath.Join(t.TempDir(), "missing", "cjsocks.sock")
+	app, err := cjsocks.New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := app.Run(context.Background()); err == nil {
+		t.Error("Run = nil, want an error for a socket in a missing directory")
+	}
+}
+
+func TestNewFailsOnInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *cjsocks.Config)
+	}{
+		{name: "deny cidr", change: func(cfg *cjsocks.Config) { cfg.DenyCIDR = []string{"not-a-cidr"} }},
+		{name: "registry", change: func(cfg *cjsocks.Config) { cfg.Registry = "ftp://registry.example" }},
+		{name: "label selector", change: func(cfg *cjsocks.Config) { cfg.LabelSelector = "tier in (web" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newConfig(t)
+			tt.change(&cfg)
+			if _, err := cjsocks.New(cfg); err == nil {
+				t.Error("New = nil error, want the invalid option reported")
+			}
+		})
+	}
+}
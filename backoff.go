@@ -0,0 +1,39 @@
+package cjsocks
+
+import (
+	"math/rand"
+	"time"
+)
+
+const backoff_jitter float64 = 0.2 // Delays are shortened by up to this fraction so instances don't retry in step
+
+// backoff computes retry delays that double from base up to max, with jitter
+type backoff struct {
+	base    time.Duration
+	max     time.Duration
+	jitter  float64
+	attempt int
+}
+
+func newBackoff(base time.Duration, max time.Duration) *backoff {
+	return &backoff{base: base, max: max, jitter: backoff_jitter}
+}
+
+// next returns the delay before the next attempt.  It is between (1 - jitter) and 1 times
+// base * 2^attempt, capped at max.
+func (b *backoff) next() time.Duration {
+	delay := b.base
+	for i := 0; i < b.attempt && delay < b.max; i++ {
+		delay *= 2
+	}
+	if b.max > 0 && delay > b.max {
+		delay = b.max
+	}
+	b.attempt++
+	return delay - time.Duration(rand.Float64()*b.jitter*float64(delay))
+}
+
+// reset starts the delays over from base after a success
+func (b *backoff) reset() {
+	b.attempt = 0
+}
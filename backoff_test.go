@@ -0,0 +1,32 @@
+package cjsocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Second, 10*time.Second)
+	want := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, w := range want {
+		w *= time.Second
+		delay := b.next()
+		min := w - time.Duration(backoff_jitter*float64(w))
+		if delay > w || delay < min {
+			t.Errorf("delay %v = %v, want between %v and %v", i, delay, min, w)
+		}
+	}
+
+	b.reset()
+	if delay := b.next(); delay > time.Second {
+		t.Errorf("delay after reset = %v, want at most 1s", delay)
+	}
+}
+
+func TestBackoffMaxMustBePositive(t *testing.T) {
+	for _, value := range []string{"0", "-1s"} {
+		if _, err := ParseFlags([]string{"-backoff-max", value}); err == nil {
+			t.Errorf("ParseFlags(-backoff-max %v) = nil error, want an error", value)
+		}
+	}
+}
@@ -1,7 +1,8 @@
-package main
+// Package cjsocks resolves the names of docker containers for a socks5 server, so a browser or other socks5
+// client can reach containers by name.  The cjsocks command in cmd/cjsocks runs it.
+package cjsocks
 
 // Based on https://github.com/asjustas/docker-resolver
-// TODO: Command line parameters are not being parsed.  Using default ports.
 // TODO: Switch from socks5 implementation to coreDNS + socks5 + host file updater.  This will enable using DNS or hosts file for non MacOS
 
 /* Documentation:
@@ -15,6 +16,93 @@ By default, FQDN is generated bu adding the container name and a configurable do
 The default domain name is "container".  So a container named "myservice"
 will get a FQDN "myservice.container" if nothing else is configured.
 
+The base domain can be changed for a single container with the "org.cj-tools.hosts.base_domain"
+label.  It takes the place of the configured base domain, so a subdomain or compose project is still
+prepended, but the "org.cj-tools.hosts.domain_name" label and the container's own domain name
+(with "org.cj-tools.hosts.use_container_base_domain=true") take precedence over it.
+e.g. "myservice.myproject.test" with base_domain=test
+
+-basedomain takes a comma separated list to register every name under each of them, e.g.
+-basedomain=container,local for both "myservice.container" and "myservice.local"
+
+Additional names can be given with a comma separated "org.cj-tools.hosts.aliases" label.
+Aliases containing a dot are used as is.  Bare aliases get the base domain appended.
+
+With the label "org.cj-tools.hosts.wildcard=true" any subdomain of the container's names
+also resolves to the container.  e.g. "tenant1.myservice.container"
+
+A container on several networks resolves to its address on the network named by the
+"org.cj-tools.hosts.network" label, instead of the cj network or -network-priority.
+With -network-suffix that network's name goes in the container's names, e.g. "web.frontend.container" and
+"web.backend.container" for two containers called web.  Underscores become hyphens.
+The label "org.cj-tools.hosts.ip" overrides the address altogether, e.g. for a placeholder container
+standing in for an external host.
+
+With -swarm, each swarm service with a virtual IP is registered too, e.g. "api.container" for a service
+called api, or the name in its "org.cj-tools.hosts.host_name" label.  Services of a stack get the stack's
+name like compose services, e.g. "web.shop.container" for shop_web.  The ignore label, -ignore-name-regex,
+-project-filter (stack names) and -label-selector apply as for containers.  The virtual IP on the cj network
+is preferred.  Listing services needs cjsocks to talk to a swarm manager.
+
+With -register-short-names the bare host name (e.g. "myservice") resolves too.
+With -docker-suffix-alias the container's name followed by ".docker" (e.g. "myproject-web-1.docker") resolves too.
+
+When two containers get the same name the most recently started one takes it over (-collision-policy=last).
+With -collision-policy=first the first container keeps it, and with -collision-policy=error the
+second container's registration is refused and logged as an error.  Short names have their own policy,
+-short-name-collision, which defaults to first.
+
+Containers labelled "org.cj-tools.hosts.ignore=true", or whose name matches -ignore-name-regex,
+never get a name.  e.g. -ignore-name-regex='-(init|migrate)-[0-9]+$'
+With -project-filter only containers from the listed compose projects get a name.
+With -label-selector only containers whose labels match get a name, e.g.
+-label-selector='org.cj-tools.hosts.env=prod,tier in (web,api),!org.cj-tools.hosts.internal'
+Requirements are separated by commas and must all match: key=value, key!=value, key in (a,b),
+key notin (a,b), key (the label is set) and !key (the label is missing).
+Containers started by "docker compose run" don't get a name either, so they don't shadow the service
+they were run from, unless they have a host name label.
+
+The embedded DNS server answers with a TTL of -dns-ttl seconds, or the container's
+"org.cj-tools.hosts.ttl" label.  e.g. "org.cj-tools.hosts.ttl=300" for a container that rarely moves.
+With -dns-search it answers bare names with each base domain appended, like a search domain, e.g. a query
+for "web" gets the address of "web.container".
+Dual stack containers answer A queries with their IPv4 address and AAAA queries with their IPv6
+address.  The socks5 proxy connects to one of them, the IPv6 address with -prefer-ipv6.
+
+Replicas of a compose service (docker compose up --scale web=3) share their names, and connections
+are spread over them round robin.  With -register-replica-names each replica is also reachable on its
+own, by the compose container number, e.g. "web-2.myproject.container"
+
+If the docker daemon can't be reached at startup the socks5 server starts anyway and serves names
+that aren't containers.  Container names resolve once docker answers, which is retried with backoff.
+
+With -enable-discovery clients of the proxy can list the registered names as JSON by connecting to
+"_cjsocks.list" on any port, e.g. curl --socks5-hostname localhost:1080 telnet://_cjsocks.list:1
+It is off by default since it shows every container name to anyone who can use the proxy.
+
+When a container has several names, the label "org.cj-tools.hosts.canonical" picks the one reverse (PTR)
+lookups and logs report, e.g. "org.cj-tools.hosts.canonical=api.myproject.container".  It defaults to the
+container's first name.
+
+The label "org.cj-tools.hosts.port_map" sends socks5 connections for some ports of a container's names to
+other ports, e.g. "org.cj-tools.hosts.port_map=80:8080,443:8443" for a service listening on 8080 that clients
+expect on 80.  Connections to the container's IP address aren't rewritten.
+
+The label "org.cj-tools.hosts.upstream" makes a container stand in for an external endpoint, e.g.
+"org.cj-tools.hosts.upstream=api.example.com:443".  Its names resolve to api.example.com, looked up like names
+that aren't containers, and connections go to port 443 unless the port_map label says otherwise.  The port
+is optional.
+
+With -registry redis://host:6379/0 the names are kept in the Redis hash "cjsocks:domains" instead of in
+memory, so several cjsocks instances resolve each other's names and entries added by hand with
+HSET cjsocks:domains myhost.container 10.0.0.5
+Lookups in Redis are cached for 5 seconds, so a name added or removed elsewhere can take that long to show.
+
+The names of a paused container don't resolve until it is unpaused, or resolve to its running replicas.
+
+With -removal-grace=5s a stopped container keeps its names for 5 seconds, and keeps them altogether if it
+starts again meanwhile.  So a crash looping container doesn't flap in and out of DNS.
+
 Containers created by docker-compose automatically get a subdomain.  So a container
 named "myservice" created in a docker-compose project "myproject" will get
 a FQDN "myservice.myproject.container"
@@ -24,400 +112,2276 @@ Requirements:
   to route to the containers.
 
 The implementation does the following:
-- Creates a docker network "cj-socks5" if it doesn't already exist
-- Creates a socks5 proxy listening on a configured port (default 1085)
+- Creates a docker network "cj-socks5" (-cj-network) if it doesn't already exist, unless -no-create-network
+- Creates a socks5 proxy listening on a configured port (default 1085), or a unix socket (-unix-socket)
 - Provides DNS resolution via a custom socks5 resolver
+- Optionally relays UDP (socks5 UDP associate) on the same port (-enable-udp).  The relay is open to anyone who
+  can reach the port, so it can't be combined with authentication or -allow-cidr/-deny-cidr
+- Logs each socks5 connection with its client, destination and result at info level
+- Optionally resolves names that aren't containers with other DNS servers (-upstream-dns)
+- Optionally refuses connections to names that aren't containers (-strict-resolve)
+- Optionally refuses connections to addresses outside -allow-cidr or inside -deny-cidr
+- Optionally serves the same names from an embedded DNS server (-dns-port)
+- Optionally limits how fast socks5 connections are accepted (-max-conns-per-sec)
+- On shutdown gives open socks5 connections -drain-timeout (default 10s) to finish before closing them
+- Optionally stops registering new names past -max-domains, in case something starts thousands of containers
+- Optionally writes container start, stop, rename and update events to stdout as JSON lines (-events-json).  Logs go to stderr then.
+- Optionally POSTs {"event": "added" or "removed", "fqdns": [...], "ip": "..."} to -webhook-url when names change
+- Optionally maintains a block of entries in a hosts file (-hosts-file)
+- Optionally lists the registered names, Prometheus metrics and traffic per destination on an admin HTTP server (-admin-port, GET /domains, /metrics and /stats)
+- Optionally re-registers every running container on request (POST /resync on the admin HTTP server)
+- Optionally serves liveness and readiness probes on the admin HTTP server (GET /livez and /healthz)
+- Registers a name for the docker host (-host-alias, default "host.cjsocks"), resolving to -host-address or
+  the gateway of the cj network
+- Reads options from a YAML file (-config), e.g. "base_domain: test" or "network_priority: [backend]"
+- Reads base_domain, cj_network and auto_add from labels on its own container, e.g.
+  "org.cj-tools.hosts.config.base_domain=test", unless they are set some other way
+- Prints the effective configuration as JSON and exits with -print-config, including the options from labels on
+  its own container
+- Prints the names of the running containers and exits with -once
+- Prints the version with -version, and on the admin HTTP server (GET /version)
+- Connects to a remote docker daemon over TLS (-docker-host=tcp://..., -docker-tls-cert, -docker-tls-key, -docker-tls-ca)
 - Monitors container creation/destruction to add/remove DNS entries
-- To ensure connectivity, new containers are automatically added to the cj-socks
+- Compares the registered containers with the running ones every -reconcile-interval (default 60s) in case
+  events were missed
+- To ensure connectivity, new containers with a "org.cj-tools.hosts.*" label are automatically added
+  to the cj-socks network (-autoadd), or every new container with -auto-add-all
 
 */
 
 import (
 	"context"
-	"flag"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
-	"github.com/chuckpreslar/emission"
+	"github.com/docker/docker/api/types/swarm"
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/haxii/socks5"
 )
 
 const default_ip string = "0.0.0.0"
 const default_auto_add_to_cjnetwork bool = false
-const default_port string = "1085"
-const listen_protocol string = "tcp"
+const default_port int = 1085
+const listen_protocol string = "tcp"      // Unless -unix-socket is set
+const unix_socket_mode os.FileMode = 0666 // Like the TCP port, anyone who can reach the socket may use it
+const default_bind_retries int = 5
+const default_bind_retry_delay time.Duration = 2 * time.Second
+const docker_events_buffer int = 100
+const start_ip_retries int = 5                         // Inspections of a started container that had no IP
+const start_ip_retry_delay time.Duration = time.Second // Between those inspections
+const docker_reconnect_delay time.Duration = time.Second
+const default_backoff_max time.Duration = 30 * time.Second // Longest delay between docker reconnects and listen retries
+const default_docker_host string = "unix:///var/run/docker.sock"
+const shutdown_timeout time.Duration = 5 * time.Second
+const default_resolve_cache_ttl time.Duration = 30 * time.Second
+const default_resolve_cache_size int = 1024
+const default_docker_timeout time.Duration = 5 * time.Second
+const default_dial_timeout time.Duration = 10 * time.Second
+const default_log_level string = "info"
+const default_dns_port int = 0                 // 0 disables the DNS server
+const default_dns_ttl int = 10                 // Seconds.  Kept short since container IPs change on restart.
+const default_admin_port int = 0               // 0 disables the admin HTTP server
 const default_base_domain string = "container" // Default domain for the containers.  e.g. hostname.container
+const collision_policy_first string = "first"  // The container that registered a name first keeps it
+const collision_policy_last string = "last"    // The most recently started container takes over a name
+const collision_policy_error string = "error"  // Like first, but logged as an error
 const default_cj_network_name string = "cj-socks5"
+const cj_network_description string = "Default network used by cj-socks to bridge communication to other containers."
 
+const label_cj_prefix string = "org.cj-tools.hosts."
 const label_cj_hostname string = "org.cj-tools.hosts.host_name"
 const label_docker_compose_service string = "com.docker.compose.service"
 const label_docker_compose_project string = "com.docker.compose.project"
+const label_docker_compose_container_number string = "com.docker.compose.container-number"
+const label_docker_compose_oneoff string = "com.docker.compose.oneoff"
 const label_cj_subdomain string = "org.cj-tools.hosts.sub_domain"
 const label_cj_domain string = "org.cj-tools.hosts.domain_name"
 const label_cj_flag_use_container_base_domain string = "org.cj-tools.hosts.use_container_base_domain"
-
+const label_cj_base_domain string = "org.cj-tools.hosts.base_domain"
+const label_cj_aliases string = "org.cj-tools.hosts.aliases"
+const label_cj_flag_wildcard string = "org.cj-tools.hosts.wildcard"
+const label_cj_flag_ignore string = "org.cj-tools.hosts.ignore"
+const label_cj_ttl string = "org.cj-tools.hosts.ttl"
+const label_cj_network string = "org.cj-tools.hosts.network"
+const label_cj_ip string = "org.cj-tools.hosts.ip"
+const label_cj_canonical string = "org.cj-tools.hosts.canonical"
+const label_cj_port_map string = "org.cj-tools.hosts.port_map"
+const label_cj_upstream string = "org.cj-tools.hosts.upstream"
+
+var generatedHostnameRegex = regexp.MustCompile(`^[0-9a-f]{12}$`)
+var fqdnLabelRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// App registers the names of docker containers and resolves them for a socks5 server
 type App struct {
-	emitter               *emission.Emitter
-	fqdnToIp              map[string]string // Resolve a lower case DNS name to an IP address
-	defaultBaseDomain     string
-	cjnetworkName         string // containers with cj labels get added here automatically if they don't already exist on the network
+	sync.RWMutex          // Guards idToDomains, idToIp, idToMeta, fqdnOwners and paused, which are read by the socks5 resolver and written by the docker event listener
+	hooks                 Hooks
+	cfg                   Config                   // As given to New
+	docker                dockerAPI                // Set once connected, for the admin server
+	ready                 atomic.Bool              // Listening for docker events and the running containers are registered
+	registry              Registry                 // Resolve a lower case DNS name to an IP address.  Shared with other instances in Redis.
+	idToDomains           map[string][]string      // Domains registered for a container ID.  Used to remove them once the container is gone.
+	idToIp                map[string]string        // IP registered for a container ID
+	idToMeta              map[string]containerMeta // Compose service and DNS TTL of a container ID
+	fqdnOwners            map[string][]string      // IDs of the containers that registered a lower case DNS name.  More than one for replicas.
+	paused                map[string]bool          // Paused container IDs.  Their names stay registered but don't resolve.
+	roundRobin            atomic.Uint64            // Rotates lookups of names shared by replicas
+	resolver              Resolver                 // Resolves the names of socks5 requests.  The App itself unless replaced with SetResolver.
+	resolveCache          *resolveCache            // System DNS results for names that aren't containers
+	destinations          *destinationFilter       // Allowed and denied destination addresses.  nil allows everything.
+	upstream              *upstreamResolver        // DNS servers for names that aren't containers.  nil uses the system resolver.
+	metrics               *metrics
+	stats                 *trafficStats                   // Proxied traffic by destination
+	events                *eventLog                       // Container lifecycle events for -events-json.  nil when disabled.
+	webhook               *webhook                        // POSTs name changes to -webhook-url while Run runs.  nil when disabled.
+	removals              *pendingRemovals                // Stopped containers whose names are kept for -removal-grace
+	resyncs               chan chan resyncResult          // Resync requests for the docker event loop, each with a channel for the result
+	dockerClient          func() (dockerAPI, error)       // Creates the docker client Run uses.  A fake in tests.
+	baseDomains           []string                        // Base domains for containers without a base domain label.  Each gets a name.
+	dnsSearch             bool                            // Answer bare DNS names under each base domain
+	dnsTTL                uint32                          // Seconds, for containers without a ttl label
+	noCreateNetwork       bool                            // The cj network is created beforehand, so only inspect it
+	cjnetworkName         string                          // containers with cj labels get added here automatically if they don't already exist on the network
+	networkPriority       []string                        // Networks whose IP addresses are preferred, after the cj network
+	preferIPv6            bool                            // Register a container's IPv6 address when it has both
+	networkSuffix         bool                            // Put the name of the network a container is reached on in its names
+	swarm                 bool                            // Register swarm services on their virtual IPs
+	dockerSuffixAlias     bool                            // Also register each container's name under .docker
+	strictResolve         bool                            // Refuse names that aren't registered containers instead of using the system resolver
+	registerShortNames    bool                            // Also register the bare host name of each container
+	registerReplicaNames  bool                            // Also register a numbered name for each compose replica
+	collisionPolicy       string                          // Which container keeps a name registered by two: "first", "last" or "error"
+	shortNameCollision    string                          // The collision policy for short names
+	ignoreNameRegex       *regexp.Regexp                  // Containers whose name matches are never registered
+	projectFilter         []string                        // Compose projects whose containers are registered.  All containers if empty.
+	labelSelector         labelSelector                   // Only containers matching it get names.  Empty matches every container.
+	maxDomains            int                             // Most names to register.  0 is unlimited.
+	reconcileInterval     time.Duration                   // How often to compare the registered containers with the running ones.  0 never does.
+	backoffMax            time.Duration                   // Longest delay between docker reconnects
+	hostAddress           string                          // IP of the docker host, for ports published on all interfaces.  "" if unknown.
+	selfID                atomic.Value                    // cjsocks's own container ID, a string.  Unset outside a container.
+	ownNetworks           atomic.Pointer[map[string]bool] // Lower case names of the networks cjsocks's own container is attached to.  nil if unknown.
+	hostAlias             string                          // Name resolving to the docker host.  "" disables it.
+	hostIP                string                          // IP the host alias resolves to: the host address or the cj network's gateway.  "" until known.
 	auto_add_to_cjnetwork bool
+	autoAddAll            bool // Auto-add containers without a cj label too
 }
 
-type BindFlags []string
+// Resolver looks up the address of a name in a socks5 request.  The ctx returned is passed on to the
+// connection, e.g. for port rewrites.  It has the signature of socks5.NameResolver.
+type Resolver interface {
+	Resolve(ctx context.Context, name string) (context.Context, net.IP, error)
+}
 
-func main() {
-	app := new(App)
-	app.emitter = emission.NewEmitter()
-	app.cjnetworkName = default_cj_network_name
-	app.fqdnToIp = make(map[string]string)
-	// TODO: Create the network name if it doesn't already exist.  Include labels.
+// Hooks are called as containers come and go.  Any of them may be nil.
+type Hooks struct {
+	OnContainerStart func(domains []string, ip string) // A container's domains were registered
+	OnContainerStop  func(domains []string)            // A container's domains were removed
+	OnDomainsUpdated func()                            // The FQDN to IP map changed
+}
 
-	b, _ := strconv.ParseBool(os.Getenv("CJ_AUTO_ADD"))
-	app.auto_add_to_cjnetwork = *flag.Bool("autoadd", b, "Default base domain for containers if not overridden")
+func (h Hooks) containerStarted(domains []string, ip string) {
+	if h.OnContainerStart != nil {
+		h.OnContainerStart(domains, ip)
+	}
+}
 
-	app.defaultBaseDomain = *flag.String("basedomain", os.Getenv("CJ_BASE_DOMAIN"), "Default base domain for containers if not overridden")
-	if app.defaultBaseDomain == "" {
-		app.defaultBaseDomain = default_base_domain
+func (h Hooks) containerStopped(domains []string) {
+	if h.OnContainerStop != nil {
+		h.OnContainerStop(domains)
 	}
+}
 
-	// Options:
-	// Start socks5 server on IP:port.
-	ip := os.Getenv("CJ_LISTEN_IP")
-	flag.String("listenip", ip, "IP address to start the socks5 server on")
-	if ip == "" {
-		ip = default_ip
+func (h Hooks) domainsUpdated() {
+	if h.OnDomainsUpdated != nil {
+		h.OnDomainsUpdated()
 	}
-	bindip := net.ParseIP(ip)
+}
+
+type BindFlags []string
 
-	bp := os.Getenv("CJ_SOCKS_PORT")
-	flag.String("port", bp, "Port to listen on")
-	if bp == "" {
-		bp = default_port
+// envOrDefault returns the value of the environment variable key, or def if it is unset or empty.
+func envOrDefault(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
-	bindport, _ := strconv.Atoi(bp)
+	return def
+}
 
-	containerStart := func(domains []string, ip string) {
-		fmt.Printf("ContainerStart %s\n%s\n\n", domains, ip)
+// envBoolOrDefault returns the boolean value of the environment variable key, or def if it is unset or invalid.
+func envBoolOrDefault(key string, def bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return v
 	}
+	return def
+}
 
-	containerStop := func(domains []string) {
-		fmt.Printf("ContainerStop %s\n\n", domains)
+// envIntOrDefault returns the integer value of the environment variable key, or def if it is unset or not a number.
+func envIntOrDefault(key string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
 	}
+	return def
+}
 
-	app.emitter.On("container-start", containerStart)
-	app.emitter.On("container-stop", containerStop)
+// envDurationOrDefault returns the duration value (e.g. "2s") of the environment variable key, or def if it is unset or invalid.
+func envDurationOrDefault(key string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
 
-	fmt.Println("Creating resolver")
+// splitList splits a comma separated list, dropping blank entries
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
 
-	// resolver := socks5.CJResolver{}
-	resolver := app
+// NewLogger returns a logger writing to w that discards messages below level (debug, info, warn or error)
+func NewLogger(w io.Writer, level string) (*slog.Logger, error) {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: logLevel})), nil
+}
 
-	fmt.Println("Creating conf")
+// RunOnce registers the running containers and writes their names to w, sorted, for -once
+func RunOnce(cfg Config, w io.Writer) error {
+	app, err := New(cfg)
+	if err != nil {
+		return err
+	}
+	return app.runOnce(w)
+}
 
-	conf := socks5.Config{
-		Resolver: resolver,
-		BindIP:   bindip,
-		BindPort: bindport,
+// runOnce registers the running containers with the client from app.dockerClient and writes their names to w
+func (app *App) runOnce(w io.Writer) error {
+	client, err := app.dockerClient()
+	if err != nil {
+		return err
+	}
+	if err := pingDocker(app.cfg, client); err != nil {
+		return err
+	}
+	if err := registerRunningContainers(app, client); err != nil {
+		return fmt.Errorf("could not register running containers: %w", err)
+	}
+	return writeDomains(w, app.Domains())
+}
+
+// writeDomains writes a table of FQDNs and their IPs sorted by FQDN
+func writeDomains(w io.Writer, domains map[string]string) error {
+	fqdns := make([]string, 0, len(domains))
+	for fqdn := range domains {
+		fqdns = append(fqdns, fqdn)
 	}
+	sort.Strings(fqdns)
 
-	fmt.Println("Creating socks server")
-	// This populates conf with defaults if I didn't provide a value.
-	server, err := socks5.New(&conf)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FQDN\tIP")
+	for _, fqdn := range fqdns {
+		fmt.Fprintf(tw, "%v\t%v\n", fqdn, domains[fqdn])
+	}
+	return tw.Flush()
+}
+
+// New returns an App configured from cfg.  It connects to docker once it is Run.
+func New(cfg Config) (*App, error) {
+	app := new(App)
+	app.cfg = cfg
+	app.cjnetworkName = cfg.CJNetworkName
+	app.noCreateNetwork = cfg.NoCreateNetwork
+	app.idToDomains = make(map[string][]string)
+	app.idToIp = make(map[string]string)
+	app.idToMeta = make(map[string]containerMeta)
+	app.fqdnOwners = make(map[string][]string)
+	app.paused = make(map[string]bool)
+	app.metrics = newMetrics()
+	app.stats = newTrafficStats()
+	app.resolver = app
+	app.removals = newPendingRemovals(cfg.RemovalGrace.Duration)
+	app.resyncs = make(chan chan resyncResult)
+	app.dockerClient = func() (dockerAPI, error) {
+		client, err := newDockerClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return withDockerTimeout(client, cfg.DockerTimeout.Duration), nil
+	}
+	if cfg.EventsJSON {
+		app.events = &eventLog{w: os.Stdout}
+	}
+	registry, err := newRegistry(cfg.Registry)
+	if err != nil {
+		return nil, err
+	}
+	app.registry = registry
+	app.auto_add_to_cjnetwork = cfg.AutoAdd
+	app.autoAddAll = cfg.AutoAddAll
+	destinations, err := newDestinationFilter(cfg.AllowCIDR, cfg.DenyCIDR)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	app.destinations = destinations
+	app.resolveCache = newResolveCache(cfg.ResolveCacheTTL.Duration, cfg.ResolveCacheSize)
+	if len(cfg.UpstreamDNS) > 0 {
+		upstream, err := newUpstreamResolver(cfg.UpstreamDNS)
+		if err != nil {
+			return nil, err
+		}
+		app.upstream = upstream
+		slog.Info("Using upstream DNS servers", "servers", app.upstream.servers)
+	}
+	app.networkPriority = cfg.NetworkPriority
+	app.preferIPv6 = cfg.PreferIPv6
+	app.strictResolve = cfg.StrictResolve
+	app.registerShortNames = cfg.RegisterShortNames
+	app.registerReplicaNames = cfg.RegisterReplicaNames
+	app.projectFilter = cfg.ProjectFilter
+	app.maxDomains = cfg.MaxDomains
+	app.networkSuffix = cfg.NetworkSuffix
+	app.swarm = cfg.Swarm
+	app.dockerSuffixAlias = cfg.DockerSuffixAlias
+	if app.labelSelector, err = parseLabelSelector(cfg.LabelSelector); err != nil {
+		return nil, err
+	}
+	app.backoffMax = cfg.BackoffMax.Duration
+	app.reconcileInterval = cfg.ReconcileInterval.Duration
+	app.collisionPolicy = cfg.CollisionPolicy
+	app.shortNameCollision = cfg.ShortNameCollision
+	for _, baseDomain := range splitList(cfg.BaseDomain) {
+		normalized, err := normalizeDomain(baseDomain)
+		if err != nil {
+			slog.Warn("Ignoring invalid base domain", "base_domain", baseDomain, "error", err)
+			continue
+		}
+		app.baseDomains = append(app.baseDomains, normalized)
+	}
+	if len(app.baseDomains) == 0 {
+		slog.Warn("No valid base domain, using the default", "base_domain", cfg.BaseDomain, "default", default_base_domain)
+		app.baseDomains = []string{default_base_domain}
+	}
+	app.dnsTTL = uint32(cfg.DNSTTL)
+	app.dnsSearch = cfg.DNSSearch
+	if address := cfg.dockerHostAddress(); address != "" {
+		ip, err := net.ResolveIPAddr("ip", address)
+		if err != nil {
+			slog.Warn("Could not resolve the docker host address.  Ports published on all interfaces are used as is", "address", address, "error", err)
+		} else {
+			app.hostAddress = ip.String()
+			slog.Info("Using docker host address for ports published on all interfaces", "address", address, "ip", app.hostAddress)
+		}
+	}
+	if cfg.HostAlias != "" {
+		alias, err := normalizeDomain(cfg.HostAlias)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host alias %q: %w", cfg.HostAlias, err)
+		}
+		app.hostAlias = alias
+		app.hostIP = app.hostAddress
+	}
+	if cfg.IgnoreNameRegex != "" {
+		ignoreNameRegex, err := regexp.Compile(cfg.IgnoreNameRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore name regex: %w", err)
+		}
+		app.ignoreNameRegex = ignoreNameRegex
 	}
 
-	fmt.Printf("Starting socks5 server on %v\n", net.IP.String(conf.BindIP)+":"+strconv.Itoa(conf.BindPort))
+	app.hooks.OnContainerStart = func(domains []string, ip string) {
+		slog.Info("Container started", "fqdn", domains[0], "fqdns", domains, "ip", ip)
+	}
 
-	go app.monitorDocker()
+	app.hooks.OnContainerStop = func(domains []string) {
+		slog.Info("Container stopped", "fqdn", domains[0], "fqdns", domains)
+	}
 
-	// Start the socks5 server
-	// For some reason I have to specify the protocol, address and port even though conf has it.
-	// TODO: Add a check for data:EADDRINUSE  (address in use).  Retry some period of time.
-	if err := server.ListenAndServe(listen_protocol, net.IP.String(conf.BindIP)+":"+strconv.Itoa(conf.BindPort)); err != nil {
-		panic(err)
+	if cfg.WebhookURL != "" {
+		app.webhook = newWebhook(cfg.WebhookURL)
+		logStart, logStop := app.hooks.OnContainerStart, app.hooks.OnContainerStop
+		app.hooks.OnContainerStart = func(domains []string, ip string) {
+			logStart(domains, ip)
+			app.webhook.send(webhookEvent{Event: "added", FQDNs: domains, IP: ip})
+		}
+		app.hooks.OnContainerStop = func(domains []string) {
+			logStop(domains)
+			app.webhook.send(webhookEvent{Event: "removed", FQDNs: domains})
+		}
+	}
+
+	if cfg.HostsFile != "" {
+		hosts := &hostsFileUpdater{path: cfg.HostsFile}
+		app.hooks.OnDomainsUpdated = func() {
+			if err := hosts.update(app.Domains()); err != nil {
+				slog.Error("Could not update hosts file", "path", hosts.path, "error", err)
+			}
+		}
 	}
+	return app, nil
+}
 
+// SetResolver replaces how the socks5 server resolves names, e.g. with a stub in tests.  resolver takes the
+// place of the registered containers, the upstream DNS servers and the allow and deny lists, but can fall back
+// to them by calling app.Resolve.  Must be called before Run.
+func (app *App) SetResolver(resolver Resolver) {
+	app.resolver = resolver
 }
 
-func (app *App) monitorDocker() {
-	// Monitors a channel of docker events
-	fmt.Println("Starting docker events listener")
+// Run starts the socks5 server and everything around it, and blocks until ctx is cancelled or a server fails.
+// Startup errors are returned rather than exiting, so the caller decides how to report them.
+func (app *App) Run(ctx context.Context) error {
+	cfg := app.cfg
 
-	client, err := docker.NewClient("unix:///var/run/docker.sock")
+	// resolver := socks5.CJResolver{}
+	resolver := app.resolver
 
-	if err != nil {
-		panic(err)
-	}
+	// Also cancelled when one of the servers fails, to stop the others
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	// Create the network if it doesn't exist
-	network_options := docker.CreateNetworkOptions{
-		Name:           app.cjnetworkName,
-		Labels:         map[string]string{"description": "Default network used by cj-socks to bridge communication to other containers."},
-		CheckDuplicate: true,
-		Attachable:     true,
+	discoveryAddr := ""
+	if cfg.EnableDiscovery {
+		var err error
+		if discoveryAddr, err = app.listenDiscovery(ctx); err != nil {
+			return fmt.Errorf("could not start the discovery responder: %w", err)
+		}
 	}
-	fmt.Println("Creating network in case it does not already exist", app.cjnetworkName)
-	_, e := client.CreateNetwork(network_options)
-	if e != nil {
-		fmt.Printf("WARNING: Could not create network %v %T %#v\n", app.cjnetworkName, e, e)
-		// TODO: Need to figure out how to extract the docker error structure from the error
-		//var dockererror *docker.Error = &e
-		/*
-			if e.Status == 409 {
-				// Network already existed
-				panic(e)
-			} else {
-				panic(e)
-			}
-		*/
+
+	conf := newSocksConfig(cfg, resolver, app.destinations, app.stats, discoveryAddr, slog.Default())
+
+	// This populates conf with defaults if I didn't provide a value.
+	server, err := socks5.New(conf)
+	if err != nil {
+		return fmt.Errorf("could not create socks5 server: %w", err)
 	}
 
-	registerRunningContainers(app, client)
+	slog.Info("Starting socks5 server", "network", cfg.listenNetwork(), "addr", cfg.listenAddr())
 
-	events := make(chan *docker.APIEvents)
-	err = client.AddEventListener(events)
+	client, err := app.dockerClient()
 	if err != nil {
-		panic(err)
+		return err
 	}
+	app.docker = client
 
-	defer client.RemoveEventListener(events)
+	// Without docker the socks5 server still serves names that aren't containers
+	pingErr := client.Ping()
+	if pingErr == nil {
+		if err := createNetwork(app, client); err != nil {
+			return err
+		}
+	} else {
+		slog.Warn("Could not reach the docker daemon.  Container names won't resolve until it is reachable (is the docker socket mounted?  Use -docker-host or DOCKER_HOST to change it)", "docker_host", cfg.DockerHost, "error", pingErr)
+	}
 
-	// Loops constantly on events
-	for event := range events {
-		action := strings.Split(event.Action, ":")[0] // Some actions include details.  But most are just the word.
-		switch action {
-		case "exec_create", "exec_start", "exec_die":
-		case "create":
-			fmt.Printf("Event [%v]\n", event.Action)
-			if app.auto_add_to_cjnetwork {
-				container, _ := client.InspectContainer(event.ID)
+	// Changes queued before Run are sent now
+	if app.webhook != nil {
+		go app.webhook.run(ctx)
+	}
 
-				// Check if the container is already in our targeted socks network
-				// or one of the networks attached to this (the cj-socks) container
-				for networkname, net := range container.NetworkSettings.Networks {
-					fmt.Printf("Network %v = %v %#v", networkname, net.IPAddress, net)
-				}
+	serverErrs := make(chan error, 3)
+	monitorDone := make(chan struct{})
+	go func() {
+		defer close(monitorDone)
+		if pingErr != nil {
+			if !app.waitForDocker(ctx, client) {
+				return
+			}
+			if err := createNetwork(app, client); err != nil {
+				serverErrs <- err
+				cancel()
+				return
+			}
+		}
+		app.monitorDocker(ctx, client)
+	}()
+
+	if cfg.DNSPort > 0 {
+		go func() {
+			if err := app.serveDNS(ctx, cfg.ListenIP, cfg.DNSPort); err != nil {
+				serverErrs <- fmt.Errorf("DNS server failed: %w", err)
+				cancel()
+			}
+		}()
+	}
 
-				opts := docker.NetworkConnectionOptions{
-					Container: container.ID,
-					Force:     false,
-				}
-				fmt.Println("Connecting network cj-proxy")
-				client.ConnectNetwork(app.cjnetworkName, opts)
+	if cfg.AdminPort > 0 {
+		go func() {
+			if err := app.serveAdmin(ctx, cfg.ListenIP, cfg.AdminPort); err != nil {
+				serverErrs <- fmt.Errorf("admin server failed: %w", err)
+				cancel()
 			}
-		case "start":
-			fmt.Printf("Event [%v]\n", event.Action)
-			container, _ := client.InspectContainer(event.ID)
-
-			fmt.Printf("\nLabels: %#v\n", container.Config.Labels)
-			ip := getContainerIP(app, client, event.ID)
-			domains := getDomains(client, event.ID, app.defaultBaseDomain)
-			app.registerDomains(domains, ip)
-			/*
-				fmt.Printf("Got docker events Action [%v]\n%%#v=%#v\n %%v=%v\n\n", event.Action, event, event)
-				domains := getDomains(client, event.ID, app)
-				// TODO: If the container has a cj label then automatically add it to the cj network.
-				// TODO: If container is added/removed on cj-network then update domain names list
-				ip := getContainerIP(client, event.ID)
-				app.registerDomains(domains, ip)
-				app.emitter.Emit("container-start", domains, ip)
-				app.emitter.Emit("domains-updated")
-			*/
-		// Also: "destroy" when container deleted and "disconnect" when stopped/removed from network
-		case "destroy", "stop", "kill", "die":
-			fmt.Printf("Event [%v]\n", event.Action)
-			/*
-				fmt.Printf("Got docker events Action [%v]\n%%#v=%#v\n %%v=%v\n\n", event.Action, event, event)
-				domains := getDomains(client, event.ID)
-				app.removeDomains(domains)
-				app.emitter.Emit("container-stop", domains)
-				app.emitter.Emit("domains-updated")
-			*/
-		case "disconnect": // Disconnected from a network.  Container may not be running!
-			// Disconnect event fires when container is stopped or removed from network.
-			// However the IP address has been disposed at this point
-			fmt.Printf("Event [%v]\n%%#v=%#v\n", event.Action, event)
-		case "connect": // Connected to a network.  Only fires when container starts or is running.
-			// NOTE: IP Address is not available at time of connect.
-			fmt.Printf("Event [%v]\n%%#v=%#v\n", event.Action, event)
-		default:
-			fmt.Printf("Unhandled event [%v]\n", event.Action)
-			// fmt.Printf("Got docker events Action [%v]\n%%#v=%#v\n %%v=%v\n\n", event.Action, event, event)
+		}()
+	}
+
+	// Start the socks5 server
+	// For some reason I have to specify the protocol, address and port even though conf has it.
+	listenAddr := cfg.listenAddr()
+	if cfg.UnixSocket != "" {
+		err = removeStaleSocket(cfg.UnixSocket)
+	}
+	var listener net.Listener
+	if err == nil {
+		listener, err = listenWithRetry(cfg.listenNetwork(), listenAddr, cfg.BindRetries, newBackoff(cfg.BindRetryDelay.Duration, cfg.BackoffMax.Duration))
+	}
+	if err == nil && cfg.UnixSocket != "" {
+		if err = os.Chmod(cfg.UnixSocket, unix_socket_mode); err != nil {
+			listener.Close()
 		}
 	}
-}
+	// The UDP relay shares the port number of the socks5 server
+	var relay *net.UDPConn
+	if err == nil && cfg.EnableUDP {
+		if relay, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(cfg.ListenIP), Port: cfg.Port}); err != nil {
+			listener.Close()
+		}
+	}
+	if err != nil {
+		cancel()
+		<-monitorDone
+		return fmt.Errorf("could not listen on %v: %w", listenAddr, err)
+	}
 
-func (app *App) registerDomains(domains []string, ip string) {
-	if ip == "" {
-		return
+	go func() {
+		<-ctx.Done()
+		listener.Close() // Stops the socks5 server
+	}()
+	if relay != nil {
+		go relayUDP(ctx, relay, resolver)
 	}
-	for _, fqdn := range domains {
-		// app.records[domain] = ip
-		fmt.Printf("\t[%v] [%v]\n", fqdn, ip)
-		app.fqdnToIp[fqdn] = ip
+	// The wrappers get their own variable, since the goroutine above reads listener
+	served := listener
+	if cfg.MaxConnsPerSec > 0 {
+		slog.Info("Limiting socks5 connections", "per_second", cfg.MaxConnsPerSec)
+		served = rateLimitedListener{Listener: served, bucket: newTokenBucket(cfg.MaxConnsPerSec)}
 	}
-}
+	tracker := newConnTracker()
+	served = trackingListener{Listener: served, tracker: tracker}
 
-func (app *App) removeDomains(domains []string) {
-	for _, domain := range domains {
-		delete(app.fqdnToIp, domain)
+	if err := serveSocks(server, served); err != nil && ctx.Err() == nil {
+		cancel()
+		<-monitorDone
+		return fmt.Errorf("socks5 server failed: %w", err)
+	}
+	// No new connections are accepted now, but the open ones may be in the middle of a download
+	tracker.drain(cfg.DrainTimeout.Duration)
+
+	select {
+	case <-monitorDone:
+		slog.Info("Shutdown complete")
+	case <-time.After(shutdown_timeout):
+		slog.Warn("Timed out waiting for the docker events listener to stop")
+	}
+
+	select {
+	case err := <-serverErrs:
+		return err
+	default:
+		return nil
 	}
 }
 
-func getContainerIP(app *App, client *docker.Client, ID string) string {
-	// WARNING: A blank IP address can get returned for some containers exposed only on the host network adapter.
-	// IP Address exposed inside the Docker network.  Or host IP if not exposed on the Docker network.
-	// IP priority order:
-	// - If connected to the network named app.cjnetworkName, its IP address
-	// - If connected to another docker network, the first IP address found
-	// - The address on the first attached network (could be blank if only connected on Host network)
-	// - "HostIp" if the container is exposed on the host network
-	container, _ := client.InspectContainer(ID)
-
-	var ip string
-	var firstip string
-
-	// Check if the container is already in our targeted socks network
-	// or one of the networks attached to this (the cj-socks) container
-	for networkname, net := range container.NetworkSettings.Networks {
-		if firstip == "" {
-			firstip = net.IPAddress
-		}
-		// fmt.Printf("Network %v = %v %#v", networkname, net.IPAddress, net)
-		if strings.ToLower(networkname) == app.cjnetworkName {
-			ip = net.IPAddress
-			break
+// newSocksConfig returns the socks5 server configuration for cfg, resolving names with resolver.  Traffic is
+// counted in stats, unless it is nil.  Connections to the discovery pseudo-host go to discoveryAddr, unless it is "".
+func newSocksConfig(cfg Config, resolver socks5.NameResolver, filter *destinationFilter, stats *trafficStats, discoveryAddr string, logger *slog.Logger) *socks5.Config {
+	dial := newDial(cfg.DialTimeout.Duration, cfg.IdleTimeout.Duration)
+	if discoveryAddr != "" {
+		dial = discoveryDial(discoveryAddr, dial)
+	}
+	if stats != nil {
+		dial = statsDial(stats, dial)
+	}
+	conf := &socks5.Config{
+		Resolver: resolver,
+		Rewriter: portRewriter{},
+		// UDP associate needs the UDP relay Run starts with -enable-udp
+		Rules:  accessLogRules{rules: destinationRules{filter: filter, rules: &socks5.PermitCommand{EnableConnect: true, EnableBind: true, EnableAssociate: cfg.EnableUDP}}},
+		Dial:   accessLogDial(dial),
+		BindIP: net.ParseIP(cfg.ListenIP),
+		Logger: slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	if cfg.EnableUDP {
+		slog.Warn("Enabling socks5 UDP associate.  Anyone who can reach the UDP port can relay datagrams through it", "port", cfg.Port)
+		// The library tells clients to send to BindIP:BindPort, and to 127.0.0.1 when BindIP is unspecified
+		if conf.BindIP.IsUnspecified() {
+			slog.Warn("UDP associate replies tell clients to send to 127.0.0.1, so only local clients can use the relay", "listen_ip", cfg.ListenIP)
 		}
+		conf.BindPort = cfg.Port
 	}
 
-	if ip == "" {
-		ip = firstip
+	// Without credentials the server stays open to anyone on the network
+	if cfg.SocksUser != "" {
+		slog.Info("Enabling socks5 username/password authentication", "user", cfg.SocksUser)
+		conf.Credentials = socks5.StaticCredentials{cfg.SocksUser: cfg.SocksPass}
 	}
+	return conf
+}
 
-	if ip == "" {
-		for _, bindings := range container.NetworkSettings.Ports {
-			for _, b := range bindings {
-				ip = b.HostIP
-				if ip != "" {
-					break
-				}
-			}
-		}
+// dockerAPI is the part of the docker client used once connected.  *docker.Client implements it, and
+// anything else that does (e.g. a fake daemon) can stand in for it.
+type dockerAPI interface {
+	InspectContainer(id string) (*docker.Container, error)
+	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+	AddEventListener(listener chan<- *docker.APIEvents) error
+	RemoveEventListener(listener chan *docker.APIEvents) error
+	CreateNetwork(opts docker.CreateNetworkOptions) (*docker.Network, error)
+	NetworkInfo(id string) (*docker.Network, error)
+	ConnectNetwork(id string, opts docker.NetworkConnectionOptions) error
+	ListServices(opts docker.ListServicesOptions) ([]swarm.Service, error)
+	InspectService(id string) (*swarm.Service, error)
+	Ping() error
+}
+
+// timeoutDocker bounds each docker call by timeout, so a hung daemon can't block the event loop.  Event listeners
+// are long lived and NetworkInfo and InspectService have no context aware variant, so those calls aren't bounded.
+type timeoutDocker struct {
+	*docker.Client
+	timeout time.Duration
+}
+
+// withDockerTimeout returns client with each call bounded by timeout.  0 leaves the calls unbounded.
+func withDockerTimeout(client *docker.Client, timeout time.Duration) dockerAPI {
+	if timeout <= 0 {
+		return client
 	}
+	return timeoutDocker{Client: client, timeout: timeout}
+}
 
-	return ip
+// call runs fn with a context that expires after the timeout and logs calls that were abandoned
+func (d timeoutDocker) call(name string, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	err := fn(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		slog.Warn("Docker call timed out", "call", name, "timeout", d.timeout)
+	}
+	return err
+}
+
+func (d timeoutDocker) InspectContainer(id string) (container *docker.Container, err error) {
+	err = d.call("inspect container", func(ctx context.Context) error {
+		container, err = d.Client.InspectContainerWithContext(id, ctx)
+		return err
+	})
+	return container, err
+}
+
+func (d timeoutDocker) ListContainers(opts docker.ListContainersOptions) (containers []docker.APIContainers, err error) {
+	err = d.call("list containers", func(ctx context.Context) error {
+		opts.Context = ctx
+		containers, err = d.Client.ListContainers(opts)
+		return err
+	})
+	return containers, err
+}
+
+func (d timeoutDocker) CreateNetwork(opts docker.CreateNetworkOptions) (network *docker.Network, err error) {
+	err = d.call("create network", func(ctx context.Context) error {
+		opts.Context = ctx
+		network, err = d.Client.CreateNetwork(opts)
+		return err
+	})
+	return network, err
+}
+
+func (d timeoutDocker) ConnectNetwork(id string, opts docker.NetworkConnectionOptions) error {
+	return d.call("connect network", func(ctx context.Context) error {
+		opts.Context = ctx
+		return d.Client.ConnectNetwork(id, opts)
+	})
 }
 
-// Resolve ...
-func (app App) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
-	fmt.Printf("Custom resolver called for %s\n", name)
+func (d timeoutDocker) ListServices(opts docker.ListServicesOptions) (services []swarm.Service, err error) {
+	err = d.call("list services", func(ctx context.Context) error {
+		opts.Context = ctx
+		services, err = d.Client.ListServices(opts)
+		return err
+	})
+	return services, err
+}
+
+func (d timeoutDocker) Ping() error {
+	return d.call("ping", func(ctx context.Context) error {
+		return d.Client.PingWithContext(ctx)
+	})
+}
+
+// pingDocker checks the docker daemon at cfg.DockerHost is reachable with client.
+func pingDocker(cfg Config, client dockerAPI) error {
+	if err := client.Ping(); err != nil {
+		return fmt.Errorf("could not reach the docker daemon at %q (is the docker socket mounted?  Use -docker-host or DOCKER_HOST to change it): %w", cfg.DockerHost, err)
+	}
+	return nil
+}
 
-	var addr *net.IPAddr
+// newDockerClient creates a docker client for cfg.DockerHost without contacting the daemon.
+// A tcp endpoint uses TLS when any of the docker TLS files are configured.
+func newDockerClient(cfg Config) (*docker.Client, error) {
+	endpoint := cfg.DockerHost
+	var client *docker.Client
 	var err error
-	if ip := app.fqdnToIp[name]; ip != "" {
-		addr, err = net.ResolveIPAddr("ip", ip)
+	if cfg.dockerTLS() && !strings.HasPrefix(endpoint, "unix://") {
+		if err := checkDockerTLSFiles(cfg); err != nil {
+			return nil, err
+		}
+		client, err = docker.NewTLSClient(endpoint, cfg.DockerTLSCert, cfg.DockerTLSKey, cfg.DockerTLSCA)
 	} else {
-		addr, err = net.ResolveIPAddr("ip", name)
+		client, err = docker.NewClient(endpoint)
 	}
 	if err != nil {
-		fmt.Printf("Got an error %s\n", name)
-		return ctx, nil, err
+		return nil, fmt.Errorf("invalid docker endpoint %q: %w", endpoint, err)
+	}
+	return client, nil
+}
+
+// waitForDocker pings the docker daemon with backoff until it answers.
+// Returns false if ctx is cancelled first.
+func (app *App) waitForDocker(ctx context.Context, client dockerAPI) bool {
+	delays := newBackoff(docker_reconnect_delay, app.backoffMax)
+	for {
+		delay := delays.next()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		err := client.Ping()
+		if err == nil {
+			slog.Info("Docker daemon is reachable")
+			return true
+		}
+		slog.Info("Docker daemon is still unreachable", "error", err)
+	}
+}
+
+// checkDockerTLSFiles fails when TLS to docker is requested but the certificate, key or CA file can't be read.
+// The docker client silently ignores missing files, which leads to confusing handshake errors.
+func checkDockerTLSFiles(cfg Config) error {
+	files := []struct{ flag, path string }{
+		{"-docker-tls-cert", cfg.DockerTLSCert},
+		{"-docker-tls-key", cfg.DockerTLSKey},
+		{"-docker-tls-ca", cfg.DockerTLSCA},
 	}
-	fmt.Printf("Returning address %s\n", net.IP.String(addr.IP))
-	return ctx, addr.IP, err
+	for _, file := range files {
+		if file.path == "" {
+			return fmt.Errorf("docker TLS is enabled but %v is not set", file.flag)
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			return fmt.Errorf("docker TLS file for %v: %w", file.flag, err)
+		}
+	}
+	return nil
 }
 
-func registerRunningContainers(app *App, client *docker.Client) {
-	fmt.Println("Registering running containers")
+// createNetwork creates the cj network.  A network that already exists is reused, with a warning if it
+// doesn't look like one cjsocks created.  With -no-create-network it is only inspected.
+func createNetwork(app *App, client dockerAPI) error {
+	if app.noCreateNetwork {
+		slog.Info("Not creating network, it should already exist", "network", app.cjnetworkName)
+		checkNetwork(app, client)
+		return nil
+	}
+	network_options := docker.CreateNetworkOptions{
+		Name:           app.cjnetworkName,
+		Labels:         map[string]string{"description": cj_network_description},
+		CheckDuplicate: true,
+		Attachable:     true,
+	}
+	slog.Info("Creating network in case it does not already exist", "network", app.cjnetworkName)
+	_, err := client.CreateNetwork(network_options)
 
-	containers, err := client.ListContainers(docker.ListContainersOptions{})
+	// 409 Conflict: the network already exists
+	var dockerErr *docker.Error
+	if err != nil && (!errors.As(err, &dockerErr) || dockerErr.Status != http.StatusConflict) {
+		return fmt.Errorf("could not create network %v: %w", app.cjnetworkName, err)
+	}
+	checkNetwork(app, client)
+	return nil
+}
 
+// checkNetwork inspects the cj network and logs what it is.  Problems are only logged, since containers
+// may still be reachable on their other networks.
+func checkNetwork(app *App, client dockerAPI) {
+	network, err := client.NetworkInfo(app.cjnetworkName)
 	if err != nil {
-		panic(err)
+		slog.Warn("Could not inspect network.  Containers may have no IP on it, so their IPs come from other networks and may not be reachable", "network", app.cjnetworkName, "error", err)
+		return
 	}
-	for _, container := range containers {
-		domains := getDomains(client, container.ID, app.defaultBaseDomain)
-		ip := getContainerIP(app, client, container.ID)
+	subnets := make([]string, 0, len(network.IPAM.Config))
+	for _, config := range network.IPAM.Config {
+		subnets = append(subnets, config.Subnet)
+	}
+	slog.Info("Using network", "network", app.cjnetworkName, "driver", network.Driver, "subnets", subnets)
+	if gateway := networkGateway(network.IPAM); gateway != "" {
+		app.setHostIP(gateway)
+	}
+	if network.Labels["description"] != cj_network_description {
+		slog.Warn("Network already exists but was not created by cjsocks", "network", app.cjnetworkName)
+	}
+	// The docker client doesn't report the Attachable flag.  It only matters for swarm scoped networks.
+	if network.Driver == "overlay" {
+		slog.Warn("Network is an overlay network.  Containers can only join it if it is attachable", "network", app.cjnetworkName)
+	}
+}
 
-		app.registerDomains(domains, ip)
+// removeStaleSocket removes a unix socket left behind by a server that didn't shut down cleanly.
+// A socket that still accepts connections is left alone so listening on it fails as in use.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
 	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%v exists and is not a unix socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil
+	}
+	slog.Info("Removing stale unix socket", "path", path)
+	return os.Remove(path)
+}
 
-	app.emitter.Emit("domains-updated")
+// listenWithRetry listens on addr, retrying with exponential backoff while the address is in use.
+func listenWithRetry(network string, addr string, retries int, delays *backoff) (net.Listener, error) {
+	for attempt := 1; ; attempt++ {
+		listener, err := net.Listen(network, addr)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) || attempt > retries {
+			return listener, err
+		}
+		delay := delays.next()
+		slog.Warn("Address is in use", "addr", addr, "retry", attempt, "retries", retries, "delay", delay)
+		time.Sleep(delay)
+	}
 }
 
-func getDomains(client *docker.Client, ID string, defaultBaseDomain string) []string {
-	domains := []string{}
-	container, _ := client.InspectContainer(ID)
+func (app *App) monitorDocker(ctx context.Context, client dockerAPI) {
+	// Monitors a channel of docker events
+	slog.Info("Starting docker events listener")
+
+	delays := newBackoff(docker_reconnect_delay, app.backoffMax)
+	for {
+		// The docker client drops events when the listener isn't ready, so leave room for bursts
+		events := make(chan *docker.APIEvents, docker_events_buffer)
+		err := client.AddEventListener(events)
+		if err == nil {
+			// Resync on every (re)connect since events may have been missed while disconnected
+			err = registerRunningContainers(app, client)
+		}
+		if err == nil {
+			delays.reset()
+			app.ready.Store(true)
+			ok := app.processEvents(ctx, client, events)
+			app.ready.Store(false)
+			if !ok {
+				client.RemoveEventListener(events)
+				return
+			}
+			slog.Warn("Docker event stream closed")
+		} else {
+			slog.Warn("Could not listen for docker events", "error", err)
+		}
 
-	// Private host name
-	// service_hostname := container.Config.Labels[label_docker_compose_service]
+		// Remove the old listener so reconnecting doesn't leave a duplicate behind
+		client.RemoveEventListener(events)
+		delay := delays.next()
+		slog.Info("Reconnecting to docker", "delay", delay)
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopping docker events listener")
+			return
+		case <-time.After(delay):
+		}
+	}
+}
 
-	// Public host name
-	// Order of precedence: Host name label, docker service name, container host name, container name
-	public_hostname := container.Config.Labels[label_cj_hostname]
-	if public_hostname == "" {
-		public_hostname = container.Config.Labels[label_docker_compose_service]
+// processEvents handles events until the channel closes or ctx is cancelled.
+// Returns false when ctx was cancelled and the listener should not reconnect.
+func (app *App) processEvents(ctx context.Context, client dockerAPI, events chan *docker.APIEvents) bool {
+	// Reconciling and resyncing here rather than in their own goroutines keeps them from racing the events.
+	// A nil channel never fires.
+	var reconcile <-chan time.Time
+	if app.reconcileInterval > 0 {
+		ticker := time.NewTicker(app.reconcileInterval)
+		defer ticker.Stop()
+		reconcile = ticker.C
 	}
-	if public_hostname == "" {
-		// Docker will automatically generate a 12 character host name if none is configured
-		// TODO: Be a little more creative than just checking name length = 12.  Maybe regex replace [a-f0-9] and verify all 12 characters are a match.
-		if len(container.Config.Hostname) != 12 && container.Config.Hostname > "" {
-			public_hostname = container.Config.Hostname
-		} else {
-			public_hostname = container.Name[1:] // Skip the leading slash
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopping docker events listener")
+			return false
+		case event, ok := <-events:
+			if !ok {
+				return true
+			}
+			app.handleEvent(client, event)
+		case <-reconcile:
+			if err := app.reconcile(client, false); err != nil {
+				slog.Warn("Could not reconcile containers", "error", err)
+			}
+		case reply := <-app.resyncs:
+			count, err := app.resync(client)
+			reply <- resyncResult{count: count, err: err}
 		}
 	}
+}
 
-	// --- FQDN
-	fqdn := public_hostname + "."
-	// --- Full domain name
-	//     Order of precedence:
-	//       If label says then only use the container domain name.
-	//       otherwise
-	//       Subdomain label or compose project + label domain or container domain name or external configured domain
-	if container.Config.Labels[label_cj_flag_use_container_base_domain] == "true" && container.Config.Domainname > "" {
-		fqdn = public_hostname + "." + container.Config.Domainname
-	} else {
-		// --- or Sub domain + Base domain name
-		fqdn = public_hostname + "."
-		if container.Config.Labels[label_cj_subdomain] != "" {
-			fqdn += container.Config.Labels[label_cj_subdomain] + "."
-		} else if container.Config.Labels[label_docker_compose_project] > "" {
-			fqdn += container.Config.Labels[label_docker_compose_project] + "."
+// handleEvent updates the registered domains for a single docker event
+func (app *App) handleEvent(client dockerAPI, event *docker.APIEvents) {
+	action := strings.Split(event.Action, ":")[0] // Some actions include details.  But most are just the word.
+	log := slog.With("event", event.Action, "container_id", event.ID)
+	app.metrics.incDockerEvent(action)
+	if event.Type == "service" {
+		if app.swarm {
+			app.handleServiceEvent(client, event)
 		}
-		if container.Config.Labels[label_cj_domain] != "" {
-			fqdn += container.Config.Labels[label_cj_domain]
-		} else if container.Config.Labels[label_cj_flag_use_container_base_domain] == "true" && container.Config.Domainname != "" {
-			fqdn += container.Config.Domainname
-		} else {
-			fqdn += defaultBaseDomain
+		return
+	}
+	switch action {
+	case "exec_create", "exec_start", "exec_die":
+	case "create":
+		log.Debug("Docker event")
+		if app.auto_add_to_cjnetwork {
+			container, err := client.InspectContainer(event.ID)
+			if err != nil {
+				log.Warn("Could not inspect container", "error", err)
+				return
+			}
+			if app.wantsCJNetwork(container) {
+				app.connectToCJNetwork(client, container)
+			}
+		}
+	case "start":
+		log.Debug("Docker event")
+		// TODO: If container is added/removed on cj-network then update domain names list
+		app.cancelRemoval(event.ID)
+		container, err := client.InspectContainer(event.ID)
+		if err != nil {
+			log.Warn("Could not inspect container", "error", err)
+			return
+		}
+		// Connected when it was created, or created before cjsocks was listening
+		if app.auto_add_to_cjnetwork && app.wantsCJNetwork(container) {
+			container = app.connectToCJNetwork(client, container)
 		}
+		if !app.addInspected(container, "start") {
+			log.Debug("Container has no IP yet, retrying")
+			go app.retryAddContainer(client, event.ID)
+		}
+	// Also: "destroy" when container deleted and "disconnect" when stopped/removed from network
+	case "destroy", "stop", "die":
+		log.Debug("Docker event")
+		// The container can no longer be inspected reliably, so use the domains cached when it started.
+		app.scheduleRemoval(event.ID)
+	case "rename":
+		log.Debug("Docker event", "old_name", event.Actor.Attributes["oldName"], "name", event.Actor.Attributes["name"])
+		// The old name only survives in the cached domains.  The new one comes from inspecting the container.
+		// Reported as a single rename with the new names
+		app.dropContainer(event.ID, "")
+		app.addContainer(client, event.ID, "rename")
+	case "update":
+		// Labels may have changed, and with them the names
+		log.Debug("Docker event")
+		app.updateContainer(client, event.ID)
+	case "pause":
+		// A paused container keeps its IP but can't answer, so stop handing it out until it is unpaused
+		log.Debug("Docker event")
+		app.setPaused(event.ID, true)
+	case "unpause":
+		log.Debug("Docker event")
+		app.setPaused(event.ID, false)
+	case "kill":
+		// A kill may be a non fatal signal (e.g. SIGHUP).  A "die" event follows if the container actually exits.
+		log.Debug("Docker event")
+	case "disconnect": // Disconnected from a network.  Container may not be running!
+		// Disconnect event fires when container is stopped or removed from network.
+		// However the IP address has been disposed at this point, so work out which address is left.
+		// Network events are about the network.  The container is in the attributes.
+		ID := event.Actor.Attributes["container"]
+		log.Debug("Docker event", "container_id", ID, "attributes", event.Actor.Attributes)
+		// Registered containers keep their addresses until they change or a resync
+		if app.isSelf(ID) {
+			app.refreshOwnNetworks(client)
+		}
+		app.refreshContainer(client, ID)
+	case "connect": // Connected to a network.  Only fires when container starts or is running.
+		// NOTE: IP Address is not available at time of connect.
+		log.Debug("Docker event", "attributes", event.Actor.Attributes)
+		if app.isSelf(event.Actor.Attributes["container"]) {
+			app.refreshOwnNetworks(client)
+		}
+	default:
+		log.Debug("Unhandled docker event")
+	}
+}
 
+// wantsCJNetwork reports whether -autoadd connects a container to the cj network: only containers that opted in
+// with a cj label, unless -auto-add-all is set
+func (app *App) wantsCJNetwork(container *docker.Container) bool {
+	if !app.autoAddAll && !hasCJLabel(container.Config.Labels) {
+		slog.Debug("Not connecting container without a cj label to network", "container_id", container.ID, "network", app.cjnetworkName)
+		return false
 	}
-	domains = append(domains, fqdn)
+	return true
+}
 
-	/*
-		if "" != container.Config.Domainname {
-			domains := append(domains, container.Config.Hostname+"."+container.Config.Domainname)
+// connectToCJNetwork connects a container to the cj network, unless it is already on it, and reports the IP it
+// has there.  Returns the container inspected again after connecting, for registering it with that IP.  A
+// container connected when it is created only gets its IP when it starts, which reports it again.
+func (app *App) connectToCJNetwork(client dockerAPI, container *docker.Container) *docker.Container {
+	log := slog.With("container_id", container.ID, "network", app.cjnetworkName)
+	if ip, ok := app.cjNetworkIP(container); ok {
+		if ip != "" {
+			log.Info("Container has IP on network", "ip", ip)
+		} else {
+			log.Debug("Container is already on the network, it gets an IP when it starts")
 		}
-	*/
+		return container
+	}
 
-	//domains = append(domains, container.Name[1:]+".docker")
-	/*
-		envDomains := getDomainsFromEnv(container.Config.Env)
+	opts := docker.NetworkConnectionOptions{
+		Container: container.ID,
+		Force:     false,
+	}
+	log.Info("Connecting container to network")
+	if err := client.ConnectNetwork(app.cjnetworkName, opts); err != nil {
+		log.Warn("Could not connect container to network", "error", err)
+		return container
+	}
 
-		for _, domain := range envDomains {
-			domains = append(domains, domain)
+	connected, err := client.InspectContainer(container.ID)
+	if err != nil {
+		log.Warn("Could not inspect container", "error", err)
+		return container
+	}
+	if ip, _ := app.cjNetworkIP(connected); ip != "" {
+		log.Info("Connected container to network", "ip", ip)
+	} else {
+		log.Debug("Connected container to network, it gets an IP when it starts")
+	}
+	return connected
+}
+
+// cjNetworkIP returns the address of a container on the cj network, or "" if it has none yet, and whether the
+// container is on the network at all
+func (app *App) cjNetworkIP(container *docker.Container) (string, bool) {
+	for networkname, network := range container.NetworkSettings.Networks {
+		if strings.EqualFold(networkname, app.cjnetworkName) {
+			if network.IPAddress != "" {
+				return network.IPAddress, true
+			}
+			return network.GlobalIPv6Address, true
 		}
-	*/
+	}
+	return "", false
+}
 
-	return domains
+// containerMeta is what is remembered about a registered container besides its names and IP
+type containerMeta struct {
+	service      string      // Compose "project/service", or "" if it wasn't started by compose.  Replicas share their names.
+	ttl          uint32      // DNS TTL in seconds from the ttl label.  0 uses app.dnsTTL.
+	hostname     string      // The host name label, lower cased.  "" if the name was derived from the container.
+	canonical    string      // The canonical label, lower cased.  "" uses the container's first name.
+	ports        map[int]int // Destination ports to rewrite from the port_map label, or nil
+	upstream     string      // External host from the upstream label the names resolve to instead, or ""
+	upstreamPort int         // Port from the upstream label every connection goes to, or 0 to keep the requested port
+	v4           net.IP      // The container's IPv4 address for A answers, or nil
+	v6           net.IP      // The container's IPv6 address for AAAA answers, or nil
+}
+
+// inspectedMeta returns the containerMeta of an inspected container
+func (app *App) inspectedMeta(container *docker.Container) containerMeta {
+	meta := labelMeta(container.ID, container.Config.Labels)
+	meta.v4, meta.v6 = app.containerFamilies(container)
+	return meta
+}
+
+// labelMeta returns the containerMeta from a container's labels
+func labelMeta(ID string, labels map[string]string) containerMeta {
+	meta := containerMeta{
+		service:   composeService(labels),
+		ttl:       labelTTL(ID, labels),
+		hostname:  strings.ToLower(labels[label_cj_hostname]),
+		canonical: strings.ToLower(strings.TrimSuffix(strings.TrimSpace(labels[label_cj_canonical]), ".")),
+		ports:     labelPortMap(ID, labels),
+	}
+	meta.upstream, meta.upstreamPort = labelUpstream(ID, labels)
+	return meta
+}
+
+// labelTTL returns the ttl label in seconds, or 0 if it is missing.  A ttl that isn't a positive integer
+// is logged and ignored.
+func labelTTL(ID string, labels map[string]string) uint32 {
+	value, ok := labels[label_cj_ttl]
+	if !ok {
+		return 0
+	}
+	ttl, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+	if err != nil || ttl == 0 {
+		slog.Warn("Ignoring invalid ttl label, must be a positive number of seconds", "container_id", ID, "ttl", value)
+		return 0
+	}
+	return uint32(ttl)
+}
+
+// composeService returns the compose "project/service" from a container's labels, or ""
+func composeService(labels map[string]string) string {
+	project, service := labels[label_docker_compose_project], labels[label_docker_compose_service]
+	if project == "" || service == "" {
+		return ""
+	}
+	return project + "/" + service
+}
+
+// hasCJLabel reports whether any of labels is a cj hosts label
+func hasCJLabel(labels map[string]string) bool {
+	for label := range labels {
+		if strings.HasPrefix(label, label_cj_prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *App) registerDomains(domains []string, ip string) {
+	if ip == "" {
+		return
+	}
+	for _, fqdn := range domains {
+		// DNS names are case insensitive
+		fqdn = strings.ToLower(fqdn)
+		slog.Info("Registered domain", "fqdn", fqdn, "ip", ip)
+		if err := app.registry.Set(fqdn, ip); err != nil {
+			slog.Warn("Could not register domain", "fqdn", fqdn, "error", err)
+		}
+	}
+}
+
+// addContainer inspects a container, registers its domains and calls the hooks.  action is reported in the
+// event log, unless it is "".  Returns false when the container has no usable IP yet.
+func (app *App) addContainer(client dockerAPI, ID string, action string) bool {
+	container, err := client.InspectContainer(ID)
+	if err != nil {
+		slog.Warn("Could not inspect container", "container_id", ID, "error", err)
+		return false
+	}
+	return app.addInspected(container, action)
+}
+
+// addInspected registers the domains of an inspected container and calls the hooks.  action is reported in the
+// event log, unless it is "".  Returns false when the container has no usable IP yet.
+func (app *App) addInspected(container *docker.Container, action string) bool {
+	ip := getContainerIP(app, container)
+	if ip == "" {
+		return false
+	}
+	domains := app.getDomains(container)
+	domains = app.registerContainer(container.ID, app.inspectedMeta(container), domains, ip)
+	if len(domains) > 0 {
+		app.hooks.containerStarted(domains, ip)
+		app.hooks.domainsUpdated()
+		app.events.emit(action, container.ID, domains, ip)
+	}
+	return true
+}
+
+// retryAddContainer keeps trying to add a started container whose IP wasn't available yet.
+// IP addresses are sometimes assigned shortly after the start event.
+func (app *App) retryAddContainer(client dockerAPI, ID string) {
+	for attempt := 1; attempt <= start_ip_retries; attempt++ {
+		time.Sleep(start_ip_retry_delay)
+		container, err := client.InspectContainer(ID)
+		if err != nil || !container.State.Running {
+			slog.Debug("Container went away before it got an IP", "container_id", ID)
+			return
+		}
+		if app.addInspected(container, "start") {
+			slog.Debug("Container got an IP", "container_id", ID, "attempt", attempt)
+			return
+		}
+	}
+	slog.Warn("Giving up on container without a usable IP", "container_id", ID, "attempts", start_ip_retries)
+}
+
+// setPaused marks a registered container as paused or running again.  The names of a paused container
+// don't resolve, or resolve to its running replicas.
+func (app *App) setPaused(ID string, paused bool) {
+	app.Lock()
+	defer app.Unlock()
+	if _, ok := app.idToDomains[ID]; !ok {
+		return
+	}
+	if paused {
+		slog.Info("Container paused, its names won't resolve until it is unpaused", "container_id", ID)
+		app.paused[ID] = true
+	} else if app.paused[ID] {
+		slog.Info("Container unpaused", "container_id", ID)
+		delete(app.paused, ID)
+	}
+}
+
+// dropContainer removes the cached domains of a container, calls the hooks and returns the removed domains.
+// action is reported in the event log, unless it is "".
+func (app *App) dropContainer(ID string, action string) []string {
+	app.RLock()
+	ip := app.idToIp[ID]
+	app.RUnlock()
+	domains := app.removeContainer(ID)
+	// Nothing to report when a previous event already removed them
+	if len(domains) > 0 {
+		app.hooks.containerStopped(domains)
+		app.hooks.domainsUpdated()
+		app.events.emit(action, ID, domains, ip)
+	}
+	return domains
+}
+
+// refreshContainer recomputes the IP of a registered container after its networks change.  The domains
+// cached when it started move to the new IP, or are removed if the container has no usable IP left.
+func (app *App) refreshContainer(client dockerAPI, ID string) {
+	app.RLock()
+	domains, ok := app.idToDomains[ID]
+	oldIP := app.idToIp[ID]
+	meta := app.idToMeta[ID]
+	app.RUnlock()
+	// Stopped containers were already removed by the "die" event
+	if !ok {
+		return
+	}
+
+	container, err := client.InspectContainer(ID)
+	if err != nil {
+		slog.Warn("Could not inspect container", "container_id", ID, "error", err)
+		return
+	}
+	ip := getContainerIP(app, container)
+	if ip == "" {
+		slog.Info("Container has no usable IP left", "container_id", ID, "old_ip", oldIP)
+		app.dropContainer(ID, "stop")
+		return
+	}
+	v4, v6 := app.containerFamilies(container)
+	if ip != oldIP || !v4.Equal(meta.v4) || !v6.Equal(meta.v6) {
+		slog.Info("Container IP changed", "container_id", ID, "old_ip", oldIP, "ip", ip)
+		meta.v4, meta.v6 = v4, v6
+		app.registerContainer(ID, meta, domains, ip)
+		app.hooks.domainsUpdated()
+	}
+}
+
+// updateContainer recomputes the names of a registered container from its current labels.  Names it lost are
+// removed and new ones added, while the names it keeps stay registered throughout.  Stopped containers are
+// left alone since they are read again when they start.
+func (app *App) updateContainer(client dockerAPI, ID string) {
+	app.RLock()
+	_, registered := app.idToDomains[ID]
+	app.RUnlock()
+	if !registered {
+		return
+	}
+
+	container, err := client.InspectContainer(ID)
+	if err != nil {
+		slog.Warn("Could not inspect container", "container_id", ID, "error", err)
+		return
+	}
+	if !container.State.Running {
+		return
+	}
+	app.updateInspected(container)
+}
+
+// updateInspected recomputes the names and IP of an inspected, registered container like updateContainer
+func (app *App) updateInspected(container *docker.Container) {
+	ID := container.ID
+	app.RLock()
+	previous := app.idToDomains[ID]
+	app.RUnlock()
+	ip := getContainerIP(app, container)
+	if ip == "" {
+		slog.Info("Container has no usable IP left", "container_id", ID)
+		app.dropContainer(ID, "stop")
+		return
+	}
+	domains := app.registerContainer(ID, app.inspectedMeta(container), app.getDomains(container), ip)
+	// Registering again clears the paused flag
+	if container.State.Paused {
+		app.Lock()
+		app.paused[ID] = true
+		app.Unlock()
+	}
+
+	lost := []string{}
+	for _, domain := range previous {
+		if !containsFold(domains, domain) {
+			lost = append(lost, domain)
+		}
+	}
+	added := []string{}
+	for _, domain := range domains {
+		if !containsFold(previous, domain) {
+			added = append(added, domain)
+		}
+	}
+	if len(lost) == 0 && len(added) == 0 {
+		slog.Debug("Container names didn't change", "container_id", ID)
+		return
+	}
+	slog.Info("Container names changed", "container_id", ID, "added", added, "removed", lost)
+	if len(lost) > 0 {
+		app.hooks.containerStopped(lost)
+	}
+	// The hooks only hear about the names that are new, the event log gets them all
+	if len(added) > 0 {
+		app.hooks.containerStarted(added, ip)
+	}
+	app.hooks.domainsUpdated()
+	app.events.emit("update", ID, domains, ip)
+}
+
+// registerContainer registers the domains for a container and remembers them for removal when the container stops.
+// It returns the domains that were registered, which leaves out any kept by another container.  The canonical
+// name comes first.
+func (app *App) registerContainer(ID string, meta containerMeta, domains []string, ip string) []string {
+	if ip == "" {
+		return nil
+	}
+	app.Lock()
+	previous := app.idToDomains[ID]
+	domains = canonicalFirst(ID, meta.canonical, app.claimDomains(ID, meta, domains))
+	// A container registered again, e.g. restarted after a missed die event, may have lost some names
+	stale := []string{}
+	for _, domain := range previous {
+		if !containsFold(domains, domain) {
+			stale = append(stale, domain)
+		}
+	}
+	removed, moved := app.releaseDomains(ID, stale)
+	app.idToDomains[ID] = domains
+	app.idToIp[ID] = ip
+	app.idToMeta[ID] = meta
+	delete(app.paused, ID) // Started again
+	app.Unlock()
+	app.syncRegistry(removed, moved)
+	app.registerDomains(domains, ip)
+	return domains
+}
+
+// canonicalFirst moves the name from the canonical label to the front of domains, which makes it the name
+// reverse lookups and logs report.  Without the label the first name that isn't a wildcard is canonical.
+func canonicalFirst(ID string, canonical string, domains []string) []string {
+	pick := -1
+	for i, domain := range domains {
+		if canonical != "" && strings.EqualFold(domain, canonical) {
+			pick = i
+			break
+		}
+		if pick < 0 && !strings.HasPrefix(domain, "*.") {
+			pick = i
+		}
+	}
+	if canonical != "" && len(domains) > 0 && (pick < 0 || !strings.EqualFold(domains[pick], canonical)) {
+		slog.Warn("Canonical label is not one of the container's names, using the first name", "container_id", ID, "label", label_cj_canonical, "value", canonical, "fqdns", domains)
+	}
+	if pick <= 0 {
+		return domains
+	}
+	ordered := make([]string, 0, len(domains))
+	ordered = append(ordered, domains[pick])
+	ordered = append(ordered, domains[:pick]...)
+	return append(ordered, domains[pick+1:]...)
+}
+
+// claimDomains records ID as an owner of its domains and returns the ones it may register.
+// Replicas of the same compose service share their names.  A name already owned by another container
+// is handled by app.collisionPolicy, or app.shortNameCollision for short names: "first" keeps the current
+// owner, "last" hands the name over to ID and "error" refuses it loudly.  Two containers with the same host
+// name label are always warned about, since that is almost certainly a mistake.  New names are refused once
+// app.maxDomains are registered.  The caller must hold the write lock.
+func (app *App) claimDomains(ID string, meta containerMeta, domains []string) []string {
+	claimed := make([]string, 0, len(domains))
+	warned, limited := false, false
+	for _, domain := range domains {
+		fqdn := strings.ToLower(domain)
+		owners := app.fqdnOwners[fqdn]
+		switch {
+		case len(owners) == 0 && app.maxDomains > 0 && len(app.fqdnOwners) >= app.maxDomains:
+			if !limited {
+				slog.Error("Too many names registered, not registering more until containers stop", "max_domains", app.maxDomains, "container_id", ID, "fqdn", fqdn)
+				limited = true
+			}
+			continue
+		case len(owners) == 0:
+		case containsString(owners, ID):
+			claimed = append(claimed, domain)
+			continue
+		case meta.service != "" && app.idToMeta[owners[0]].service == meta.service:
+			slog.Debug("Sharing name with a replica", "fqdn", fqdn, "container_id", ID, "service", meta.service)
+		default:
+			if !warned && meta.hostname != "" && app.idToMeta[owners[0]].hostname == meta.hostname {
+				slog.Warn("Two containers have the same host name label", "host_name", meta.hostname, "container_id", ID, "other_container_id", owners[0])
+				warned = true
+			}
+			policy := app.collisionPolicy
+			if isShortName(strings.TrimPrefix(fqdn, "*.")) {
+				policy = app.shortNameCollision
+			}
+			log := slog.With("fqdn", fqdn, "container_id", ID, "owner", owners[0])
+			switch policy {
+			case collision_policy_first:
+				log.Info("Name already registered by another container")
+				continue
+			case collision_policy_error:
+				log.Error("Refusing to register a name owned by another container")
+				continue
+			default:
+				log.Warn("Taking over name from another container")
+				for _, owner := range owners {
+					app.idToDomains[owner] = withoutDomain(app.idToDomains[owner], fqdn)
+				}
+				owners = nil
+			}
+		}
+		app.fqdnOwners[fqdn] = append(owners, ID)
+		claimed = append(claimed, domain)
+	}
+	return claimed
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold reports whether list contains s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutDomain returns domains without any case insensitive match for fqdn
+func withoutDomain(domains []string, fqdn string) []string {
+	kept := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		if !strings.EqualFold(domain, fqdn) {
+			kept = append(kept, domain)
+		}
+	}
+	return kept
+}
+
+// isShortName reports whether name is a single label without a domain
+func isShortName(name string) bool {
+	return !strings.Contains(name, ".")
+}
+
+// removeContainer removes the domains previously registered for a container and returns them.
+// A name is only removed while the container still owns it.  A name shared by replicas moves to
+// the IP of a remaining replica.
+func (app *App) removeContainer(ID string) []string {
+	app.Lock()
+	domains := app.idToDomains[ID]
+	delete(app.idToDomains, ID)
+	delete(app.idToIp, ID)
+	delete(app.idToMeta, ID)
+	delete(app.paused, ID)
+	removed, moved := app.releaseDomains(ID, domains)
+	app.Unlock()
+	app.syncRegistry(removed, moved)
+	return domains
+}
+
+// releaseDomains gives up the ownership of domains by ID.  Returns the names nobody owns anymore, and the names
+// shared by replicas with the IP of the replica they move to, for syncRegistry.  The caller must hold the write lock.
+func (app *App) releaseDomains(ID string, domains []string) ([]string, map[string]string) {
+	removed := []string{}
+	moved := map[string]string{}
+	for _, domain := range domains {
+		fqdn := strings.ToLower(domain)
+		owners := withoutString(app.fqdnOwners[fqdn], ID)
+		if len(owners) == 0 {
+			delete(app.fqdnOwners, fqdn)
+			removed = append(removed, fqdn)
+			continue
+		}
+		app.fqdnOwners[fqdn] = owners
+		moved[fqdn] = app.idToIp[owners[0]]
+	}
+	return removed, moved
+}
+
+// syncRegistry applies the changes from releaseDomains to the registry.  The registry may be remote, so it is
+// updated without holding the lock.
+func (app *App) syncRegistry(removed []string, moved map[string]string) {
+	for _, fqdn := range removed {
+		if err := app.registry.Delete(fqdn); err != nil {
+			slog.Warn("Could not unregister domain", "fqdn", fqdn, "error", err)
+		}
+	}
+	for fqdn, ip := range moved {
+		if err := app.registry.Set(fqdn, ip); err != nil {
+			slog.Warn("Could not register domain", "fqdn", fqdn, "error", err)
+		}
+	}
+}
+
+// withoutString returns list without s
+func withoutString(list []string, s string) []string {
+	kept := make([]string, 0, len(list))
+	for _, item := range list {
+		if item != s {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// lookupFamilies returns the IPv4 and IPv6 addresses and DNS TTL registered for a lower case name, and the host
+// of the container's upstream label or "".  Either address is nil if the container doesn't have one.  The caller
+// must hold the read lock.
+func (app *App) lookupFamilies(name string) (net.IP, net.IP, uint32, string) {
+	owner := app.pickOwner(app.matchName(name))
+	if owner == "" {
+		return nil, nil, 0, ""
+	}
+	meta := app.idToMeta[owner]
+	v4, v6 := meta.v4, meta.v6
+	// Containers only reachable through a published port have no network addresses
+	if v4 == nil && v6 == nil {
+		if ip := net.ParseIP(app.idToIp[owner]); ip.To4() != nil {
+			v4 = ip.To4()
+		} else {
+			v6 = ip
+		}
+	}
+	return v4, v6, app.ownerTTL(owner), meta.upstream
+}
+
+// lookupAddr returns the canonical name and DNS TTL of the container with address ip, or "" if there is none.
+// When several containers share the address, e.g. one published on the docker host, the lowest ID wins so the
+// answer is stable.  The caller must hold the read lock.
+func (app *App) lookupAddr(ip net.IP) (string, uint32) {
+	owner := ""
+	for ID, registered := range app.idToIp {
+		meta := app.idToMeta[ID]
+		if len(app.idToDomains[ID]) == 0 || (owner != "" && ID > owner) {
+			continue
+		}
+		if net.ParseIP(registered).Equal(ip) || meta.v4.Equal(ip) || meta.v6.Equal(ip) {
+			owner = ID
+		}
+	}
+	if owner == "" {
+		return "", 0
+	}
+	return app.idToDomains[owner][0], app.ownerTTL(owner)
+}
+
+// ownerTTL returns the DNS TTL for the names of a container.  The caller must hold the read lock.
+func (app *App) ownerTTL(ID string) uint32 {
+	if ttl := app.idToMeta[ID].ttl; ttl > 0 {
+		return ttl
+	}
+	return app.dnsTTL
+}
+
+// matchName returns the registered name that a lower case name resolves with, or "" if there is none.  When
+// there is no exact match, the leftmost labels are stripped one at a time looking for a wildcard ("*.")
+// registration.  The caller must hold the read lock.
+func (app *App) matchName(name string) string {
+	if len(app.fqdnOwners[name]) > 0 {
+		return name
+	}
+	for i := strings.Index(name, "."); i >= 0; i = strings.Index(name, ".") {
+		name = name[i+1:]
+		if len(app.fqdnOwners["*."+name]) > 0 {
+			return "*." + name
+		}
+	}
+	return ""
+}
+
+// pickOwner returns the ID of the container that fqdn resolves to, taking turns between replicas.
+// Paused containers are skipped.  Returns "" if they are all paused.  The caller must hold the read lock.
+func (app *App) pickOwner(fqdn string) string {
+	owners := app.fqdnOwners[fqdn]
+	if len(app.paused) > 0 {
+		running := make([]string, 0, len(owners))
+		for _, owner := range owners {
+			if !app.paused[owner] {
+				running = append(running, owner)
+			}
+		}
+		owners = running
+	}
+	switch len(owners) {
+	case 0:
+		return ""
+	case 1:
+		return owners[0]
+	}
+	n := app.roundRobin.Add(1)
+	return owners[n%uint64(len(owners))]
+}
+
+// Domains returns a copy of the FQDN to IP map.  With a shared registry it includes the names registered
+// elsewhere, or only this instance's names when the registry can't be read.
+func (app *App) Domains() map[string]string {
+	domains, err := app.registry.List()
+	if err == nil {
+		return domains
+	}
+	slog.Warn("Could not list the registry, listing this instance's names only", "error", err)
+	app.RLock()
+	defer app.RUnlock()
+	domains = make(map[string]string, len(app.fqdnOwners))
+	for fqdn, owners := range app.fqdnOwners {
+		domains[fqdn] = app.idToIp[owners[0]]
+	}
+	return domains
+}
+
+// lookupRegistry returns the address registered for a lower case name by another cjsocks instance, or by hand,
+// in a shared registry.  Returns nil if there is none.  Names registered here are found with matchName instead.
+func (app *App) lookupRegistry(name string) net.IP {
+	ip, err := app.registry.Get(name)
+	if err != nil {
+		slog.Warn("Could not look up name in the registry", "fqdn", name, "error", err)
+		return nil
+	}
+	addr := net.ParseIP(ip)
+	if ip4 := addr.To4(); ip4 != nil {
+		return ip4
+	}
+	return addr
+}
+
+// getContainerIP returns the address a container is reached at, or "" if it has none
+func getContainerIP(app *App, container *docker.Container) string {
+	ip, _ := containerAddress(app, container)
+	return ip
+}
+
+// containerAddress returns the address a container is reached at and the name of the network it is on.
+// The network is "" for the ip label and published ports, and both are "" if the container has no address.
+func containerAddress(app *App, container *docker.Container) (string, string) {
+	// WARNING: A blank IP address can get returned for some containers exposed only on the host network adapter.
+	// IP Address exposed inside the Docker network.  Or host IP if not exposed on the Docker network.
+	// IP priority order:
+	// - The address from the ip label, if it is valid
+	// - If the network label names a network the container is connected to, its IP address
+	// - If connected to the network named app.cjnetworkName, its IP address
+	// - The networks listed in app.networkPriority, in order
+	// - The remaining networks sorted by name (could be blank if only connected on Host network)
+	//   Networks cjsocks's own container is attached to go first, in the same order, since only those are reachable.
+	// - The same networks again for the other address family (IPv6 unless app.preferIPv6)
+	// - "HostIp" if the container is exposed on the host network.  0.0.0.0 and :: are replaced by the docker host address when known.
+	ID := container.ID
+	if value, ok := container.Config.Labels[label_cj_ip]; ok {
+		if ip := net.ParseIP(strings.TrimSpace(value)); ip != nil {
+			return ip.String(), ""
+		}
+		slog.Warn("Ignoring invalid ip label", "container_id", ID, "label", label_cj_ip, "value", value)
+	}
+	networks := container.NetworkSettings.Networks
+	order := app.networkOrder(networks)
+	families := []func(docker.ContainerNetwork) string{
+		func(n docker.ContainerNetwork) string { return n.IPAddress },
+		func(n docker.ContainerNetwork) string { return n.GlobalIPv6Address },
+	}
+	if app.preferIPv6 {
+		families[0], families[1] = families[1], families[0]
+	}
+	if pinned := container.Config.Labels[label_cj_network]; pinned != "" {
+		if ip, networkname := pinnedNetworkIP(networks, pinned, families); ip != "" {
+			return ip, networkname
+		}
+		slog.Warn("Container has no IP on the network from its network label, using the usual order", "container_id", ID, "network", pinned)
+	}
+	for _, address := range families {
+		for _, networkname := range order {
+			if ip := address(networks[networkname]); ip != "" {
+				return ip, networkname
+			}
+		}
+	}
+
+	// Sorted so containers publishing several ports always get the same address
+	ports := make([]string, 0, len(container.NetworkSettings.Ports))
+	for port := range container.NetworkSettings.Ports {
+		ports = append(ports, string(port))
+	}
+	sort.Strings(ports)
+	for _, port := range ports {
+		for _, b := range container.NetworkSettings.Ports[docker.Port(port)] {
+			if b.HostIP == "" {
+				continue
+			}
+			// Published on all interfaces, which is only reachable from the docker host itself
+			if ip := net.ParseIP(b.HostIP); ip != nil && ip.IsUnspecified() && app.hostAddress != "" {
+				return app.hostAddress, ""
+			}
+			return b.HostIP, ""
+		}
+	}
+
+	return "", ""
+}
+
+// containerFamilies returns a container's IPv4 and IPv6 network addresses for DNS answers, preferring the
+// networks in the same order as getContainerIP.  Either is nil if the container has none.  A valid ip label
+// replaces both.
+func (app *App) containerFamilies(container *docker.Container) (net.IP, net.IP) {
+	if ip := net.ParseIP(strings.TrimSpace(container.Config.Labels[label_cj_ip])); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4, nil
+		}
+		return nil, ip
+	}
+	networks := container.NetworkSettings.Networks
+	order := app.networkOrder(networks)
+	if pinned := container.Config.Labels[label_cj_network]; pinned != "" {
+		for networkname := range networks {
+			if strings.EqualFold(networkname, pinned) {
+				order = append([]string{networkname}, order...)
+			}
+		}
+	}
+	var v4, v6 net.IP
+	for _, networkname := range order {
+		if ip := net.ParseIP(networks[networkname].IPAddress); v4 == nil && ip != nil {
+			v4 = ip.To4()
+		}
+		if ip := net.ParseIP(networks[networkname].GlobalIPv6Address); v6 == nil && ip != nil {
+			v6 = ip
+		}
+	}
+	return v4, v6
+}
+
+// pinnedNetworkIP returns the address on the network named pinned, matched case insensitively, in the
+// order of families, and the network's actual name.  Returns "" if the container isn't connected to it or
+// has no address there.
+func pinnedNetworkIP(networks map[string]docker.ContainerNetwork, pinned string, families []func(docker.ContainerNetwork) string) (string, string) {
+	for networkname, network := range networks {
+		if !strings.EqualFold(networkname, pinned) {
+			continue
+		}
+		for _, address := range families {
+			if ip := address(network); ip != "" {
+				return ip, networkname
+			}
+		}
+	}
+	return "", ""
+}
+
+// networkOrder returns the names of networks in the order their IP addresses should be preferred.
+// Map iteration order is random, so the order is made deterministic: the cj network, then
+// app.networkPriority, then the rest sorted by name.  Names are matched case insensitively.  Networks shared with
+// cjsocks's own container come before the others.
+func (app *App) networkOrder(networks map[string]docker.ContainerNetwork) []string {
+	names := make([]string, 0, len(networks))
+	for networkname := range networks {
+		names = append(names, networkname)
+	}
+	sort.Strings(names)
+
+	order := make([]string, 0, len(names))
+	used := make(map[string]bool, len(names))
+	for _, preferred := range append([]string{app.cjnetworkName}, app.networkPriority...) {
+		for _, networkname := range names {
+			if !used[networkname] && strings.EqualFold(networkname, preferred) {
+				order = append(order, networkname)
+				used[networkname] = true
+			}
+		}
+	}
+	for _, networkname := range names {
+		if !used[networkname] {
+			order = append(order, networkname)
+		}
+	}
+	return app.sharedFirst(order)
+}
+
+// Resolve returns the IP address for name.  Container names resolve to their container, other names through
+// the upstream DNS servers or the system resolver unless strict resolution is enabled.  Addresses the allow and
+// deny lists refuse are an error.  Errors are a *ResolveError.  It implements socks5.NameResolver.
+func (app *App) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if ctx == nil {
+		ctx = context.Background() // Resolvers set with SetResolver may pass nil
+	}
+	// Names are registered without the root's trailing dot, e.g. "web.container." is "web.container"
+	name = strings.TrimSuffix(name, ".")
+
+	// Answered by cjsocks itself, so the allow and deny lists don't apply
+	if app.cfg.EnableDiscovery && isDiscoveryName(name) {
+		app.metrics.incResolve("hit")
+		return ctx, discovery_ip, nil
+	}
+	ctx, addr, err := app.resolve(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	if err := app.destinations.check(addr); err != nil {
+		app.metrics.incResolve("denied")
+		slog.Debug("Refusing denied destination", "fqdn", name, "ip", addr.String(), "error", err)
+		return ctx, nil, &ResolveError{Name: name, Reason: ResolveDenied, Err: err}
+	}
+	return ctx, addr, nil
+}
+
+// resolve returns the IP address for name, before the allow and deny lists are applied
+func (app *App) resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	slog.Debug("Resolving", "fqdn", name)
+	name = strings.ToLower(name)
+
+	app.RLock()
+	fqdn := app.matchName(name)
+	owner := app.pickOwner(fqdn)
+	ip, meta := app.idToIp[owner], app.idToMeta[owner]
+	app.RUnlock()
+	registered := fqdn != ""
+
+	// A stand in for an external endpoint
+	if ip != "" && meta.upstream != "" {
+		addr, err := app.upstreamAddress(ctx, meta.upstream)
+		if err != nil {
+			app.metrics.incResolve("error")
+			slog.Debug("Could not resolve upstream", "fqdn", name, "upstream", meta.upstream, "error", err)
+			return ctx, nil, err
+		}
+		app.metrics.incResolve("hit")
+		slog.Debug("Resolved to upstream", "fqdn", name, "upstream", meta.upstream, "ip", addr.String())
+		if meta.ports != nil {
+			ctx = context.WithValue(ctx, portMapKey{}, meta.ports)
+		}
+		if meta.upstreamPort != 0 {
+			ctx = context.WithValue(ctx, upstreamPortKey{}, meta.upstreamPort)
+		}
+		return ctx, addr, nil
+	}
+
+	// Container addresses are authoritative and never cached
+	if ip != "" {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			app.metrics.incResolve("error")
+			slog.Debug("Could not resolve", "fqdn", name, "ip", ip)
+			return ctx, nil, &ResolveError{Name: name, Reason: ResolveNotFound, Err: fmt.Errorf("invalid address %q registered for %v", ip, name)}
+		}
+		// Return IPv4 addresses in their 4 byte form so they aren't mistaken for IPv6
+		if ip4 := addr.To4(); ip4 != nil {
+			addr = ip4
+		}
+		app.metrics.incResolve("hit")
+		slog.Debug("Resolved", "fqdn", name, "ip", addr.String())
+		if meta.ports != nil {
+			ctx = context.WithValue(ctx, portMapKey{}, meta.ports)
+		}
+		return ctx, addr, nil
+	}
+
+	// The name belongs to paused containers, which would only time out
+	if registered {
+		app.metrics.incResolve("error")
+		slog.Debug("Not resolving the name of a paused container", "fqdn", name)
+		return ctx, nil, &ResolveError{Name: name, Reason: ResolveNotFound, Err: fmt.Errorf("the containers registered for %v are paused", name)}
+	}
+
+	// Names registered by other instances sharing the registry
+	if addr := app.lookupRegistry(name); addr != nil {
+		app.metrics.incResolve("hit")
+		slog.Debug("Resolved from the registry", "fqdn", name, "ip", addr.String())
+		return ctx, addr, nil
+	}
+
+	// Only container names are reachable in strict mode
+	if app.strictResolve {
+		app.metrics.incResolve("rejected")
+		slog.Debug("Refusing to resolve unknown name", "fqdn", name)
+		return ctx, nil, &ResolveError{Name: name, Reason: ResolveNotFound, Err: fmt.Errorf("%v is not a registered container name", name)}
+	}
+
+	if cached := app.resolveCache.get(name); cached != nil {
+		app.metrics.incResolve("miss")
+		slog.Debug("Resolved from cache", "fqdn", name, "ip", cached.String())
+		return ctx, cached, nil
+	}
+
+	addr, err := app.lookupHost(ctx, name)
+	if err != nil {
+		app.metrics.incResolve("error")
+		slog.Debug("Could not resolve", "fqdn", name, "error", err)
+		return ctx, nil, lookupError(name, err)
+	}
+	app.metrics.incResolve("miss")
+	app.resolveCache.put(name, addr)
+	slog.Debug("Resolved", "fqdn", name, "ip", addr.String())
+	return ctx, addr, nil
+}
+
+// lookupHost resolves a name that isn't a container with the upstream DNS servers, or the system resolver
+func (app *App) lookupHost(ctx context.Context, name string) (net.IP, error) {
+	if app.upstream != nil {
+		return app.upstream.lookup(ctx, name)
+	}
+	addr, err := net.ResolveIPAddr("ip", name)
+	if err != nil {
+		return nil, err
+	}
+	return addr.IP, nil
+}
+
+func registerRunningContainers(app *App, client dockerAPI) error {
+	slog.Info("Registering running containers")
+	app.refreshOwnNetworks(client)
+
+	// All: false lists running containers only, but a container can stop between the list and the inspect below
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: false})
+
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		inspected, err := client.InspectContainer(container.ID)
+		if err != nil {
+			slog.Warn("Could not inspect container", "container_id", container.ID, "error", err)
+			continue
+		}
+		if !inspected.State.Running {
+			slog.Debug("Skipping container that isn't running", "container_id", container.ID, "state", inspected.State.Status)
+			continue
+		}
+
+		// Running again after a missed start event
+		app.cancelRemoval(container.ID)
+		domains := app.getDomains(inspected)
+		ip := getContainerIP(app, inspected)
+
+		app.registerContainer(container.ID, app.inspectedMeta(inspected), domains, ip)
+		if inspected.State.Paused {
+			app.setPaused(container.ID, true)
+		}
+	}
+	app.registerHostAlias()
+	// Services are only listed by swarm managers, so failing to list them leaves the containers registered
+	if app.swarm {
+		if err := registerServices(app, client); err != nil {
+			slog.Warn("Could not list swarm services", "error", err)
+		}
+	}
+
+	app.hooks.domainsUpdated()
+	return nil
+}
+
+// resync registers the running containers again, recomputing their names from their labels, and removes the
+// ones that are no longer running.  Names that don't change stay registered throughout, so they keep resolving.
+// Returns the number of names registered afterwards.  It runs on the docker event loop, see requestResync.
+func (app *App) resync(client dockerAPI) (int, error) {
+	app.refreshOwnNetworks(client)
+	if err := app.reconcile(client, true); err != nil {
+		return 0, err
+	}
+	app.registerHostAlias()
+	if app.swarm {
+		if err := registerServices(app, client); err != nil {
+			slog.Warn("Could not list swarm services", "error", err)
+		}
+	}
+	app.hooks.domainsUpdated()
+	app.RLock()
+	defer app.RUnlock()
+	return len(app.fqdnOwners), nil
+}
+
+// resyncResult is the outcome of a resync run on the docker event loop
+type resyncResult struct {
+	count int
+	err   error
+}
+
+// requestResync has the docker event loop resync, so no event is handled halfway through it, and waits for the
+// result.  Fails when the event loop isn't running, e.g. while docker is unreachable.
+func (app *App) requestResync(ctx context.Context) (int, error) {
+	if !app.ready.Load() {
+		return 0, fmt.Errorf("not listening for docker events")
+	}
+	reply := make(chan resyncResult, 1)
+	select {
+	case app.resyncs <- reply:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	select {
+	case result := <-reply:
+		return result.count, result.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// isGeneratedHostname reports whether hostname looks like the short container ID docker uses when no host name is configured
+func isGeneratedHostname(hostname string) bool {
+	return generatedHostnameRegex.MatchString(hostname)
+}
+
+// getDomains returns the names of an inspected container, or none if it is ignored
+func (app *App) getDomains(container *docker.Container) []string {
+	domains := []string{}
+	ID := container.ID
+
+	if app.ignored(ID, strings.TrimPrefix(container.Name, "/"), container.Config.Labels[label_docker_compose_project], container.Config.Labels) {
+		return domains
+	}
+	// docker compose run containers would take over the name of the service they were run from
+	if strings.EqualFold(container.Config.Labels[label_docker_compose_oneoff], "true") && container.Config.Labels[label_cj_hostname] == "" {
+		slog.Debug("Ignoring one-off compose container", "container_id", ID, "name", container.Name)
+		return domains
+	}
+
+	// Private host name
+	// service_hostname := container.Config.Labels[label_docker_compose_service]
+
+	// Public host name
+	// Order of precedence: Host name label, docker service name, container host name, container name
+	public_hostname := container.Config.Labels[label_cj_hostname]
+	if public_hostname == "" {
+		public_hostname = container.Config.Labels[label_docker_compose_service]
+	}
+	if public_hostname == "" {
+		// Docker will automatically generate a 12 character hex host name if none is configured
+		if !isGeneratedHostname(container.Config.Hostname) && container.Config.Hostname > "" {
+			public_hostname = container.Config.Hostname
+		} else {
+			public_hostname = strings.TrimPrefix(container.Name, "/")
+		}
+	}
+	// Would leave a bare base domain like ".container"
+	if strings.Trim(strings.TrimSpace(public_hostname), ".") == "" {
+		slog.Warn("Skipping container without a usable host name", "container_id", ID, "name", container.Name)
+		return domains
+	}
+
+	// The base domain label replaces the configured defaults for this container only
+	baseDomains := app.baseDomains
+	if domain := labelDomain(ID, container.Config.Labels, label_cj_base_domain); domain != "" {
+		baseDomains = []string{domain}
+	}
+
+	// --- Full domain name
+	//     Order of precedence:
+	//       If label says then only use the container domain name.
+	//       otherwise
+	//       Subdomain label or compose project + label domain or container domain name or base domain label or external configured domains
+	//     One suffix for each base domain
+	var suffixes []string
+	if container.Config.Labels[label_cj_flag_use_container_base_domain] == "true" && container.Config.Domainname > "" {
+		suffixes = []string{container.Config.Domainname}
+	} else {
+		// --- or Sub domain + Base domain name
+		prefix := ""
+		if subdomain := labelDomain(ID, container.Config.Labels, label_cj_subdomain); subdomain != "" {
+			prefix = subdomain + "."
+		} else if container.Config.Labels[label_docker_compose_project] > "" {
+			prefix = container.Config.Labels[label_docker_compose_project] + "."
+		}
+		if domain := labelDomain(ID, container.Config.Labels, label_cj_domain); domain != "" {
+			suffixes = []string{prefix + domain}
+		} else if container.Config.Labels[label_cj_flag_use_container_base_domain] == "true" && container.Config.Domainname != "" {
+			suffixes = []string{prefix + container.Config.Domainname}
+		} else {
+			for _, baseDomain := range baseDomains {
+				suffixes = append(suffixes, prefix+baseDomain)
+			}
+		}
+
+	}
+	// --- or the network the container is reached on + the above, to tell apart containers on different networks
+	if app.networkSuffix {
+		if _, networkname := containerAddress(app, container); networkname != "" {
+			label := strings.ReplaceAll(strings.ToLower(networkname), "_", "-")
+			for i, suffix := range suffixes {
+				suffixes[i] = label + "." + suffix
+			}
+		}
+	}
+	// --- FQDN
+	for _, suffix := range suffixes {
+		domains = append(domains, public_hostname+"."+suffix)
+	}
+
+	// --- Replica name
+	//     Each replica of a scaled compose service also gets its own name, e.g. web-2.myproject.container
+	if number := container.Config.Labels[label_docker_compose_container_number]; app.registerReplicaNames && number != "" {
+		for _, suffix := range suffixes {
+			domains = append(domains, public_hostname+"-"+number+"."+suffix)
+		}
+	}
+
+	// --- Short name
+	//     The bare host name, for tools configured to resolve names without a domain
+	if app.registerShortNames && isShortName(public_hostname) {
+		domains = append(domains, public_hostname)
+	}
+
+	// --- Docker name
+	//     The raw container name under .docker, e.g. myproject-web-1.docker, for tools expecting that convention
+	if app.dockerSuffixAlias {
+		domains = append(domains, strings.TrimPrefix(container.Name, "/")+".docker")
+	}
+
+	// --- Aliases
+	//     Comma separated.  Aliases containing a dot are fully qualified.  Bare names get each base domain.
+	for _, alias := range splitList(container.Config.Labels[label_cj_aliases]) {
+		if strings.Contains(alias, ".") {
+			domains = append(domains, alias)
+			continue
+		}
+		for _, baseDomain := range baseDomains {
+			domains = append(domains, alias+"."+baseDomain)
+		}
+	}
+
+	// --- Wildcards
+	//     Every subdomain of the container's names resolves to the container too, e.g. tenant1.myservice.container
+	if container.Config.Labels[label_cj_flag_wildcard] == "true" {
+		for _, domain := range domains {
+			domains = append(domains, "*."+domain)
+		}
+	}
+
+	/*
+		if "" != container.Config.Domainname {
+			domains := append(domains, container.Config.Hostname+"."+container.Config.Domainname)
+		}
+	*/
+
+	/*
+		envDomains := getDomainsFromEnv(container.Config.Env)
+
+		for _, domain := range envDomains {
+			domains = append(domains, domain)
+		}
+	*/
+
+	return validDomains(ID, domains)
+}
+
+// ignored reports whether the ignore label, -ignore-name-regex, -project-filter or -label-selector leave out the
+// container or swarm service called name, from the compose project or stack project
+func (app *App) ignored(ID string, name string, project string, labels map[string]string) bool {
+	if labels[label_cj_flag_ignore] == "true" {
+		slog.Debug("Ignoring container with the ignore label", "container_id", ID)
+		return true
+	}
+	if app.ignoreNameRegex != nil && app.ignoreNameRegex.MatchString(name) {
+		slog.Debug("Ignoring container matching the ignore name regex", "container_id", ID, "name", name)
+		return true
+	}
+	if len(app.projectFilter) > 0 && !containsFold(app.projectFilter, project) {
+		slog.Debug("Ignoring container outside the project filter", "container_id", ID, "project", project)
+		return true
+	}
+	if !app.labelSelector.matches(labels) {
+		slog.Debug("Ignoring container not matching the label selector", "container_id", ID)
+		return true
+	}
+	return false
+}
+
+// validDomains returns domains without the names that could never be resolved, rather than registering garbage,
+// and without names listed twice
+func validDomains(ID string, domains []string) []string {
+	valid := []string{}
+	seen := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		if seen[strings.ToLower(domain)] {
+			continue
+		}
+		seen[strings.ToLower(domain)] = true
+		if err := validateFQDN(strings.TrimPrefix(domain, "*.")); err != nil {
+			slog.Warn("Skipping invalid domain", "container_id", ID, "fqdn", domain, "error", err)
+			continue
+		}
+		valid = append(valid, domain)
+	}
+	return valid
+}
+
+// validateFQDN checks fqdn follows the RFC 1123 host name rules: at most 253 characters, made of dot separated
+// labels of 1 to 63 letters, digits and hyphens that don't start or end with a hyphen.
+func validateFQDN(fqdn string) error {
+	if len(fqdn) > 253 {
+		return fmt.Errorf("name is longer than 253 characters")
+	}
+	for _, label := range strings.Split(fqdn, ".") {
+		if label == "" {
+			return fmt.Errorf("empty label")
+		}
+		if !fqdnLabelRegex.MatchString(label) {
+			return fmt.Errorf("invalid label %q", label)
+		}
+	}
+	return nil
+}
+
+// normalizeDomain trims spaces and surrounding dots from a domain suffix and lower cases it, so " .Container. "
+// becomes "container".  Returns an error if what's left isn't a valid domain.
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+	if domain == "" {
+		return "", fmt.Errorf("empty domain")
+	}
+	return domain, validateFQDN(domain)
+}
+
+// labelDomain returns the normalized domain from a label, or "" if the label is missing or invalid
+func labelDomain(ID string, labels map[string]string, label string) string {
+	value := labels[label]
+	if value == "" {
+		return ""
+	}
+	domain, err := normalizeDomain(value)
+	if err != nil {
+		slog.Warn("Ignoring invalid domain label", "container_id", ID, "label", label, "value", value, "error", err)
+		return ""
+	}
+	return domain
 }
 
 // Parameters:
@@ -0,0 +1,738 @@
+package cjsocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// newStrictTestApp returns an App that only resolves container names, so names that aren't registered fail
+// straight away instead of going to the system resolver
+func newStrictTestApp(t *testing.T) *App {
+	t.Helper()
+	cfg := testConfig(t)
+	cfg.StrictResolve = true
+	return newTestApp(t, cfg)
+}
+
+// resolveIP returns the address name resolves to, or "" when it doesn't resolve
+func resolveIP(app *App, name string) string {
+	_, ip, err := app.Resolve(context.Background(), name)
+	if err != nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func TestHandleEvent(t *testing.T) {
+	web := registration{ID: "web1", ip: "172.17.0.2", domains: []string{"web.container"}}
+	tests := []struct {
+		name   string
+		cfg    func(cfg *Config)
+		setup  func(f *fakeDocker) // Changes to the daemon the events report
+		events []*docker.APIEvents
+		want   []registration
+		check  func(t *testing.T, f *fakeDocker, app *App)
+	}{
+		{
+			name: "start",
+			setup: func(f *fakeDocker) {
+				f.addContainer(fakeContainer("api1", "api", "172.17.0.3", nil))
+			},
+			events: []*docker.APIEvents{fakeEvent("start", "api1")},
+			want:   []registration{web, {ID: "api1", ip: "172.17.0.3", domains: []string{"api.container"}}},
+		},
+		{
+			name:   "die",
+			events: []*docker.APIEvents{fakeEvent("die", "web1")},
+		},
+		{
+			name:   "destroy without inspecting",
+			setup:  func(f *fakeDocker) { f.removeContainer("web1") },
+			events: []*docker.APIEvents{fakeEvent("destroy", "web1")},
+		},
+		{
+			name: "rename",
+			setup: func(f *fakeDocker) {
+				f.changeContainer("web1", func(c *docker.Container) { c.Name = "/frontend" })
+			},
+			events: []*docker.APIEvents{fakeEvent("rename", "web1")},
+			want:   []registration{{ID: "web1", ip: "172.17.0.2", domains: []string{"frontend.container"}}},
+			check: func(t *testing.T, f *fakeDocker, app *App) {
+				if got := resolveIP(app, "frontend.container"); got != "172.17.0.2" {
+					t.Errorf("frontend.container resolved to %q after the rename, want 172.17.0.2", got)
+				}
+				if _, ok := app.Domains()["web.container"]; ok {
+					t.Errorf("web.container still registered after the rename")
+				}
+			},
+		},
+		{
+			name: "update",
+			setup: func(f *fakeDocker) {
+				f.changeContainer("web1", func(c *docker.Container) {
+					c.Config.Labels = map[string]string{label_cj_aliases: "www"}
+				})
+			},
+			events: []*docker.APIEvents{fakeEvent("update", "web1")},
+			want:   []registration{{ID: "web1", ip: "172.17.0.2", domains: []string{"web.container", "www.container"}}},
+		},
+		{
+			name:   "pause",
+			events: []*docker.APIEvents{fakeEvent("pause", "web1")},
+			want:   []registration{web},
+			check: func(t *testing.T, f *fakeDocker, app *App) {
+				if !app.paused["web1"] {
+					t.Errorf("web1 is not paused")
+				}
+				if got := resolveIP(app, "web.container"); got != "" {
+					t.Errorf("web.container resolved to %q while paused, want nothing", got)
+				}
+			},
+		},
+		{
+			name:   "unpause",
+			events: []*docker.APIEvents{fakeEvent("pause", "web1"), fakeEvent("unpause", "web1")},
+			want:   []registration{web},
+			check: func(t *testing.T, f *fakeDocker, app *App) {
+				if app.paused["web1"] {
+					t.Errorf("web1 is still paused")
+				}
+				if got := resolveIP(app, "web.container"); got != "172.17.0.2" {
+					t.Errorf("web.container resolved to %q once unpaused, want 172.17.0.2", got)
+				}
+			},
+		},
+		{
+			name: "disconnect moves to the remaining network",
+			setup: func(f *fakeDocker) {
+				f.changeContainer("web1", func(c *docker.Container) {
+					c.NetworkSettings.Networks = map[string]docker.ContainerNetwork{"backend": {IPAddress: "10.0.0.5"}}
+				})
+			},
+			events: []*docker.APIEvents{fakeNetworkEvent("disconnect", "bridge", "web1")},
+			want:   []registration{{ID: "web1", ip: "10.0.0.5", domains: []string{"web.container"}}},
+		},
+		{
+			name: "disconnect from the last network",
+			setup: func(f *fakeDocker) {
+				f.changeContainer("web1", func(c *docker.Container) {
+					c.NetworkSettings.Networks = map[string]docker.ContainerNetwork{}
+				})
+			},
+			events: []*docker.APIEvents{fakeNetworkEvent("disconnect", "bridge", "web1")},
+		},
+		{
+			name: "create connects a labelled container",
+			cfg:  func(cfg *Config) { cfg.AutoAdd = true },
+			setup: func(f *fakeDocker) {
+				created := fakeContainer("new1", "new", "", map[string]string{label_cj_hostname: "new"})
+				created.State = docker.State{Status: "created"}
+				f.addContainer(created)
+			},
+			events: []*docker.APIEvents{fakeEvent("create", "new1")},
+			want:   []registration{web},
+			check: func(t *testing.T, f *fakeDocker, app *App) {
+				container, _ := f.InspectContainer("new1")
+				if _, ok := container.NetworkSettings.Networks[default_cj_network_name]; !ok {
+					t.Errorf("new1 was not connected to %v, networks %v", default_cj_network_name, container.NetworkSettings.Networks)
+				}
+			},
+		},
+		{
+			name: "create leaves a container without a cj label alone",
+			cfg:  func(cfg *Config) { cfg.AutoAdd = true },
+			setup: func(f *fakeDocker) {
+				created := fakeContainer("new1", "new", "", nil)
+				created.State = docker.State{Status: "created"}
+				f.addContainer(created)
+			},
+			events: []*docker.APIEvents{fakeEvent("create", "new1")},
+			want:   []registration{web},
+			check: func(t *testing.T, f *fakeDocker, app *App) {
+				if n := f.called("ConnectNetwork"); n != 0 {
+					t.Errorf("ConnectNetwork called %v times, want 0", n)
+				}
+			},
+		},
+		{
+			name: "create connects a container without a cj label with auto add all",
+			cfg:  func(cfg *Config) { cfg.AutoAdd, cfg.AutoAddAll = true, true },
+			setup: func(f *fakeDocker) {
+				created := fakeContainer("new1", "new", "", nil)
+				created.State = docker.State{Status: "created"}
+				f.addContainer(created)
+			},
+			events: []*docker.APIEvents{fakeEvent("create", "new1")},
+			want:   []registration{web},
+			check: func(t *testing.T, f *fakeDocker, app *App) {
+				if n := f.called("ConnectNetwork"); n != 1 {
+					t.Errorf("ConnectNetwork called %v times, want 1", n)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			if tt.cfg != nil {
+				tt.cfg(&cfg)
+			}
+			app := newTestApp(t, cfg)
+			f := newFakeDocker()
+			f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+			if err := registerRunningContainers(app, f); err != nil {
+				t.Fatalf("registerRunningContainers: %v", err)
+			}
+			assertRegistered(t, app, web)
+
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+			for _, event := range tt.events {
+				app.handleEvent(f, event)
+			}
+			assertRegistered(t, app, tt.want...)
+			if tt.check != nil {
+				tt.check(t, f, app)
+			}
+		})
+	}
+}
+
+func TestConcurrentResolveAndRegister(t *testing.T) {
+	app := newStrictTestApp(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		ID := fmt.Sprintf("web%v", i)
+		domain := fmt.Sprintf("web%v.container", i)
+		ip := fmt.Sprintf("172.17.0.%v", i+2)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				app.registerContainer(ID, containerMeta{}, []string{domain}, ip)
+				app.removeContainer(ID)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if got := resolveIP(app, domain); got != "" && got != ip {
+					t.Errorf("%v resolved to %v, want %v or nothing", domain, got, ip)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assertRegistered(t, app)
+}
+
+func TestDieStopsResolving(t *testing.T) {
+	app := newStrictTestApp(t)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	if got := resolveIP(app, "web.container"); got != "172.17.0.2" {
+		t.Fatalf("web.container resolved to %q after start, want 172.17.0.2", got)
+	}
+
+	app.handleEvent(f, fakeEvent("die", "web1"))
+	if got := resolveIP(app, "web.container"); got != "" {
+		t.Errorf("web.container resolved to %v after die, want nothing", got)
+	}
+}
+
+func TestGeneratedHostname(t *testing.T) {
+	tests := []struct {
+		hostname  string
+		generated bool
+		want      string // Name of a container called myapp with the host name
+	}{
+		{hostname: "a1b2c3d4e5f6", generated: true, want: "myapp.container"},
+		{hostname: "mytwelvechar", want: "mytwelvechar.container"},
+		{hostname: "web", want: "web.container"},
+	}
+	app := newTestApp(t, testConfig(t))
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			if got := isGeneratedHostname(tt.hostname); got != tt.generated {
+				t.Errorf("isGeneratedHostname(%q) = %v, want %v", tt.hostname, got, tt.generated)
+			}
+			container := fakeContainer("id1", "myapp", "172.17.0.2", nil)
+			container.Config.Hostname = tt.hostname
+			if domains := app.getDomains(container); len(domains) == 0 || domains[0] != tt.want {
+				t.Errorf("getDomains = %v, want %v first", domains, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateFQDN(t *testing.T) {
+	tests := []struct {
+		fqdn  string
+		valid bool
+	}{
+		{fqdn: "web..container"},
+		{fqdn: "-bad.container"},
+		{fqdn: "web.proj.container", valid: true},
+	}
+	for _, tt := range tests {
+		if err := validateFQDN(tt.fqdn); (err == nil) != tt.valid {
+			t.Errorf("validateFQDN(%q) = %v, want valid %v", tt.fqdn, err, tt.valid)
+		}
+	}
+}
+
+func TestCollisionPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		owner   string // Container that ends up with web.container
+		ownerIP string
+	}{
+		{policy: collision_policy_first, owner: "web1", ownerIP: "172.17.0.2"},
+		{policy: collision_policy_last, owner: "web2", ownerIP: "172.17.0.3"},
+		{policy: collision_policy_error, owner: "web1", ownerIP: "172.17.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.CollisionPolicy = tt.policy
+			cfg.StrictResolve = true
+			app := newTestApp(t, cfg)
+			app.registerContainer("web1", containerMeta{}, []string{"web.container"}, "172.17.0.2")
+			app.registerContainer("web2", containerMeta{}, []string{"web.container"}, "172.17.0.3")
+
+			want := map[string]registration{
+				"web1": {ID: "web1", ip: "172.17.0.2"},
+				"web2": {ID: "web2", ip: "172.17.0.3"},
+			}
+			owner := want[tt.owner]
+			owner.domains = []string{"web.container"}
+			want[tt.owner] = owner
+			assertRegistered(t, app, want["web1"], want["web2"])
+			if got := resolveIP(app, "web.container"); got != tt.ownerIP {
+				t.Errorf("web.container resolved to %q, want %v", got, tt.ownerIP)
+			}
+
+			// Only the owner removes the name
+			other := "web2"
+			if tt.owner == "web2" {
+				other = "web1"
+			}
+			app.removeContainer(other)
+			if got := resolveIP(app, "web.container"); got != tt.ownerIP {
+				t.Errorf("web.container resolved to %q after removing %v, want %v", got, other, tt.ownerIP)
+			}
+			app.removeContainer(tt.owner)
+			if got := resolveIP(app, "web.container"); got != "" {
+				t.Errorf("web.container resolved to %v after removing both, want nothing", got)
+			}
+		})
+	}
+}
+
+func TestDestroyRemovesWithoutInspecting(t *testing.T) {
+	app := newStrictTestApp(t)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	f.removeContainer("web1")
+	inspected := f.called("InspectContainer")
+
+	app.handleEvent(f, fakeEvent("destroy", "web1"))
+	assertRegistered(t, app)
+	if n := f.called("InspectContainer") - inspected; n != 0 {
+		t.Errorf("InspectContainer called %v times for destroy, want 0", n)
+	}
+	if got := resolveIP(app, "web.container"); got != "" {
+		t.Errorf("web.container resolved to %v after destroy, want nothing", got)
+	}
+}
+
+func TestReplicasRoundRobin(t *testing.T) {
+	app := newStrictTestApp(t)
+	meta := containerMeta{service: "web"}
+	ips := []string{"172.17.0.2", "172.17.0.3", "172.17.0.4"}
+	for i, ip := range ips {
+		app.registerContainer(fmt.Sprintf("web%v", i+1), meta, []string{"web.proj.container"}, ip)
+	}
+
+	got := []string{}
+	seen := map[string]bool{}
+	for i := 0; i < 2*len(ips); i++ {
+		ip := resolveIP(app, "web.proj.container")
+		got = append(got, ip)
+		seen[ip] = true
+	}
+	for i := len(ips); i < len(got); i++ {
+		if got[i] != got[i-len(ips)] {
+			t.Fatalf("resolved to %v, want the replicas in turn", got)
+		}
+	}
+	for _, ip := range ips {
+		if !seen[ip] {
+			t.Errorf("resolved to %v, never %v", got, ip)
+		}
+	}
+}
+
+func TestResolveTrailingDot(t *testing.T) {
+	app := newStrictTestApp(t)
+	app.registerContainer("web1", containerMeta{}, []string{"web.container"}, "172.17.0.2")
+	for _, name := range []string{"web.container", "web.container."} {
+		if got := resolveIP(app, name); got != "172.17.0.2" {
+			t.Errorf("%v resolved to %q, want 172.17.0.2", name, got)
+		}
+	}
+}
+
+func TestRestartWithNewIP(t *testing.T) {
+	app := newStrictTestApp(t)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+	app.handleEvent(f, fakeEvent("start", "web1"))
+
+	// Restarted without a die event getting through
+	f.changeContainer("web1", func(c *docker.Container) {
+		c.NetworkSettings.Networks["bridge"] = docker.ContainerNetwork{IPAddress: "172.17.0.9"}
+	})
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	assertRegistered(t, app, registration{ID: "web1", ip: "172.17.0.9", domains: []string{"web.container"}})
+	if got := resolveIP(app, "web.container"); got != "172.17.0.9" {
+		t.Errorf("web.container resolved to %q, want 172.17.0.9", got)
+	}
+}
+
+func TestNoCreateNetwork(t *testing.T) {
+	for _, noCreate := range []bool{false, true} {
+		cfg := testConfig(t)
+		cfg.NoCreateNetwork = noCreate
+		app := newTestApp(t, cfg)
+		f := newFakeDocker()
+		if err := createNetwork(app, f); err != nil {
+			t.Fatalf("createNetwork with no create network %v: %v", noCreate, err)
+		}
+		want := 1
+		if noCreate {
+			want = 0
+		}
+		if n := f.called("CreateNetwork"); n != want {
+			t.Errorf("CreateNetwork called %v times with no create network %v, want %v", n, noCreate, want)
+		}
+		if n := f.called("NetworkInfo"); n != 1 {
+			t.Errorf("NetworkInfo called %v times with no create network %v, want 1", n, noCreate)
+		}
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	// A UDP echo server to relay to
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { target.Close() })
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, addr, err := target.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			target.WriteTo(buffer[:n], addr)
+		}
+	}()
+
+	// The relay shares the TCP port number
+	port := freeTCPPort(t)
+	cfg := socksTestConfig(t)
+	cfg.UnixSocket = ""
+	cfg.ListenIP = "127.0.0.1"
+	cfg.Port = port
+	cfg.EnableUDP = true
+	cfg.DrainTimeout = Duration{100 * time.Millisecond} // The library only notices the association closed every 10 seconds
+	app := newTestApp(t, cfg)
+	app.registerContainer("echo1", containerMeta{}, []string{"echo.container"}, "127.0.0.1")
+	stop := startApp(t, app)
+
+	var conn net.Conn
+	waitFor(t, "the socks5 server", func() bool {
+		conn, err = net.Dial("tcp", cfg.listenAddr())
+		return err == nil
+	})
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, 10)
+	conn.Write([]byte{5, 1, 0}) // No authentication
+	if _, err := io.ReadFull(conn, reply[:2]); err != nil || reply[1] != 0 {
+		t.Fatalf("socks5 greeting reply = %v, %v", reply[:2], err)
+	}
+	conn.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0}) // UDP associate from any address
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+		t.Fatalf("UDP associate reply = %v, %v", reply, err)
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:10]))}
+	if want := (&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}); relay.String() != want.String() {
+		t.Errorf("relay address = %v, want %v", relay, want)
+	}
+
+	udp, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+	defer udp.Close()
+	to := target.LocalAddr().(*net.UDPAddr)
+	byIP := append([]byte{0, 0, 0, 1}, to.IP.To4()...)
+	byIP = binary.BigEndian.AppendUint16(byIP, uint16(to.Port))
+	byName := append([]byte{0, 0, 0, 3, byte(len("echo.container"))}, "echo.container"...)
+	byName = binary.BigEndian.AppendUint16(byName, uint16(to.Port))
+	for _, header := range [][]byte{byIP, byName} {
+		udp.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := udp.Write(append(header, "ping"...)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		packet := make([]byte, 1500)
+		n, err := udp.Read(packet)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if got := string(packet[:n]); got != string(header)+"ping" {
+			t.Errorf("relayed reply = %q, want %q", got, string(header)+"ping")
+		}
+	}
+
+	// Shutting down closes the relay's socket too
+	conn.Close()
+	if err := stop(); err != nil {
+		t.Fatalf("Run = %v, want nil", err)
+	}
+	relayed, err := net.ListenPacket("udp", relay.String())
+	if err != nil {
+		t.Fatalf("UDP relay port still in use after Run returned: %v", err)
+	}
+	relayed.Close()
+}
+
+func TestAutoAddedContainerResolvesOnCJNetwork(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []string // Container events cjsocks sees.  It isn't listening yet when create is missing.
+		logged string   // Message reporting the IP on the cj network
+	}{
+		{name: "connected when created", events: []string{"create", "start"}, logged: "Container has IP on network"},
+		{name: "created earlier", events: []string{"start"}, logged: "Connected container to network"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			cfg := testConfig(t)
+			cfg.AutoAdd = true
+			cfg.StrictResolve = true
+			app := newTestApp(t, cfg)
+			f := newFakeDocker()
+			created := fakeContainer("new1", "new", "172.17.0.5", map[string]string{label_cj_hostname: "new"})
+			created.State = docker.State{Status: "created"}
+			f.addContainer(created)
+
+			for _, action := range tt.events {
+				if action == "start" {
+					f.changeContainer("new1", func(c *docker.Container) { c.State = docker.State{Running: true, Status: "running"} })
+				}
+				app.handleEvent(f, fakeEvent(action, "new1"))
+			}
+			if n := f.called("ConnectNetwork"); n != 1 {
+				t.Errorf("ConnectNetwork called %v times, want 1", n)
+			}
+			assertRegistered(t, app, registration{ID: "new1", ip: f.connectIP, domains: []string{"new.container"}})
+			if got := resolveIP(app, "new.container"); got != f.connectIP {
+				t.Errorf("new.container resolved to %q, want its %v address %v", got, default_cj_network_name, f.connectIP)
+			}
+			reported := logs.records(tt.logged)
+			if len(reported) != 1 || reported[0]["ip"] != f.connectIP {
+				t.Errorf("%q logged %v, want it once with ip %v", tt.logged, reported, f.connectIP)
+			}
+		})
+	}
+}
+
+func TestUpdateHooksGetChangedNames(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+	var started, stopped [][]string
+	app.hooks.OnContainerStart = func(domains []string, ip string) { started = append(started, domains) }
+	app.hooks.OnContainerStop = func(domains []string) { stopped = append(stopped, domains) }
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", map[string]string{label_cj_aliases: "www"}))
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	assertEqual(t, "started on start", started, [][]string{{"web.container", "www.container"}})
+
+	f.changeContainer("web1", func(c *docker.Container) {
+		c.Config.Labels = map[string]string{label_cj_aliases: "api"}
+	})
+	started = nil
+	app.handleEvent(f, fakeEvent("update", "web1"))
+	assertEqual(t, "started on update", started, [][]string{{"api.container"}})
+	assertEqual(t, "stopped on update", stopped, [][]string{{"www.container"}})
+
+	// Nothing new, nothing to report
+	started, stopped = nil, nil
+	app.handleEvent(f, fakeEvent("update", "web1"))
+	assertEqual(t, "started on an update changing nothing", started, [][]string(nil))
+	assertEqual(t, "stopped on an update changing nothing", stopped, [][]string(nil))
+}
+
+func TestLogLevelError(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := NewLogger(&out, "error")
+	if err != nil {
+		t.Fatalf("NewLogger: %v", err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(previous)
+
+	app := newTestApp(t, testConfig(t))
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	slog.Error("Something failed", "container_id", "web1")
+
+	if strings.Contains(out.String(), "Container started") {
+		t.Errorf("info line logged at level error: %q", out.String())
+	}
+	if !strings.Contains(out.String(), "level=ERROR") || !strings.Contains(out.String(), "container_id=web1") {
+		t.Errorf("log = %q, want the error line", out.String())
+	}
+
+	if _, err := NewLogger(&out, "loud"); err == nil {
+		t.Error("NewLogger(loud) = nil error, want the invalid level reported")
+	}
+}
+
+// staleList lists every container as if it were running, like a list taken just before some of them stopped
+type staleList struct {
+	*fakeDocker
+}
+
+func (s staleList) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	opts.All = true
+	return s.fakeDocker.ListContainers(opts)
+}
+
+func TestRegisterRunningContainersSkipsStopped(t *testing.T) {
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+	f.addContainer(fakeContainer("db1", "db", "172.17.0.3", nil))
+	f.changeContainer("db1", func(c *docker.Container) { c.State = docker.State{Status: "exited"} })
+	f.addContainer(fakeContainer("new1", "new", "", nil))
+	f.changeContainer("new1", func(c *docker.Container) { c.State = docker.State{Status: "created"} })
+
+	for _, client := range []dockerAPI{f, staleList{f}} {
+		app := newTestApp(t, testConfig(t))
+		if err := registerRunningContainers(app, client); err != nil {
+			t.Fatalf("registerRunningContainers: %v", err)
+		}
+		assertRegistered(t, app, registration{ID: "web1", ip: "172.17.0.2", domains: []string{"web.container"}})
+	}
+}
+
+func TestStrictResolve(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		cfg := testConfig(t)
+		cfg.StrictResolve = strict
+		app := newTestApp(t, cfg)
+		app.registerContainer("web1", containerMeta{}, []string{"web.container"}, "172.17.0.2")
+
+		if got := resolveIP(app, "web.container"); got != "172.17.0.2" {
+			t.Errorf("strict %v: web.container resolved to %q, want 172.17.0.2", strict, got)
+		}
+		// Unknown names go to the system resolver unless resolution is strict
+		want := "127.0.0.1"
+		if strict {
+			want = ""
+		}
+		if got := resolveIP(app, "localhost"); got != want {
+			t.Errorf("strict %v: localhost resolved to %q, want %q", strict, got, want)
+		}
+	}
+}
+
+func TestStartRetriesWithoutIP(t *testing.T) {
+	app := newStrictTestApp(t)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "", nil))
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	if got := resolveIP(app, "web.container"); got != "" {
+		t.Fatalf("web.container resolved to %q without an IP", got)
+	}
+
+	// The address is assigned after the start event
+	f.changeContainer("web1", func(c *docker.Container) {
+		c.NetworkSettings.Networks["bridge"] = docker.ContainerNetwork{IPAddress: "172.17.0.2"}
+	})
+	waitFor(t, "web.container to resolve", func() bool { return resolveIP(app, "web.container") == "172.17.0.2" })
+	if calls := f.called("InspectContainer"); calls != 2 {
+		t.Errorf("inspected web1 %v times, want once for the event and once more when retrying", calls)
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", map[string]string{label_cj_aliases: "www"}))
+	f.addContainer(fakeContainer("api1", "api", "172.17.0.3", nil))
+	cfg := socksTestConfig(t)
+	app := newTestApp(t, cfg)
+	app.dockerClient = func() (dockerAPI, error) { return f, nil }
+
+	var out bytes.Buffer
+	if err := app.runOnce(&out); err != nil {
+		t.Fatalf("runOnce: %v", err)
+	}
+	want := "FQDN           IP\n" +
+		"api.container  172.17.0.3\n" +
+		"web.container  172.17.0.2\n" +
+		"www.container  172.17.0.2\n"
+	if out.String() != want {
+		t.Errorf("runOnce wrote\n%v\nwant\n%v", out.String(), want)
+	}
+	// Nothing is served
+	if _, err := net.Dial("unix", cfg.UnixSocket); !isNotListening(err) {
+		t.Errorf("dialing the socks5 socket after runOnce = %v, want nothing listening", err)
+	}
+	if calls := f.called("AddEventListener"); calls != 0 {
+		t.Errorf("listened for docker events %v times, want none", calls)
+	}
+
+	f.setPingErr(errors.New("fake docker daemon is unreachable"))
+	if err := app.runOnce(&out); err == nil || !strings.Contains(err.Error(), "could not reach the docker daemon") {
+		t.Errorf("runOnce with docker unreachable = %v, want the daemon reported unreachable", err)
+	}
+}
+
+func TestInspectOncePerStart(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+	f := newFakeDocker()
+	f.addContainer(onNetworks(map[string]string{"frontend": "172.20.0.2", "backend": "172.19.0.2"}, map[string]string{
+		label_cj_aliases:       "www",
+		label_cj_flag_wildcard: "true",
+		label_cj_ttl:           "60",
+	}))
+	for i := 1; i <= 3; i++ {
+		app.handleEvent(f, fakeEvent("start", "web1"))
+		if calls := f.called("InspectContainer"); calls != i {
+			t.Errorf("InspectContainer called %v times after %v start events, want %v", calls, i, i)
+		}
+	}
+	assertRegistered(t, app, registration{ID: "web1", ip: "172.19.0.2", domains: []string{"web.container", "www.container", "*.web.container", "*.www.container"}})
+}
@@ -0,0 +1,86 @@
+// Command cjsocks runs the cjsocks socks5 server.  The flags are documented in the cjsocks package.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/king-perseus/cjsocks"
+)
+
+func main() {
+	cfg, err := cjsocks.ParseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(2)
+	}
+
+	if cfg.PrintVersion {
+		cjsocks.WriteVersion(os.Stdout)
+		os.Exit(0)
+	}
+
+	// Keep stdout for the table with -once, the events with -events-json and the JSON with -print-config
+	logOutput := os.Stdout
+	if cfg.Once || cfg.EventsJSON || cfg.PrintConfig {
+		logOutput = os.Stderr
+	}
+	logger, err := cjsocks.NewLogger(logOutput, cfg.LogLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	for _, key := range cfg.UnknownKeys {
+		slog.Warn("Ignoring unknown config file option", "path", cfg.ConfigFile, "key", key)
+	}
+	cfg = cjsocks.SelfConfig(cfg)
+
+	// Printed after the labels on our own container are applied, so it is the configuration Run would use
+	if cfg.PrintConfig {
+		if err := cjsocks.PrintConfig(os.Stdout, cfg); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if cfg.Once {
+		if err := cjsocks.RunOnce(cfg, os.Stdout); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Cancelled on SIGINT/SIGTERM to stop the docker event listener and the servers
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		slog.Info("Shutting down", "signal", sig.String())
+		cancel()
+	}()
+
+	app, err := cjsocks.New(cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	if err := app.Run(ctx); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
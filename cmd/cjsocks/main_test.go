@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain runs main instead of the tests in the subprocesses the tests start
+func TestMain(m *testing.M) {
+	if os.Getenv("CJSOCKS_RUN_MAIN") == "1" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func TestShutdownOnSignal(t *testing.T) {
+	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGTERM} {
+		t.Run(sig.String(), func(t *testing.T) {
+			socket := filepath.Join(t.TempDir(), "cjsocks.sock")
+			cmd := exec.Command(os.Args[0], "-unix-socket", socket, "-docker-host", "unix://"+filepath.Join(t.TempDir(), "docker.sock"))
+			cmd.Env = append(os.Environ(), "CJSOCKS_RUN_MAIN=1")
+			var out bytes.Buffer
+			cmd.Stdout, cmd.Stderr = &out, &out
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			defer cmd.Process.Kill()
+
+			deadline := time.Now().Add(10 * time.Second)
+			for _, err := os.Stat(socket); err != nil; _, err = os.Stat(socket) {
+				if time.Now().After(deadline) {
+					t.Fatalf("cjsocks didn't start listening: %v", out.String())
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			if err := cmd.Process.Signal(sig); err != nil {
+				t.Fatalf("Signal: %v", err)
+			}
+			done := make(chan error, 1)
+			go func() { done <- cmd.Wait() }()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("cjsocks exited with %v, want 0: %v", err, out.String())
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("cjsocks still running after %v", sig)
+			}
+			// Logged once the docker events listener has returned
+			if !strings.Contains(out.String(), "Shutdown complete") {
+				t.Errorf("no clean shutdown logged: %v", out.String())
+			}
+		})
+	}
+}
+
+func TestVersionFlag(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-version")
+	cmd.Env = append(os.Environ(), "CJSOCKS_RUN_MAIN=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("cjsocks -version exited with %v, want 0: %s", err, out)
+	}
+	if !strings.HasPrefix(string(out), "cjsocks dev (commit ") {
+		t.Errorf("cjsocks -version = %q, want the build information", out)
+	}
+}
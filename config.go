@@ -0,0 +1,450 @@
+package cjsocks
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the effective settings after applying flags, environment variables and defaults
+// The yaml names are the keys accepted in the -config file.
+type Config struct {
+	ListenIP             string   `json:"listen_ip" yaml:"listen_ip"`
+	Port                 int      `json:"port" yaml:"port"`
+	UnixSocket           string   `json:"unix_socket,omitempty" yaml:"unix_socket"`
+	BaseDomain           string   `json:"base_domain" yaml:"base_domain"`
+	CJNetworkName        string   `json:"cj_network" yaml:"cj_network"`
+	NoCreateNetwork      bool     `json:"no_create_network" yaml:"no_create_network"`
+	AutoAdd              bool     `json:"auto_add" yaml:"auto_add"`
+	AutoAddAll           bool     `json:"auto_add_all" yaml:"auto_add_all"`
+	DockerHost           string   `json:"docker_host" yaml:"docker_host"`
+	HostAddress          string   `json:"host_address,omitempty" yaml:"host_address"`
+	HostAlias            string   `json:"host_alias" yaml:"host_alias"`
+	DockerTLSCert        string   `json:"docker_tls_cert,omitempty" yaml:"docker_tls_cert"`
+	DockerTLSKey         string   `json:"docker_tls_key,omitempty" yaml:"docker_tls_key"`
+	DockerTLSCA          string   `json:"docker_tls_ca,omitempty" yaml:"docker_tls_ca"`
+	DockerTimeout        Duration `json:"docker_timeout" yaml:"docker_timeout"`
+	LogLevel             string   `json:"log_level" yaml:"log_level"`
+	SocksUser            string   `json:"socks_user,omitempty" yaml:"socks_user"`
+	SocksPass            string   `json:"-" yaml:"socks_pass"` // Never printed
+	BindRetries          int      `json:"bind_retries" yaml:"bind_retries"`
+	BindRetryDelay       Duration `json:"bind_retry_delay" yaml:"bind_retry_delay"`
+	BackoffMax           Duration `json:"backoff_max" yaml:"backoff_max"`
+	ReconcileInterval    Duration `json:"reconcile_interval" yaml:"reconcile_interval"`
+	AdminPort            int      `json:"admin_port" yaml:"admin_port"`
+	DNSPort              int      `json:"dns_port" yaml:"dns_port"`
+	DNSTTL               int      `json:"dns_ttl" yaml:"dns_ttl"`
+	DNSSearch            bool     `json:"dns_search" yaml:"dns_search"`
+	MaxConnsPerSec       int      `json:"max_conns_per_sec" yaml:"max_conns_per_sec"`
+	MaxDomains           int      `json:"max_domains" yaml:"max_domains"`
+	NetworkPriority      []string `json:"network_priority" yaml:"network_priority"`
+	NetworkSuffix        bool     `json:"network_suffix" yaml:"network_suffix"`
+	Swarm                bool     `json:"swarm" yaml:"swarm"`
+	DockerSuffixAlias    bool     `json:"docker_suffix_alias" yaml:"docker_suffix_alias"`
+	PreferIPv6           bool     `json:"prefer_ipv6" yaml:"prefer_ipv6"`
+	HostsFile            string   `json:"hosts_file,omitempty" yaml:"hosts_file"`
+	EventsJSON           bool     `json:"events_json" yaml:"events_json"`
+	WebhookURL           string   `json:"webhook_url,omitempty" yaml:"webhook_url"`
+	ResolveCacheTTL      Duration `json:"resolve_cache_ttl" yaml:"resolve_cache_ttl"`
+	ResolveCacheSize     int      `json:"resolve_cache_size" yaml:"resolve_cache_size"`
+	AllowCIDR            []string `json:"allow_cidr,omitempty" yaml:"allow_cidr"`
+	DenyCIDR             []string `json:"deny_cidr,omitempty" yaml:"deny_cidr"`
+	StrictResolve        bool     `json:"strict_resolve" yaml:"strict_resolve"`
+	UpstreamDNS          []string `json:"upstream_dns" yaml:"upstream_dns"`
+	DialTimeout          Duration `json:"dial_timeout" yaml:"dial_timeout"`
+	IdleTimeout          Duration `json:"idle_timeout" yaml:"idle_timeout"`
+	DrainTimeout         Duration `json:"drain_timeout" yaml:"drain_timeout"`
+	RemovalGrace         Duration `json:"removal_grace" yaml:"removal_grace"`
+	EnableUDP            bool     `json:"enable_udp" yaml:"enable_udp"`
+	Registry             string   `json:"registry,omitempty" yaml:"registry"`
+	EnableDiscovery      bool     `json:"enable_discovery" yaml:"enable_discovery"`
+	RegisterShortNames   bool     `json:"register_short_names" yaml:"register_short_names"`
+	RegisterReplicaNames bool     `json:"register_replica_names" yaml:"register_replica_names"`
+	CollisionPolicy      string   `json:"collision_policy" yaml:"collision_policy"`
+	ShortNameCollision   string   `json:"short_name_collision" yaml:"short_name_collision"`
+	ProjectFilter        []string `json:"project_filter,omitempty" yaml:"project_filter"`
+	IgnoreNameRegex      string   `json:"ignore_name_regex,omitempty" yaml:"ignore_name_regex"`
+	LabelSelector        string   `json:"label_selector,omitempty" yaml:"label_selector"`
+	ConfigFile           string   `json:"config_file,omitempty" yaml:"-"`
+	PrintConfig          bool     `json:"-" yaml:"-"`
+	PrintVersion         bool     `json:"-" yaml:"-"`
+	Once                 bool     `json:"-" yaml:"-"`
+	UnknownKeys          []string `json:"-" yaml:"-"` // Keys in the config file that don't match an option
+
+	// Keys of the options set by a flag, the config file or the environment, which the labels on cjsocks's
+	// own container leave alone
+	explicit map[string]bool
+}
+
+// listFlag is a flag holding a comma separated list
+type listFlag []string
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = splitList(value)
+	return nil
+}
+
+// Duration is a time.Duration that is written and read as text, e.g. "2s"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// envConfig returns the built in defaults overridden by any CJ_* environment variables.
+// The docker settings follow the docker CLI: DOCKER_HOST, and the certificates in DOCKER_CERT_PATH
+// (default ~/.docker) when DOCKER_TLS_VERIFY is set.
+func envConfig() Config {
+	var certPath string
+	if os.Getenv("DOCKER_TLS_VERIFY") != "" {
+		certPath = os.Getenv("DOCKER_CERT_PATH")
+		if certPath == "" {
+			home, _ := os.UserHomeDir()
+			certPath = filepath.Join(home, ".docker")
+		}
+	}
+	dockerCert := func(name string) string {
+		if certPath == "" {
+			return ""
+		}
+		return filepath.Join(certPath, name)
+	}
+
+	return Config{
+		ListenIP:             envOrDefault("CJ_LISTEN_IP", default_ip),
+		Port:                 envIntOrDefault("CJ_SOCKS_PORT", default_port),
+		UnixSocket:           os.Getenv("CJ_UNIX_SOCKET"),
+		BaseDomain:           envOrDefault("CJ_BASE_DOMAIN", default_base_domain),
+		CJNetworkName:        envOrDefault("CJ_NETWORK", default_cj_network_name),
+		NoCreateNetwork:      envBoolOrDefault("CJ_NO_CREATE_NETWORK", false),
+		AutoAdd:              envBoolOrDefault("CJ_AUTO_ADD", default_auto_add_to_cjnetwork),
+		AutoAddAll:           envBoolOrDefault("CJ_AUTO_ADD_ALL", false),
+		DockerHost:           envOrDefault("DOCKER_HOST", default_docker_host),
+		HostAddress:          os.Getenv("CJ_HOST_ADDRESS"),
+		HostAlias:            envOrDefault("CJ_HOST_ALIAS", default_host_alias),
+		DockerTLSCert:        dockerCert("cert.pem"),
+		DockerTLSKey:         dockerCert("key.pem"),
+		DockerTLSCA:          dockerCert("ca.pem"),
+		DockerTimeout:        Duration{envDurationOrDefault("CJ_DOCKER_TIMEOUT", default_docker_timeout)},
+		LogLevel:             envOrDefault("CJ_LOG_LEVEL", default_log_level),
+		SocksUser:            os.Getenv("CJ_SOCKS_USER"),
+		SocksPass:            os.Getenv("CJ_SOCKS_PASS"),
+		BindRetries:          envIntOrDefault("CJ_BIND_RETRIES", default_bind_retries),
+		BindRetryDelay:       Duration{envDurationOrDefault("CJ_BIND_RETRY_DELAY", default_bind_retry_delay)},
+		BackoffMax:           Duration{envDurationOrDefault("CJ_BACKOFF_MAX", default_backoff_max)},
+		ReconcileInterval:    Duration{envDurationOrDefault("CJ_RECONCILE_INTERVAL", default_reconcile_interval)},
+		AdminPort:            envIntOrDefault("CJ_ADMIN_PORT", default_admin_port),
+		DNSPort:              envIntOrDefault("CJ_DNS_PORT", default_dns_port),
+		MaxConnsPerSec:       envIntOrDefault("CJ_MAX_CONNS_PER_SEC", 0),
+		MaxDomains:           envIntOrDefault("CJ_MAX_DOMAINS", 0),
+		DNSTTL:               envIntOrDefault("CJ_DNS_TTL", default_dns_ttl),
+		DNSSearch:            envBoolOrDefault("CJ_DNS_SEARCH", false),
+		NetworkPriority:      splitList(os.Getenv("CJ_NETWORK_PRIORITY")),
+		NetworkSuffix:        envBoolOrDefault("CJ_NETWORK_SUFFIX", false),
+		Swarm:                envBoolOrDefault("CJ_SWARM", false),
+		DockerSuffixAlias:    envBoolOrDefault("CJ_DOCKER_SUFFIX_ALIAS", false),
+		PreferIPv6:           envBoolOrDefault("CJ_PREFER_IPV6", false),
+		HostsFile:            os.Getenv("CJ_HOSTS_FILE"),
+		EventsJSON:           envBoolOrDefault("CJ_EVENTS_JSON", false),
+		WebhookURL:           os.Getenv("CJ_WEBHOOK_URL"),
+		ResolveCacheTTL:      Duration{envDurationOrDefault("CJ_RESOLVE_CACHE_TTL", default_resolve_cache_ttl)},
+		ResolveCacheSize:     envIntOrDefault("CJ_RESOLVE_CACHE_SIZE", default_resolve_cache_size),
+		AllowCIDR:            splitList(os.Getenv("CJ_ALLOW_CIDR")),
+		DenyCIDR:             splitList(os.Getenv("CJ_DENY_CIDR")),
+		StrictResolve:        envBoolOrDefault("CJ_STRICT_RESOLVE", false),
+		UpstreamDNS:          splitList(os.Getenv("CJ_UPSTREAM_DNS")),
+		DialTimeout:          Duration{envDurationOrDefault("CJ_DIAL_TIMEOUT", default_dial_timeout)},
+		IdleTimeout:          Duration{envDurationOrDefault("CJ_IDLE_TIMEOUT", 0)},
+		DrainTimeout:         Duration{envDurationOrDefault("CJ_DRAIN_TIMEOUT", default_drain_timeout)},
+		RemovalGrace:         Duration{envDurationOrDefault("CJ_REMOVAL_GRACE", 0)},
+		EnableUDP:            envBoolOrDefault("CJ_ENABLE_UDP", false),
+		Registry:             os.Getenv("CJ_REGISTRY"),
+		EnableDiscovery:      envBoolOrDefault("CJ_ENABLE_DISCOVERY", false),
+		RegisterShortNames:   envBoolOrDefault("CJ_REGISTER_SHORT_NAMES", false),
+		RegisterReplicaNames: envBoolOrDefault("CJ_REGISTER_REPLICA_NAMES", false),
+		CollisionPolicy:      envOrDefault("CJ_COLLISION_POLICY", collision_policy_last),
+		ShortNameCollision:   envOrDefault("CJ_SHORT_NAME_COLLISION", collision_policy_first),
+		ProjectFilter:        splitList(os.Getenv("CJ_PROJECT_FILTER")),
+		IgnoreNameRegex:      os.Getenv("CJ_IGNORE_NAME_REGEX"),
+		LabelSelector:        os.Getenv("CJ_LABEL_SELECTOR"),
+		ConfigFile:           os.Getenv("CJ_CONFIG"),
+	}
+}
+
+// newFlagSet defines a flag for each option that writes to cfg, using def for the defaults
+func newFlagSet(cfg *Config, def Config) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("cjsocks", flag.ContinueOnError)
+	fs.StringVar(&cfg.ConfigFile, "config", def.ConfigFile, "YAML file with configuration options.  Flags take precedence over the file, which takes precedence over environment variables")
+	fs.BoolVar(&cfg.AutoAdd, "autoadd", def.AutoAdd, "Automatically connect new containers to the cj network")
+	fs.BoolVar(&cfg.AutoAddAll, "auto-add-all", def.AutoAddAll, "With -autoadd, also connect containers without a cj label")
+	fs.StringVar(&cfg.BaseDomain, "basedomain", def.BaseDomain, "Default base domain for containers if not overridden.  A comma separated list registers each container under all of them")
+	fs.StringVar(&cfg.CJNetworkName, "cj-network", def.CJNetworkName, "Docker network to create and connect containers to")
+	fs.BoolVar(&cfg.NoCreateNetwork, "no-create-network", def.NoCreateNetwork, "Don't create the -cj-network, it was created beforehand.  For when cjsocks may not create networks")
+	fs.StringVar(&cfg.ListenIP, "listenip", def.ListenIP, "IP address to start the socks5 server on")
+	port := fs.String("port", strconv.Itoa(def.Port), "Port to listen on")
+	fs.StringVar(&cfg.UnixSocket, "unix-socket", def.UnixSocket, "Unix socket path to listen on instead of the TCP port, e.g. to share the socks5 server through a volume")
+	fs.StringVar(&cfg.SocksUser, "socks-user", def.SocksUser, "Username required by the socks5 server.  Authentication is disabled if empty")
+	fs.StringVar(&cfg.SocksPass, "socks-pass", def.SocksPass, "Password required by the socks5 server")
+	fs.IntVar(&cfg.BindRetries, "bind-retries", def.BindRetries, "Number of times to retry listening when the port is already in use")
+	fs.DurationVar(&cfg.BindRetryDelay.Duration, "bind-retry-delay", def.BindRetryDelay.Duration, "Delay before the first listen retry.  Doubles on each retry up to -backoff-max")
+	fs.DurationVar(&cfg.BackoffMax.Duration, "backoff-max", def.BackoffMax.Duration, "Longest delay between retries of the docker connection and of listening.  Delays double up to it")
+	fs.DurationVar(&cfg.ReconcileInterval.Duration, "reconcile-interval", def.ReconcileInterval.Duration, "How often to compare the registered containers with the running ones, in case events were missed.  0 disables it")
+	fs.IntVar(&cfg.AdminPort, "admin-port", def.AdminPort, "Port for the admin HTTP server to listen on.  0 disables the admin server")
+	cfg.NetworkPriority = def.NetworkPriority
+	fs.Var((*listFlag)(&cfg.NetworkPriority), "network-priority", "Comma separated list of networks whose container IP addresses are preferred, highest priority first")
+	fs.BoolVar(&cfg.NetworkSuffix, "network-suffix", def.NetworkSuffix, "Put the name of the network a container is reached on in its names, e.g. web.frontend.container")
+	fs.BoolVar(&cfg.Swarm, "swarm", def.Swarm, "Register the virtual IP of each swarm service under its name.  Needs a connection to a swarm manager")
+	fs.BoolVar(&cfg.DockerSuffixAlias, "docker-suffix-alias", def.DockerSuffixAlias, "Also register each container's name with a .docker suffix, e.g. myproject-web-1.docker")
+	fs.BoolVar(&cfg.PreferIPv6, "prefer-ipv6", def.PreferIPv6, "Prefer a container's IPv6 address over its IPv4 address")
+	fs.StringVar(&cfg.HostsFile, "hosts-file", def.HostsFile, "Hosts file to keep updated with container names, e.g. /etc/hosts.  Disabled if empty")
+	fs.BoolVar(&cfg.EventsJSON, "events-json", def.EventsJSON, "Write a JSON line to stdout for each container start, stop and rename.  Logs go to stderr instead")
+	fs.StringVar(&cfg.WebhookURL, "webhook-url", def.WebhookURL, "URL to POST a JSON event to when container names are added or removed.  Disabled if empty")
+	fs.StringVar(&cfg.DockerHost, "docker-host", def.DockerHost, "Docker daemon endpoint")
+	fs.StringVar(&cfg.HostAddress, "host-address", def.HostAddress, "Address of the docker host, for containers that only publish ports on all interfaces.  Defaults to the host of a tcp -docker-host")
+	fs.StringVar(&cfg.HostAlias, "host-alias", def.HostAlias, "Name resolving to the docker host, at -host-address or the gateway of the cj network.  Empty disables it")
+	fs.StringVar(&cfg.DockerTLSCert, "docker-tls-cert", def.DockerTLSCert, "Client certificate for a tcp docker host.  Defaults to cert.pem in DOCKER_CERT_PATH when DOCKER_TLS_VERIFY is set")
+	fs.StringVar(&cfg.DockerTLSKey, "docker-tls-key", def.DockerTLSKey, "Client key for a tcp docker host.  Defaults to key.pem in DOCKER_CERT_PATH when DOCKER_TLS_VERIFY is set")
+	fs.StringVar(&cfg.DockerTLSCA, "docker-tls-ca", def.DockerTLSCA, "CA certificate for a tcp docker host.  Defaults to ca.pem in DOCKER_CERT_PATH when DOCKER_TLS_VERIFY is set")
+	fs.DurationVar(&cfg.DockerTimeout.Duration, "docker-timeout", def.DockerTimeout.Duration, "How long to wait for each docker API call before abandoning it.  0 waits forever")
+	fs.DurationVar(&cfg.ResolveCacheTTL.Duration, "resolve-cache-ttl", def.ResolveCacheTTL.Duration, "How long to cache system DNS lookups for names that aren't containers.  0 disables the cache")
+	fs.IntVar(&cfg.ResolveCacheSize, "resolve-cache-size", def.ResolveCacheSize, "Most names to cache system DNS lookups for.  The least recently used are evicted first.  0 disables the cache")
+	fs.StringVar(&cfg.LogLevel, "log-level", def.LogLevel, "Log level: debug, info, warn or error")
+	fs.IntVar(&cfg.DNSPort, "dns-port", def.DNSPort, "Port for the DNS server to listen on.  0 disables the DNS server")
+	fs.IntVar(&cfg.DNSTTL, "dns-ttl", def.DNSTTL, "TTL in seconds of the DNS server's answers.  A container's org.cj-tools.hosts.ttl label overrides it")
+	fs.BoolVar(&cfg.DNSSearch, "dns-search", def.DNSSearch, "Answer DNS queries for bare names like web with the base domains appended, e.g. web.container")
+	fs.IntVar(&cfg.MaxConnsPerSec, "max-conns-per-sec", def.MaxConnsPerSec, "Most socks5 connections to accept per second.  Connections past it wait their turn.  0 is unlimited")
+	fs.IntVar(&cfg.MaxDomains, "max-domains", def.MaxDomains, "Most names to register.  New names are refused past it until containers stop.  0 is unlimited")
+	fs.BoolVar(&cfg.StrictResolve, "strict-resolve", def.StrictResolve, "Only resolve container names.  Connections to any other host are refused")
+	cfg.AllowCIDR = def.AllowCIDR
+	fs.Var((*listFlag)(&cfg.AllowCIDR), "allow-cidr", "Comma separated list of networks (e.g. 10.0.0.0/8) socks5 connections may go to.  Any address is allowed if empty")
+	cfg.DenyCIDR = def.DenyCIDR
+	fs.Var((*listFlag)(&cfg.DenyCIDR), "deny-cidr", "Comma separated list of networks socks5 connections may not go to.  Takes precedence over -allow-cidr")
+	cfg.UpstreamDNS = def.UpstreamDNS
+	fs.Var((*listFlag)(&cfg.UpstreamDNS), "upstream-dns", "Comma separated list of DNS servers (host:port) for names that aren't containers, tried in order.  Uses the system resolver if empty")
+	fs.DurationVar(&cfg.DialTimeout.Duration, "dial-timeout", def.DialTimeout.Duration, "How long to wait for socks5 connections to their destination.  0 waits as long as the operating system does")
+	fs.DurationVar(&cfg.IdleTimeout.Duration, "idle-timeout", def.IdleTimeout.Duration, "Close socks5 connections with no traffic either way for this long.  0 disables the timeout")
+	fs.DurationVar(&cfg.DrainTimeout.Duration, "drain-timeout", def.DrainTimeout.Duration, "On shutdown, how long open socks5 connections get to finish before they are closed")
+	fs.DurationVar(&cfg.RemovalGrace.Duration, "removal-grace", def.RemovalGrace.Duration, "Keep the names of a stopped container this long, in case it starts again.  0 removes them straight away")
+	fs.BoolVar(&cfg.EnableUDP, "enable-udp", def.EnableUDP, "Relay UDP for socks5 UDP associate requests on the same port.  The relay checks neither credentials nor -allow-cidr/-deny-cidr, so it can't be combined with them, and with -listenip 0.0.0.0 it tells clients to send to 127.0.0.1")
+	fs.StringVar(&cfg.Registry, "registry", def.Registry, "Where to keep the registered names, shared with other instances: redis://host:port/db.  In memory if empty")
+	fs.BoolVar(&cfg.EnableDiscovery, "enable-discovery", def.EnableDiscovery, "Let socks5 clients list the registered names as JSON by connecting to _cjsocks.list on any port")
+	fs.BoolVar(&cfg.RegisterShortNames, "register-short-names", def.RegisterShortNames, "Also register the bare host name of each container, e.g. myservice")
+	fs.BoolVar(&cfg.RegisterReplicaNames, "register-replica-names", def.RegisterReplicaNames, "Also register a numbered name for each replica of a compose service, e.g. web-2.myproject.container")
+	fs.StringVar(&cfg.CollisionPolicy, "collision-policy", def.CollisionPolicy, "Which container keeps a name used by two: first, last or error")
+	fs.StringVar(&cfg.ShortNameCollision, "short-name-collision", def.ShortNameCollision, "Which container keeps a short name used by two: first, last or error")
+	cfg.ProjectFilter = def.ProjectFilter
+	fs.Var((*listFlag)(&cfg.ProjectFilter), "project-filter", "Comma separated list of compose projects whose containers get names.  Every container if empty")
+	fs.StringVar(&cfg.IgnoreNameRegex, "ignore-name-regex", def.IgnoreNameRegex, "Regular expression for container names that never get a DNS name.  Disabled if empty")
+	fs.StringVar(&cfg.LabelSelector, "label-selector", def.LabelSelector, "Only containers whose labels match get names, e.g. org.cj-tools.hosts.env=prod,tier in (web,api).  Every container if empty")
+	fs.BoolVar(&cfg.PrintConfig, "print-config", false, "Print the effective configuration as JSON and exit")
+	fs.BoolVar(&cfg.PrintVersion, "version", false, "Print the version and exit")
+	fs.BoolVar(&cfg.Once, "once", false, "Print the names of the running containers and exit, without starting any servers")
+	return fs, port
+}
+
+// ParseFlags builds the configuration from the command line arguments (without the program name).
+// Flags take precedence over the config file, which takes precedence over environment variables, which take precedence over the defaults.
+func ParseFlags(args []string) (Config, error) {
+	var cfg Config
+	def := envConfig()
+	fs, port := newFlagSet(&cfg, def)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	// The file provides the defaults for the flags, so parse them again on top of it
+	var fileKeys map[string]bool
+	if cfg.ConfigFile != "" {
+		keys, unknown, err := loadConfigFile(cfg.ConfigFile, &def)
+		if err != nil {
+			return cfg, err
+		}
+		def.ConfigFile = cfg.ConfigFile
+		fs, port = newFlagSet(&cfg, def)
+		if err := fs.Parse(args); err != nil {
+			return cfg, err
+		}
+		cfg.UnknownKeys = unknown
+		fileKeys = keys
+	}
+	cfg.explicit = explicitOptions(fs, fileKeys)
+
+	// An explicitly empty flag (e.g. -basedomain="") overrides the environment and falls back to the built in default.
+	if cfg.BaseDomain == "" {
+		cfg.BaseDomain = default_base_domain
+	}
+	if cfg.CJNetworkName == "" {
+		cfg.CJNetworkName = default_cj_network_name
+	}
+	if cfg.ListenIP == "" {
+		cfg.ListenIP = default_ip
+	}
+	// A nil BindIP would quietly listen somewhere else
+	if net.ParseIP(cfg.ListenIP) == nil {
+		return cfg, fmt.Errorf("invalid CJ_LISTEN_IP: %q is not an IP address (-listenip)", cfg.ListenIP)
+	}
+	if *port == "" {
+		*port = strconv.Itoa(default_port)
+	}
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = default_log_level
+	}
+	if cfg.ShortNameCollision == "" {
+		cfg.ShortNameCollision = collision_policy_first
+	}
+	if cfg.CollisionPolicy == "" {
+		cfg.CollisionPolicy = collision_policy_last
+	}
+	for _, policy := range []string{cfg.CollisionPolicy, cfg.ShortNameCollision} {
+		if policy != collision_policy_first && policy != collision_policy_last && policy != collision_policy_error {
+			return cfg, fmt.Errorf("invalid collision policy %q, must be %v, %v or %v", policy, collision_policy_first, collision_policy_last, collision_policy_error)
+		}
+	}
+	if cfg.MaxConnsPerSec < 0 {
+		return cfg, fmt.Errorf("invalid max conns per sec %v, must be 0 or more", cfg.MaxConnsPerSec)
+	}
+	if cfg.MaxDomains < 0 {
+		return cfg, fmt.Errorf("invalid max domains %v, must be 0 or more", cfg.MaxDomains)
+	}
+	// Delays only double while they are below the cap, so 0 would retry every second forever
+	if cfg.BackoffMax.Duration <= 0 {
+		return cfg, fmt.Errorf("invalid backoff max %v, must be positive", cfg.BackoffMax.Duration)
+	}
+	if cfg.DNSTTL <= 0 {
+		return cfg, fmt.Errorf("invalid dns ttl %v, must be a positive number of seconds", cfg.DNSTTL)
+	}
+	if cfg.UnixSocket != "" && cfg.EnableUDP {
+		return cfg, fmt.Errorf("-enable-udp needs the TCP port and can't be used with -unix-socket")
+	}
+	// The UDP relay forwards any datagram sent to the port, so it would get around both
+	if cfg.EnableUDP && (cfg.SocksUser != "" || len(cfg.AllowCIDR) > 0 || len(cfg.DenyCIDR) > 0) {
+		return cfg, fmt.Errorf("-enable-udp can't be used with -socks-user, -allow-cidr or -deny-cidr, the UDP relay checks neither credentials nor destinations")
+	}
+	if _, err := newDestinationFilter(cfg.AllowCIDR, cfg.DenyCIDR); err != nil {
+		return cfg, err
+	}
+	if _, err := regexp.Compile(cfg.IgnoreNameRegex); err != nil {
+		return cfg, fmt.Errorf("invalid ignore name regex: %w", err)
+	}
+	if _, err := parseLabelSelector(cfg.LabelSelector); err != nil {
+		return cfg, err
+	}
+	if cfg.WebhookURL != "" {
+		if err := validateWebhookURL(cfg.WebhookURL); err != nil {
+			return cfg, err
+		}
+	}
+
+	var err error
+	if cfg.Port, err = strconv.Atoi(*port); err != nil {
+		return cfg, fmt.Errorf("invalid port %q", *port)
+	}
+	return cfg, nil
+}
+
+// loadConfigFile overrides the options in cfg with those set in the YAML file at path.
+// It returns the keys of the options the file sets, and the keys in it that don't match an option so they can be
+// reported.
+func loadConfigFile(path string, cfg *Config) (map[string]bool, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read config file: %w", err)
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, nil, fmt.Errorf("could not parse config file %v: %w", path, err)
+	}
+
+	var keys map[string]interface{}
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return nil, nil, fmt.Errorf("could not parse config file %v: %w", path, err)
+	}
+	known := map[string]bool{}
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ","); name != "" && name != "-" {
+			known[name] = true
+		}
+	}
+	set := map[string]bool{}
+	unknown := []string{}
+	for key := range keys {
+		if known[key] {
+			set[key] = true
+		} else {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return set, unknown, nil
+}
+
+// dockerTLS reports whether TLS to the docker daemon was requested
+func (cfg Config) dockerTLS() bool {
+	return cfg.DockerTLSCert != "" || cfg.DockerTLSKey != "" || cfg.DockerTLSCA != ""
+}
+
+// dockerHostAddress returns -host-address, or the host of a tcp docker endpoint, or "" if neither is known
+func (cfg Config) dockerHostAddress() string {
+	if cfg.HostAddress != "" {
+		return cfg.HostAddress
+	}
+	endpoint, err := url.Parse(cfg.DockerHost)
+	if err != nil || endpoint.Scheme != "tcp" {
+		return ""
+	}
+	return endpoint.Hostname()
+}
+
+// listenNetwork returns the network the socks5 server listens on: "unix" with -unix-socket, otherwise "tcp"
+func (cfg Config) listenNetwork() string {
+	if cfg.UnixSocket != "" {
+		return "unix"
+	}
+	return listen_protocol
+}
+
+// listenAddr returns the ip:port, or the unix socket path, the socks5 server listens on
+func (cfg Config) listenAddr() string {
+	if cfg.UnixSocket != "" {
+		return cfg.UnixSocket
+	}
+	return net.JoinHostPort(cfg.ListenIP, strconv.Itoa(cfg.Port))
+}
+
+// PrintConfig writes cfg to w as indented JSON.  The socks password is never included.
+func PrintConfig(w io.Writer, cfg Config) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(cfg)
+}
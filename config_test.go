@@ -0,0 +1,197 @@
+package cjsocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenIP(t *testing.T) {
+	_, err := ParseFlags([]string{"-listenip", "not.an.ip"})
+	if err == nil || !strings.Contains(err.Error(), `invalid CJ_LISTEN_IP: "not.an.ip" is not an IP address`) {
+		t.Errorf("ParseFlags(-listenip not.an.ip) = %v, want the invalid address reported", err)
+	}
+
+	// Empty falls back to the default
+	cfg, err := ParseFlags([]string{"-listenip", ""})
+	if err != nil || cfg.ListenIP != default_ip {
+		t.Errorf("ParseFlags(-listenip \"\") = %q, %v, want %v", cfg.ListenIP, err, default_ip)
+	}
+}
+
+func TestEnableUDPConflicts(t *testing.T) {
+	if _, err := ParseFlags([]string{"-enable-udp"}); err != nil {
+		t.Errorf("ParseFlags(-enable-udp) = %v, want no error", err)
+	}
+	for _, args := range [][]string{
+		{"-enable-udp", "-socks-user", "user", "-socks-pass", "pass"},
+		{"-enable-udp", "-allow-cidr", "10.0.0.0/8"},
+		{"-enable-udp", "-deny-cidr", "10.0.0.0/8"},
+		{"-enable-udp", "-unix-socket", "/tmp/cjsocks.sock"},
+	} {
+		if _, err := ParseFlags(args); err == nil {
+			t.Errorf("ParseFlags(%v) = nil error, want the UDP relay refused", args)
+		}
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "cjsocks.yaml")
+	sample := `listen_ip: 127.0.0.2
+port: 2080
+base_domain: file
+cj_network: file-network
+auto_add: true
+host_alias: file.internal
+network_priority: [front, back]
+`
+	if err := os.WriteFile(configFile, []byte(sample), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	env := map[string]string{
+		"CJ_LISTEN_IP":        "127.0.0.3",
+		"CJ_SOCKS_PORT":       "3080",
+		"CJ_BASE_DOMAIN":      "env",
+		"CJ_NETWORK":          "env-network",
+		"CJ_AUTO_ADD":         "false",
+		"CJ_HOST_ALIAS":       "env.internal",
+		"CJ_NETWORK_PRIORITY": "env1,env2",
+	}
+
+	type options struct {
+		listenIP        string
+		port            int
+		baseDomain      string
+		cjNetwork       string
+		autoAdd         bool
+		hostAlias       string
+		networkPriority string
+	}
+	fileOptions := options{"127.0.0.2", 2080, "file", "file-network", true, "file.internal", "[front back]"}
+	tests := []struct {
+		name string
+		args []string
+		env  bool
+		want options
+	}{
+		{
+			name: "defaults",
+			want: options{default_ip, default_port, default_base_domain, default_cj_network_name, default_auto_add_to_cjnetwork, default_host_alias, "[]"},
+		},
+		{
+			name: "environment over defaults",
+			env:  true,
+			want: options{"127.0.0.3", 3080, "env", "env-network", false, "env.internal", "[env1 env2]"},
+		},
+		{
+			name: "file over defaults",
+			args: []string{"-config", configFile},
+			want: fileOptions,
+		},
+		{
+			name: "file over environment",
+			args: []string{"-config", configFile},
+			env:  true,
+			want: fileOptions,
+		},
+		{
+			name: "flags over file",
+			args: []string{"-config", configFile, "-listenip", "127.0.0.4", "-port", "4080", "-basedomain", "flag", "-cj-network", "flag-network",
+				"-autoadd=false", "-host-alias", "flag.internal", "-network-priority", "flag1"},
+			env:  true,
+			want: options{"127.0.0.4", 4080, "flag", "flag-network", false, "flag.internal", "[flag1]"},
+		},
+		{
+			name: "explicitly empty flags over environment",
+			args: []string{"-basedomain=", "-cj-network", "", "-host-alias="},
+			env:  true,
+			want: options{"127.0.0.3", 3080, default_base_domain, default_cj_network_name, false, "", "[env1 env2]"},
+		},
+		{
+			name: "flags before the config flag",
+			args: []string{"-basedomain", "flag", "-config", configFile},
+			want: options{"127.0.0.2", 2080, "flag", "file-network", true, "file.internal", "[front back]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range env {
+				if !tt.env {
+					value = ""
+				}
+				t.Setenv(key, value)
+			}
+			cfg, err := ParseFlags(tt.args)
+			if err != nil {
+				t.Fatalf("ParseFlags: %v", err)
+			}
+			got := options{cfg.ListenIP, cfg.Port, cfg.BaseDomain, cfg.CJNetworkName, cfg.AutoAdd, cfg.HostAlias, fmt.Sprint(cfg.NetworkPriority)}
+			if got != tt.want {
+				t.Errorf("options = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigFileUnknownKeys(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "cjsocks.yaml")
+	if err := os.WriteFile(configFile, []byte("base_domain: file\nsocks-port: 1080\nbogus: {nested: true}\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	cfg, err := ParseFlags([]string{"-config", configFile})
+	if err != nil {
+		t.Fatalf("ParseFlags = %v, want unknown keys to be reported rather than fatal", err)
+	}
+	assertEqual(t, "UnknownKeys", cfg.UnknownKeys, []string{"bogus", "socks-port"})
+	if cfg.BaseDomain != "file" {
+		t.Errorf("BaseDomain = %q, want the known keys still applied", cfg.BaseDomain)
+	}
+
+	if err := os.WriteFile(configFile, []byte("base_domain: [unclosed\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := ParseFlags([]string{"-config", configFile}); err == nil {
+		t.Error("ParseFlags with a malformed config file = nil error")
+	}
+	if _, err := ParseFlags([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}); err == nil {
+		t.Error("ParseFlags with a missing config file = nil error")
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	t.Setenv("CJ_LOG_LEVEL", "warn")
+	t.Setenv("CJ_SOCKS_PASS", "secret")
+	cfg, err := ParseFlags([]string{"-listenip", "127.0.0.2", "-port", "2080", "-basedomain", "test", "-cj-network", "printed",
+		"-autoadd", "-docker-host", "tcp://docker.internal:2376"})
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	var out bytes.Buffer
+	if err := PrintConfig(&out, cfg); err != nil {
+		t.Fatalf("PrintConfig: %v", err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("PrintConfig wrote invalid JSON %q: %v", out.String(), err)
+	}
+	for key, want := range map[string]interface{}{
+		"listen_ip":   "127.0.0.2",
+		"port":        2080.0,
+		"base_domain": "test",
+		"cj_network":  "printed",
+		"auto_add":    true,
+		"docker_host": "tcp://docker.internal:2376",
+		"log_level":   "warn",
+	} {
+		if got[key] != want {
+			t.Errorf("%v = %v, want %v", key, got[key], want)
+		}
+	}
+	if strings.Contains(out.String(), "secret") {
+		t.Errorf("PrintConfig wrote the socks password: %v", out.String())
+	}
+}
@@ -0,0 +1,99 @@
+package cjsocks
+
+// Allow and deny lists of destination addresses (-allow-cidr and -deny-cidr)
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/haxii/socks5"
+)
+
+// destinationFilter decides which addresses the socks5 server may connect to.  Denied networks take precedence.
+// When there are allowed networks, addresses outside them are denied too.
+type destinationFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newDestinationFilter parses CIDRs such as 10.0.0.0/8.  A bare IP address matches only itself.
+// Returns nil when both lists are empty.
+func newDestinationFilter(allow []string, deny []string) (*destinationFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	f := &destinationFilter{}
+	var err error
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, fmt.Errorf("invalid allow CIDR: %w", err)
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, fmt.Errorf("invalid deny CIDR: %w", err)
+	}
+	return f, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// check returns an error if ip may not be connected to.  A nil filter allows everything.
+func (f *destinationFilter) check(ip net.IP) error {
+	if f == nil {
+		return nil
+	}
+	for _, network := range f.deny {
+		if network.Contains(ip) {
+			return fmt.Errorf("destination %v is denied by %v", ip, network)
+		}
+	}
+	if len(f.allow) == 0 {
+		return nil
+	}
+	for _, network := range f.allow {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("destination %v is not in an allowed network", ip)
+}
+
+// destinationRules refuses requests for addresses the filter denies.  Resolve already refuses names that
+// resolve to them, but clients may send an IP address, which is never resolved.
+type destinationRules struct {
+	filter *destinationFilter
+	rules  socks5.RuleSet
+}
+
+func (r destinationRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	// The discovery pseudo-host is answered by cjsocks itself
+	if req.DestAddr != nil && isDiscoveryName(req.DestAddr.FQDN) && req.DestAddr.IP.Equal(discovery_ip) {
+		return r.rules.Allow(ctx, req)
+	}
+	if req.DestAddr != nil && req.DestAddr.IP != nil && r.filter.check(req.DestAddr.IP) != nil {
+		return ctx, false
+	}
+	return r.rules.Allow(ctx, req)
+}
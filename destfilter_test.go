@@ -0,0 +1,104 @@
+package cjsocks
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/haxii/socks5"
+)
+
+func TestDestinationFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		allowed []string
+		denied  []string
+	}{
+		{
+			name:    "no lists",
+			allowed: []string{"10.1.2.3", "8.8.8.8", "::1"},
+		},
+		{
+			name:    "allow only",
+			allow:   []string{"10.0.0.0/8", "fd00::/8"},
+			allowed: []string{"10.1.2.3", "fd00::1"},
+			denied:  []string{"192.168.1.1", "8.8.8.8", "2001:db8::1"},
+		},
+		{
+			name:    "deny only",
+			deny:    []string{"169.254.0.0/16"},
+			allowed: []string{"10.1.2.3", "8.8.8.8"},
+			denied:  []string{"169.254.169.254"},
+		},
+		{
+			name:    "deny takes precedence over an overlapping allow",
+			allow:   []string{"10.0.0.0/8"},
+			deny:    []string{"10.1.0.0/16"},
+			allowed: []string{"10.2.3.4"},
+			denied:  []string{"10.1.2.3", "192.168.1.1"},
+		},
+		{
+			name:    "bare IP matches only itself",
+			deny:    []string{"10.1.2.3", "2001:db8::1"},
+			allowed: []string{"10.1.2.4", "2001:db8::2"},
+			denied:  []string{"10.1.2.3", "2001:db8::1"},
+		},
+		{
+			name:    "bare IPv4 matches its IPv6 mapped form",
+			deny:    []string{"10.1.2.3"},
+			denied:  []string{"::ffff:10.1.2.3"},
+			allowed: []string{"::ffff:10.1.2.4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newDestinationFilter(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatalf("newDestinationFilter: %v", err)
+			}
+			rules := destinationRules{filter: f, rules: &socks5.PermitCommand{EnableConnect: true}}
+			for _, addr := range tt.allowed {
+				ip := net.ParseIP(addr)
+				if err := f.check(ip); err != nil {
+					t.Errorf("check(%v) = %v, want allowed", addr, err)
+				}
+				req := &socks5.Request{Command: socks5.CommandConnect, DestAddr: &socks5.AddrSpec{IP: ip, Port: 80}}
+				if _, ok := rules.Allow(context.Background(), req); !ok {
+					t.Errorf("Allow(%v) = false, want allowed", addr)
+				}
+			}
+			for _, addr := range tt.denied {
+				ip := net.ParseIP(addr)
+				if err := f.check(ip); err == nil {
+					t.Errorf("check(%v) = nil, want denied", addr)
+				}
+				req := &socks5.Request{Command: socks5.CommandConnect, DestAddr: &socks5.AddrSpec{IP: ip, Port: 80}}
+				if _, ok := rules.Allow(context.Background(), req); ok {
+					t.Errorf("Allow(%v) = true, want denied", addr)
+				}
+			}
+		})
+	}
+}
+
+func TestDestinationFilterInvalid(t *testing.T) {
+	tests := []struct {
+		allow []string
+		deny  []string
+	}{
+		{allow: []string{"10.0.0.0/33"}},
+		{allow: []string{"not-an-ip"}},
+		{deny: []string{"10.0.0/8"}},
+		{deny: []string{"10.0.0.0/8", "example.com"}},
+	}
+	for _, tt := range tests {
+		if _, err := newDestinationFilter(tt.allow, tt.deny); err == nil {
+			t.Errorf("newDestinationFilter(%v, %v) = nil error, want invalid", tt.allow, tt.deny)
+		}
+	}
+	if _, err := ParseFlags([]string{"-deny-cidr", "not-an-ip"}); err == nil {
+		t.Error("ParseFlags(-deny-cidr not-an-ip) = nil error, want invalid")
+	}
+}
@@ -0,0 +1,48 @@
+package cjsocks
+
+// Timeouts for the connections the socks5 server makes to its targets
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// newDial returns a dial function for the socks5 server.  Dials give up after dialTimeout.  With an idleTimeout,
+// a connection with no traffic either way for that long is closed.  0 disables either timeout.
+func newDial(dialTimeout time.Duration, idleTimeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		d := net.Dialer{Timeout: dialTimeout}
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil || idleTimeout <= 0 {
+			return conn, err
+		}
+		return &idleConn{Conn: conn, timeout: idleTimeout}, nil
+	}
+}
+
+// idleConn pushes its deadline back on every read and write.  The socks5 server copies both ways through the
+// target connection, so traffic in either direction keeps it open, and the copy from the target fails once
+// neither side has sent anything for timeout.  That failure closes both connections.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// CloseWrite half closes the connection like *net.TCPConn, which the socks5 server does when the client is done sending
+func (c *idleConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package cjsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// unresponsiveServer returns the address of a loopback listener that never accepts and whose backlog is full,
+// so further connection attempts get no answer
+func unresponsiveServer(t *testing.T) string {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("Socket: %v", err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatalf("Getsockname: %v", err)
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(sa.(*syscall.SockaddrInet4).Port))
+	for i := 0; ; i++ {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			return addr
+		}
+		t.Cleanup(func() { conn.Close() })
+		if i == 10 {
+			t.Skip("the listen backlog never filled up")
+		}
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	addr := unresponsiveServer(t)
+	dial := newDial(200*time.Millisecond, 0)
+	start := time.Now()
+	_, err := dial(context.Background(), "tcp", addr)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("dial = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("dial gave up after %v, want about 200ms", elapsed)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	dial := newDial(time.Second, 200*time.Millisecond)
+	conn, err := dial(context.Background(), "tcp", echoServer(t).Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Traffic keeps it open for longer than the timeout
+	for i := 0; i < 4; i++ {
+		echo(t, conn, "ping")
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read from an idle connection = %v, want the deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("idle connection closed after %v, want about 200ms", elapsed)
+	}
+}
@@ -0,0 +1,75 @@
+package cjsocks
+
+// Discovery lets clients that can only reach cjsocks through the socks5 proxy list the registered names.
+// They connect to discovery_name on any port and read the names and IPs as JSON.
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// discovery_name is the pseudo-host that lists the registered names when -enable-discovery is set
+const discovery_name string = "_cjsocks.list"
+
+// discovery_write_timeout bounds how long a slow client can hold a discovery connection
+const discovery_write_timeout = 5 * time.Second
+
+// discovery_ip is what Resolve returns for discovery_name.  It is the IPv4 dummy address (RFC 7600), which
+// never belongs to a real destination, and connections to it go to the discovery responder instead.
+var discovery_ip = net.IPv4(192, 0, 0, 8).To4()
+
+// isDiscoveryName reports whether name is the discovery pseudo-host, in any case and with or without the root's
+// trailing dot
+func isDiscoveryName(name string) bool {
+	return strings.EqualFold(strings.TrimSuffix(name, "."), discovery_name)
+}
+
+// listenDiscovery starts the discovery responder on a loopback port and returns its address.
+// Each connection gets the FQDN to IP map as JSON and is then closed.  It stops when ctx is cancelled.
+func (app *App) listenDiscovery(ctx context.Context) (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go app.writeDiscovery(conn)
+		}
+	}()
+	slog.Info("Serving the registered names through the socks5 proxy", "name", discovery_name)
+	return listener.Addr().String(), nil
+}
+
+// writeDiscovery writes the FQDN to IP map to conn and closes it
+func (app *App) writeDiscovery(conn net.Conn) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(discovery_write_timeout))
+	encoder := json.NewEncoder(conn)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(app.Domains()); err != nil {
+		slog.Debug("Could not write the discovery list", "error", err)
+	}
+}
+
+// discoveryDial sends connections to discovery_ip to the discovery responder at addr, and the rest to dial
+func discoveryDial(addr string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, target string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(target); err == nil && net.ParseIP(host).Equal(discovery_ip) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", addr)
+		}
+		return dial(ctx, network, target)
+	}
+}
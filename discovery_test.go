@@ -0,0 +1,55 @@
+package cjsocks
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/haxii/socks5"
+)
+
+func TestDiscovery(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.EnableDiscovery = true
+	cfg.DenyCIDR = []string{"192.0.0.0/24"} // Covers discovery_ip
+	app := newTestApp(t, cfg)
+	app.registerContainer("web1", containerMeta{}, []string{"web.container"}, "172.17.0.2")
+
+	for _, name := range []string{discovery_name, "_CJSOCKS.List", discovery_name + "."} {
+		_, ip, err := app.Resolve(context.Background(), name)
+		if err != nil || !ip.Equal(discovery_ip) {
+			t.Errorf("Resolve(%q) = %v, %v, want %v", name, ip, err, discovery_ip)
+		}
+		// Clients send the name as they were given it
+		req := &socks5.Request{Command: socks5.CommandConnect, DestAddr: &socks5.AddrSpec{FQDN: name, IP: ip, Port: 1}}
+		rules := destinationRules{filter: app.destinations, rules: &socks5.PermitCommand{EnableConnect: true}}
+		if _, ok := rules.Allow(context.Background(), req); !ok {
+			t.Errorf("Allow(%q) = false, want the discovery pseudo-host allowed", name)
+		}
+	}
+
+	// Anything else at the address is still denied
+	req := &socks5.Request{Command: socks5.CommandConnect, DestAddr: &socks5.AddrSpec{FQDN: "other.example", IP: discovery_ip, Port: 1}}
+	rules := destinationRules{filter: app.destinations, rules: &socks5.PermitCommand{EnableConnect: true}}
+	if _, ok := rules.Allow(context.Background(), req); ok {
+		t.Errorf("Allow(other.example at %v) = true, want denied", discovery_ip)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr, err := app.listenDiscovery(ctx)
+	if err != nil {
+		t.Fatalf("listenDiscovery: %v", err)
+	}
+	conn, err := discoveryDial(addr, nil)(ctx, "tcp", net.JoinHostPort(discovery_ip.String(), "1"))
+	if err != nil {
+		t.Fatalf("dial discovery: %v", err)
+	}
+	defer conn.Close()
+	var domains map[string]string
+	if err := json.NewDecoder(conn).Decode(&domains); err != nil {
+		t.Fatalf("decode discovery list: %v", err)
+	}
+	assertEqual(t, "discovery list", domains, map[string]string{"web.container": "172.17.0.2"})
+}
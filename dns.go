@@ -0,0 +1,191 @@
+package cjsocks
+
+// Embedded DNS server.  Serves A/AAAA records for registered containers so hosts that can't use the
+// socks5 resolver (e.g. Linux desktops) can point resolv.conf or a stub resolver at cjsocks.
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// serveDNS starts UDP and TCP DNS servers on ip:port.  It blocks until one of them fails or ctx is cancelled.
+func (app *App) serveDNS(ctx context.Context, ip string, port int) error {
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", app.handleDNSQuery)
+
+	errs := make(chan error, 2)
+	servers := []*dns.Server{
+		{Addr: addr, Net: "udp", Handler: mux},
+		{Addr: addr, Net: "tcp", Handler: mux},
+	}
+	for _, server := range servers {
+		go func(server *dns.Server) {
+			errs <- server.ListenAndServe()
+		}(server)
+	}
+	slog.Info("Starting DNS server", "addr", addr)
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		for _, server := range servers {
+			server.Shutdown()
+		}
+		return nil
+	}
+}
+
+// handleDNSQuery answers A and AAAA queries for registered names, and PTR queries for container addresses with their
+// canonical name.  With -dns-search bare names are looked up under each base domain too.  Unknown names get
+// NXDOMAIN.  Queries are never recursed.
+func (app *App) handleDNSQuery(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.RecursionAvailable = false
+
+	for _, q := range r.Question {
+		name := strings.TrimSuffix(strings.ToLower(q.Name), ".")
+
+		if ip := reverseIP(name); ip != nil && (q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY) {
+			app.RLock()
+			fqdn, ttl := app.lookupAddr(ip)
+			app.RUnlock()
+			if fqdn == "" {
+				m.Rcode = dns.RcodeNameError
+				continue
+			}
+			m.Answer = append(m.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+				Ptr: dns.Fqdn(fqdn),
+			})
+			continue
+		}
+
+		if app.dnsSearch && isShortName(name) {
+			name = app.searchName(name)
+		}
+
+		app.RLock()
+		v4, v6, ttl, upstream := app.lookupFamilies(name)
+		registered := app.matchName(name) != ""
+		app.RUnlock()
+
+		// A stand in for an external endpoint answers with the external host's address
+		if upstream != "" {
+			v4, v6 = nil, nil
+			if addr, err := app.upstreamAddress(context.Background(), upstream); err != nil {
+				slog.Debug("Could not resolve upstream", "fqdn", name, "upstream", upstream, "error", err)
+			} else if addr.To4() != nil {
+				v4 = addr
+			} else {
+				v6 = addr
+			}
+		}
+
+		// Names registered by other instances sharing the registry
+		if v4 == nil && v6 == nil && !registered {
+			if addr := app.lookupRegistry(name); addr.To4() != nil {
+				v4, ttl = addr, app.dnsTTL
+			} else if addr != nil {
+				v6, ttl = addr, app.dnsTTL
+			}
+		}
+
+		// A paused container's name exists but has no address to give out for now
+		if v4 == nil && v6 == nil && registered {
+			m.Rcode = dns.RcodeServerFailure
+			continue
+		}
+		if v4 == nil && v6 == nil {
+			m.Rcode = dns.RcodeNameError
+			continue
+		}
+
+		// Dual stack containers answer both.  A known name queried for another record type gets an empty NOERROR answer.
+		if v4 != nil && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY) {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   v4,
+			})
+		}
+		if v6 != nil && (q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY) {
+			m.Answer = append(m.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+				AAAA: v6,
+			})
+		}
+	}
+
+	if err := w.WriteMsg(m); err != nil {
+		slog.Warn("Could not write DNS response", "error", err)
+	}
+}
+
+// reverseIP returns the address a reverse lookup name stands for, e.g. 5.0.20.172.in-addr.arpa is 172.20.0.5.
+// Returns nil if name isn't a complete in-addr.arpa or ip6.arpa name.
+func reverseIP(name string) net.IP {
+	if labels, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		octets := strings.Split(labels, ".")
+		if len(octets) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(octets)-1; i < j; i, j = i+1, j-1 {
+			octets[i], octets[j] = octets[j], octets[i]
+		}
+		return net.ParseIP(strings.Join(octets, ".")).To4()
+	}
+	if labels, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		nibbles := strings.Split(labels, ".")
+		if len(nibbles) != 2*net.IPv6len {
+			return nil
+		}
+		var hex strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return nil
+			}
+			hex.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				hex.WriteString(":")
+			}
+		}
+		return net.ParseIP(hex.String())
+	}
+	return nil
+}
+
+// searchName returns the name a bare name is answered for, like a search domain: the name itself when it is
+// registered, e.g. with -register-short-names, or else the first of name.<base domain> registered here or in the
+// registry.  Returns name when none is.
+func (app *App) searchName(name string) string {
+	candidates := make([]string, 0, len(app.baseDomains))
+	for _, baseDomain := range app.baseDomains {
+		candidates = append(candidates, name+"."+baseDomain)
+	}
+	app.RLock()
+	if app.matchName(name) != "" {
+		app.RUnlock()
+		return name
+	}
+	for _, candidate := range candidates {
+		if app.matchName(candidate) != "" {
+			app.RUnlock()
+			return candidate
+		}
+	}
+	app.RUnlock()
+	for _, candidate := range candidates {
+		if app.lookupRegistry(candidate) != nil {
+			return candidate
+		}
+	}
+	return name
+}
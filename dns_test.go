@@ -0,0 +1,251 @@
+package cjsocks
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// freeUDPPort returns a loopback UDP port nothing listens on
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// startDNS serves app's names on a loopback port until the test ends and returns its address
+func startDNS(t *testing.T, app *App) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	port := freeUDPPort(t)
+	go app.serveDNS(ctx, "127.0.0.1", port)
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+// queryDNS asks the server at addr for name, retrying while the server starts
+func queryDNS(t *testing.T, addr string, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	client := &dns.Client{Net: "udp", Timeout: time.Second}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reply, _, err := client.Exchange(m, addr)
+		if err == nil {
+			return reply
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("query %v: %v", name, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestServeDNS(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+	app.registerContainer("web1", containerMeta{}, []string{"web.container"}, "172.17.0.2")
+	addr := startDNS(t, app)
+
+	reply := queryDNS(t, addr, "web.container", dns.TypeA)
+	if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 {
+		t.Fatalf("web.container answer = %v", reply)
+	}
+	a, ok := reply.Answer[0].(*dns.A)
+	if !ok || !a.A.Equal(net.ParseIP("172.17.0.2")) {
+		t.Errorf("web.container answer = %v, want an A record for 172.17.0.2", reply.Answer[0])
+	}
+
+	if reply := queryDNS(t, addr, "missing.container", dns.TypeA); reply.Rcode != dns.RcodeNameError {
+		t.Errorf("missing.container rcode = %v, want NXDOMAIN", dns.RcodeToString[reply.Rcode])
+	}
+}
+
+func TestServeDNSReverse(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", map[string]string{
+		label_cj_aliases: "www",
+	}))
+	f.addContainer(fakeContainer("api1", "api", "172.17.0.3", map[string]string{
+		label_cj_aliases:   "www-api",
+		label_cj_canonical: "WWW-API.container.",
+	}))
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	app.handleEvent(f, fakeEvent("start", "api1"))
+	addr := startDNS(t, app)
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"172.17.0.2", "web.container."},     // The first name without the label
+		{"172.17.0.3", "www-api.container."}, // The label wins over the container name
+	}
+	for _, tt := range tests {
+		reverse, err := dns.ReverseAddr(tt.ip)
+		if err != nil {
+			t.Fatalf("ReverseAddr(%v): %v", tt.ip, err)
+		}
+		reply := queryDNS(t, addr, reverse, dns.TypePTR)
+		if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 {
+			t.Errorf("%v answer = %v, want one PTR record", reverse, reply)
+			continue
+		}
+		if ptr, ok := reply.Answer[0].(*dns.PTR); !ok || ptr.Ptr != tt.want {
+			t.Errorf("%v answer = %v, want a PTR record for %v", reverse, reply.Answer[0], tt.want)
+		}
+	}
+
+	reverse, _ := dns.ReverseAddr("172.17.0.99")
+	if reply := queryDNS(t, addr, reverse, dns.TypePTR); reply.Rcode != dns.RcodeNameError {
+		t.Errorf("%v rcode = %v, want NXDOMAIN", reverse, dns.RcodeToString[reply.Rcode])
+	}
+}
+
+func TestCanonicalFirst(t *testing.T) {
+	tests := []struct {
+		name      string
+		canonical string
+		domains   []string
+		want      []string
+	}{
+		{"no label", "", []string{"web.container", "www.container"}, []string{"web.container", "www.container"}},
+		{"no label skips wildcards", "", []string{"*.web.container", "web.container"}, []string{"web.container", "*.web.container"}},
+		{"label", "www.container", []string{"web.container", "api.container", "www.container"}, []string{"www.container", "web.container", "api.container"}},
+		{"label ignores case", "www.container", []string{"web.container", "WWW.container"}, []string{"WWW.container", "web.container"}},
+		{"label names no domain", "other.container", []string{"web.container", "www.container"}, []string{"web.container", "www.container"}},
+		{"only wildcards", "", []string{"*.web.container"}, []string{"*.web.container"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := canonicalFirst("web1", tt.canonical, tt.domains)
+			assertEqual(t, "canonicalFirst", got, tt.want)
+		})
+	}
+}
+
+func TestServeDNSTTL(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.DNSTTL = 42
+	app := newTestApp(t, cfg)
+	f := newFakeDocker()
+	tests := []struct {
+		name  string
+		label string // The ttl label, "" for none
+		want  uint32
+	}{
+		{"db", "3600", 3600},
+		{"worker", " 5 ", 5},
+		{"default", "", 42},
+		{"garbage", "soon", 42},
+		{"zero", "0", 42},
+		{"negative", "-10", 42},
+	}
+	for i, tt := range tests {
+		labels := map[string]string{}
+		if tt.label != "" {
+			labels[label_cj_ttl] = tt.label
+		}
+		ID := tt.name + "1"
+		f.addContainer(fakeContainer(ID, tt.name, "172.17.0."+strconv.Itoa(i+2), labels))
+		app.handleEvent(f, fakeEvent("start", ID))
+	}
+	addr := startDNS(t, app)
+
+	for _, tt := range tests {
+		name := tt.name + ".container"
+		reply := queryDNS(t, addr, name, dns.TypeA)
+		if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 {
+			t.Errorf("%v answer = %v, want one A record", name, reply)
+			continue
+		}
+		if got := reply.Answer[0].Header().Ttl; got != tt.want {
+			t.Errorf("%v TTL = %v, want %v", name, got, tt.want)
+		}
+	}
+}
+
+func TestServeDNSDualStack(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+	f := newFakeDocker()
+	f.addContainer(fakeDualStackContainer("dual1", "dual", "172.17.0.2", "fd00::2"))
+	f.addContainer(fakeDualStackContainer("v41", "v4", "172.17.0.3", ""))
+	f.addContainer(fakeDualStackContainer("v61", "v6", "", "fd00::4"))
+	for _, ID := range []string{"dual1", "v41", "v61"} {
+		app.handleEvent(f, fakeEvent("start", ID))
+	}
+	addr := startDNS(t, app)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  string // The address answered, "" for an empty NOERROR answer
+	}{
+		{"dual.container", dns.TypeA, "172.17.0.2"},
+		{"dual.container", dns.TypeAAAA, "fd00::2"},
+		{"v4.container", dns.TypeA, "172.17.0.3"},
+		{"v4.container", dns.TypeAAAA, ""},
+		{"v6.container", dns.TypeA, ""},
+		{"v6.container", dns.TypeAAAA, "fd00::4"},
+	}
+	for _, tt := range tests {
+		reply := queryDNS(t, addr, tt.name, tt.qtype)
+		what := tt.name + " " + dns.TypeToString[tt.qtype]
+		if reply.Rcode != dns.RcodeSuccess {
+			t.Errorf("%v rcode = %v, want NOERROR", what, dns.RcodeToString[reply.Rcode])
+			continue
+		}
+		got := ""
+		for _, rr := range reply.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				got += rr.A.String()
+			case *dns.AAAA:
+				got += rr.AAAA.String()
+			}
+			if rr.Header().Rrtype != tt.qtype {
+				t.Errorf("%v answered with a %v record", what, dns.TypeToString[rr.Header().Rrtype])
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%v answer = %q, want %q", what, got, tt.want)
+		}
+	}
+}
+
+func TestServeDNSSearch(t *testing.T) {
+	for _, search := range []bool{true, false} {
+		cfg := testConfig(t)
+		cfg.DNSSearch = search
+		app := newTestApp(t, cfg)
+		app.registerContainer("web1", containerMeta{}, []string{"web.container"}, "172.17.0.2")
+		addr := startDNS(t, app)
+
+		reply := queryDNS(t, addr, "web", dns.TypeA)
+		if !search {
+			if reply.Rcode != dns.RcodeNameError {
+				t.Errorf("web rcode = %v without -dns-search, want NXDOMAIN", dns.RcodeToString[reply.Rcode])
+			}
+			continue
+		}
+		if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 {
+			t.Fatalf("web answer = %v, want one A record", reply)
+		}
+		a, ok := reply.Answer[0].(*dns.A)
+		if !ok || !a.A.Equal(net.ParseIP("172.17.0.2")) || a.Hdr.Name != "web." {
+			t.Errorf("web answer = %v, want an A record for web. of 172.17.0.2", reply.Answer[0])
+		}
+		if reply := queryDNS(t, addr, "missing", dns.TypeA); reply.Rcode != dns.RcodeNameError {
+			t.Errorf("missing rcode = %v, want NXDOMAIN", dns.RcodeToString[reply.Rcode])
+		}
+	}
+}
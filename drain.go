@@ -0,0 +1,102 @@
+package cjsocks
+
+// Connection draining on shutdown.  The socks5 server stops accepting connections when the listener closes, but
+// the connections it already proxies would be cut when the process exits.  They get -drain-timeout to finish.
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const default_drain_timeout = 10 * time.Second
+
+// connTracker keeps the socks5 connections that are still open
+type connTracker struct {
+	sync.Mutex
+	active sync.WaitGroup
+	conns  map[*trackedConn]struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[*trackedConn]struct{})}
+}
+
+// trackingListener adds each connection it accepts to tracker
+type trackingListener struct {
+	net.Listener
+	tracker *connTracker
+}
+
+func (l trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	tracked := &trackedConn{Conn: conn, tracker: l.tracker}
+	l.tracker.Lock()
+	l.tracker.conns[tracked] = struct{}{}
+	l.tracker.active.Add(1)
+	l.tracker.Unlock()
+	return tracked, nil
+}
+
+// trackedConn leaves its tracker when it is closed, which the socks5 server does once the proxying is done
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.tracker.Lock()
+		delete(c.tracker.conns, c)
+		c.tracker.Unlock()
+		c.tracker.active.Done()
+	})
+	return c.Conn.Close()
+}
+
+// CloseWrite half closes the connection like *net.TCPConn, which the socks5 server does when the destination is done sending
+func (c *trackedConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
+
+// drain waits up to timeout for the open connections to finish, then closes the rest
+func (t *connTracker) drain(timeout time.Duration) {
+	t.Lock()
+	open := len(t.conns)
+	t.Unlock()
+	if open == 0 {
+		return
+	}
+	slog.Info("Waiting for socks5 connections to finish", "connections", open, "timeout", timeout)
+
+	done := make(chan struct{})
+	go func() {
+		t.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("Socks5 connections finished")
+		return
+	case <-time.After(timeout):
+	}
+
+	t.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.Unlock()
+	slog.Warn("Closing socks5 connections that didn't finish in time", "connections", len(conns), "timeout", timeout)
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,70 @@
+package cjsocks
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDrainLetsConnectionsFinish(t *testing.T) {
+	// Answers a little after the server started shutting down
+	replied := make(chan struct{})
+	slow := testServer(t, func(conn net.Conn) {
+		buf := make([]byte, 4)
+		io.ReadFull(conn, buf)
+		time.Sleep(200 * time.Millisecond)
+		conn.Write(buf)
+		close(replied)
+	})
+	cfg := socksTestConfig(t)
+	cfg.DrainTimeout = Duration{5 * time.Second}
+	stop := startApp(t, newTestApp(t, cfg))
+
+	conn := dialSocks(t, cfg, slow.Addr().String())
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	stopped := make(chan error, 1)
+	go func() { stopped <- stop() }()
+
+	reply := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Read during shutdown: %v", err)
+	}
+	if string(reply) != "ping" {
+		t.Errorf("reply = %q, want %q", reply, "ping")
+	}
+	select {
+	case err := <-stopped:
+		t.Fatalf("Run returned (%v) before the connection was closed", err)
+	default:
+	}
+	conn.Close()
+	if err := <-stopped; err != nil {
+		t.Errorf("Run = %v, want nil", err)
+	}
+}
+
+func TestDrainClosesConnectionsAfterTimeout(t *testing.T) {
+	// Never answers
+	quiet := testServer(t, func(conn net.Conn) { io.Copy(io.Discard, conn) })
+	cfg := socksTestConfig(t)
+	cfg.DrainTimeout = Duration{100 * time.Millisecond}
+	stop := startApp(t, newTestApp(t, cfg))
+
+	conn := dialSocks(t, cfg, quiet.Addr().String())
+	defer conn.Close()
+	started := time.Now()
+	if err := stop(); err != nil {
+		t.Errorf("Run = %v, want nil", err)
+	}
+	if elapsed := time.Since(started); elapsed > 3*time.Second {
+		t.Errorf("shutdown took %v with a 100ms drain timeout", elapsed)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read after shutdown = %v, want EOF", err)
+	}
+}
@@ -0,0 +1,42 @@
+package cjsocks
+
+// Machine readable container lifecycle events for -events-json.  One JSON object per line, separate from the logs.
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type eventLog struct {
+	sync.Mutex // Keeps lines from interleaving
+	w          io.Writer
+}
+
+// containerEvent is one line of the event log
+type containerEvent struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Action      string    `json:"action"` // start, stop, rename or update
+	ContainerID string    `json:"container_id"`
+	FQDNs       []string  `json:"fqdns"`
+	IP          string    `json:"ip,omitempty"`
+}
+
+// emit writes an event.  Does nothing when the event log is disabled (nil) or action is "".
+func (l *eventLog) emit(action string, ID string, domains []string, ip string) {
+	if l == nil || action == "" {
+		return
+	}
+	line, err := json.Marshal(containerEvent{Timestamp: time.Now().UTC(), Action: action, ContainerID: ID, FQDNs: domains, IP: ip})
+	if err != nil {
+		slog.Warn("Could not encode event", "error", err)
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		slog.Warn("Could not write event", "error", err)
+	}
+}
@@ -0,0 +1,57 @@
+package cjsocks
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestEventsJSON(t *testing.T) {
+	// The events go to stdout
+	stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer stdout.Close()
+	previous := os.Stdout
+	os.Stdout = stdout
+	defer func() { os.Stdout = previous }()
+
+	cfg := testConfig(t)
+	cfg.EventsJSON = true
+	app := newTestApp(t, cfg)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+	before := time.Now().UTC()
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	f.changeContainer("web1", func(c *docker.Container) { c.Name = "/site" })
+	app.handleEvent(f, fakeEvent("rename", "web1"))
+	app.handleEvent(f, fakeEvent("die", "web1"))
+
+	data, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var got []containerEvent
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		var event containerEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("event line %q: %v", line, err)
+		}
+		if event.Timestamp.Before(before) || event.Timestamp.After(time.Now().UTC()) {
+			t.Errorf("%v event timestamp %v isn't from the test", event.Action, event.Timestamp)
+		}
+		event.Timestamp = time.Time{}
+		got = append(got, event)
+	}
+	assertEqual(t, "events", got, []containerEvent{
+		{Action: "start", ContainerID: "web1", FQDNs: []string{"web.container"}, IP: "172.17.0.2"},
+		{Action: "rename", ContainerID: "web1", FQDNs: []string{"site.container"}, IP: "172.17.0.2"},
+		{Action: "stop", ContainerID: "web1", FQDNs: []string{"site.container"}, IP: "172.17.0.2"},
+	})
+}
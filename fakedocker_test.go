@@ -0,0 +1,370 @@
+package cjsocks
+
+// A fake docker daemon for the tests.  It keeps containers, networks and services in memory and hands the events
+// a test sends to the event listeners, so the event handling can be driven without docker.
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+type fakeDocker struct {
+	sync.Mutex
+	containers map[string]*docker.Container
+	networks   map[string]*docker.Network // By name
+	services   map[string]*swarm.Service
+	listeners  []chan<- *docker.APIEvents
+	calls      map[string]int // Number of calls to each method, e.g. "CreateNetwork"
+	connectIP  string         // IP a container gets on a network it is connected to
+	pingErr    error          // Returned by Ping, e.g. to play an unreachable daemon
+}
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{
+		containers: make(map[string]*docker.Container),
+		networks:   make(map[string]*docker.Network),
+		services:   make(map[string]*swarm.Service),
+		calls:      make(map[string]int),
+		connectIP:  "172.30.0.99",
+	}
+}
+
+// fakeContainer returns a running container called name with ip on the bridge network
+func fakeContainer(ID string, name string, ip string, labels map[string]string) *docker.Container {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	return &docker.Container{
+		ID:     ID,
+		Name:   "/" + name,
+		Config: &docker.Config{Labels: labels},
+		State:  docker.State{Running: true, Status: "running"},
+		NetworkSettings: &docker.NetworkSettings{
+			Networks: map[string]docker.ContainerNetwork{"bridge": {IPAddress: ip}},
+		},
+	}
+}
+
+// fakeDualStackContainer returns a running container on the bridge network with IPv4 address v4 and IPv6
+// address v6, either may be ""
+func fakeDualStackContainer(ID string, name string, v4 string, v6 string) *docker.Container {
+	container := fakeContainer(ID, name, v4, nil)
+	container.NetworkSettings.Networks["bridge"] = docker.ContainerNetwork{IPAddress: v4, GlobalIPv6Address: v6}
+	return container
+}
+
+// fakeService returns a swarm service called name with virtual IP vip, e.g. "10.0.1.5/24"
+func fakeService(ID string, name string, vip string, labels map[string]string) *swarm.Service {
+	service := &swarm.Service{ID: ID}
+	service.Spec.Name = name
+	service.Spec.Labels = labels
+	service.Endpoint.VirtualIPs = []swarm.EndpointVirtualIP{{NetworkID: "ingress", Addr: vip}}
+	return service
+}
+
+// fakeEvent returns a container event
+func fakeEvent(action string, ID string) *docker.APIEvents {
+	return &docker.APIEvents{
+		Type:   "container",
+		Action: action,
+		ID:     ID,
+		Actor:  docker.APIActor{ID: ID, Attributes: map[string]string{}},
+	}
+}
+
+// fakeNetworkEvent returns a network event, e.g. "disconnect", about container ID
+func fakeNetworkEvent(action string, network string, ID string) *docker.APIEvents {
+	return &docker.APIEvents{
+		Type:   "network",
+		Action: action,
+		Actor:  docker.APIActor{ID: network, Attributes: map[string]string{"container": ID, "name": network}},
+	}
+}
+
+// cloneContainer copies the parts of a container the fake changes, so callers can't race with it
+func cloneContainer(container *docker.Container) *docker.Container {
+	clone := *container
+	config := *container.Config
+	clone.Config = &config
+	settings := *container.NetworkSettings
+	settings.Networks = make(map[string]docker.ContainerNetwork, len(container.NetworkSettings.Networks))
+	for name, network := range container.NetworkSettings.Networks {
+		settings.Networks[name] = network
+	}
+	clone.NetworkSettings = &settings
+	return &clone
+}
+
+// addContainer adds or replaces a container
+func (f *fakeDocker) addContainer(container *docker.Container) {
+	f.Lock()
+	defer f.Unlock()
+	f.containers[container.ID] = cloneContainer(container)
+}
+
+// removeContainer deletes a container, so inspecting it fails like it does once docker removed it
+func (f *fakeDocker) removeContainer(ID string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.containers, ID)
+}
+
+// changeContainer calls change with a container to modify it in place
+func (f *fakeDocker) changeContainer(ID string, change func(container *docker.Container)) {
+	f.Lock()
+	defer f.Unlock()
+	change(f.containers[ID])
+}
+
+// addService adds or replaces a swarm service
+func (f *fakeDocker) addService(service *swarm.Service) {
+	f.Lock()
+	defer f.Unlock()
+	f.services[service.ID] = service
+}
+
+// removeService deletes a swarm service
+func (f *fakeDocker) removeService(ID string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.services, ID)
+}
+
+// send hands event to every event listener
+func (f *fakeDocker) send(event *docker.APIEvents) {
+	f.Lock()
+	listeners := append([]chan<- *docker.APIEvents{}, f.listeners...)
+	f.Unlock()
+	for _, listener := range listeners {
+		listener <- event
+	}
+}
+
+// dropListeners closes the event listeners and forgets them, like the docker client does when the connection to
+// the daemon drops
+func (f *fakeDocker) dropListeners() {
+	f.Lock()
+	defer f.Unlock()
+	for _, listener := range f.listeners {
+		close(listener)
+	}
+	f.listeners = nil
+}
+
+// listening returns the number of event listeners
+func (f *fakeDocker) listening() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.listeners)
+}
+
+// called returns the number of calls to method
+func (f *fakeDocker) called(method string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.calls[method]
+}
+
+// setPingErr makes Ping fail with err, or succeed when it is nil
+func (f *fakeDocker) setPingErr(err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.pingErr = err
+}
+
+func (f *fakeDocker) InspectContainer(id string) (*docker.Container, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["InspectContainer"]++
+	container, ok := f.containers[id]
+	if !ok {
+		return nil, &docker.NoSuchContainer{ID: id}
+	}
+	return cloneContainer(container), nil
+}
+
+func (f *fakeDocker) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["ListContainers"]++
+	containers := []docker.APIContainers{}
+	for _, container := range f.containers {
+		if opts.All || container.State.Running {
+			containers = append(containers, docker.APIContainers{ID: container.ID, Names: []string{container.Name}, Labels: container.Config.Labels})
+		}
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].ID < containers[j].ID })
+	return containers, nil
+}
+
+func (f *fakeDocker) AddEventListener(listener chan<- *docker.APIEvents) error {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["AddEventListener"]++
+	f.listeners = append(f.listeners, listener)
+	return nil
+}
+
+func (f *fakeDocker) RemoveEventListener(listener chan *docker.APIEvents) error {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["RemoveEventListener"]++
+	for i, l := range f.listeners {
+		if l == listener {
+			f.listeners = append(f.listeners[:i], f.listeners[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeDocker) CreateNetwork(opts docker.CreateNetworkOptions) (*docker.Network, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["CreateNetwork"]++
+	if _, ok := f.networks[opts.Name]; ok {
+		return nil, &docker.Error{Status: http.StatusConflict, Message: "network with name " + opts.Name + " already exists"}
+	}
+	network := &docker.Network{ID: "net-" + opts.Name, Name: opts.Name, Driver: "bridge", Labels: opts.Labels}
+	f.networks[opts.Name] = network
+	return network, nil
+}
+
+func (f *fakeDocker) NetworkInfo(id string) (*docker.Network, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["NetworkInfo"]++
+	for _, network := range f.networks {
+		if network.Name == id || network.ID == id {
+			clone := *network
+			return &clone, nil
+		}
+	}
+	return nil, &docker.NoSuchNetwork{ID: id}
+}
+
+func (f *fakeDocker) ConnectNetwork(id string, opts docker.NetworkConnectionOptions) error {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["ConnectNetwork"]++
+	container, ok := f.containers[opts.Container]
+	if !ok {
+		return &docker.NoSuchContainer{ID: opts.Container}
+	}
+	container.NetworkSettings.Networks[id] = docker.ContainerNetwork{IPAddress: f.connectIP}
+	return nil
+}
+
+func (f *fakeDocker) ListServices(opts docker.ListServicesOptions) ([]swarm.Service, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["ListServices"]++
+	services := []swarm.Service{}
+	for _, service := range f.services {
+		services = append(services, *service)
+	}
+	return services, nil
+}
+
+func (f *fakeDocker) InspectService(id string) (*swarm.Service, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["InspectService"]++
+	service, ok := f.services[id]
+	if !ok {
+		return nil, &docker.NoSuchService{ID: id}
+	}
+	clone := *service
+	return &clone, nil
+}
+
+func (f *fakeDocker) Ping() error {
+	f.Lock()
+	defer f.Unlock()
+	f.calls["Ping"]++
+	return f.pingErr
+}
+
+// testConfig returns the configuration cjsocks runs with when no flags are given
+func testConfig(t *testing.T) Config {
+	t.Helper()
+	cfg, err := ParseFlags(nil)
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	return cfg
+}
+
+// newTestApp returns an App for cfg
+func newTestApp(t *testing.T, cfg Config) *App {
+	t.Helper()
+	app, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return app
+}
+
+// registration is what the tests expect to be registered for a container
+type registration struct {
+	ID      string
+	ip      string
+	domains []string
+}
+
+// assertRegistered fails unless exactly the containers in want are registered: their names, IPs, the owners of
+// each name and the registry contents must all match.
+func assertRegistered(t *testing.T, app *App, want ...registration) {
+	t.Helper()
+	wantDomains := map[string][]string{}
+	wantIPs := map[string]string{}
+	wantOwners := map[string][]string{}
+	wantRegistry := map[string]string{}
+	for _, r := range want {
+		wantDomains[r.ID] = r.domains
+		wantIPs[r.ID] = r.ip
+		for _, domain := range r.domains {
+			wantOwners[domain] = append(wantOwners[domain], r.ID)
+			if _, ok := wantRegistry[domain]; !ok {
+				wantRegistry[domain] = r.ip
+			}
+		}
+	}
+
+	app.RLock()
+	gotDomains := copyMap(app.idToDomains)
+	gotIPs := copyMap(app.idToIp)
+	gotOwners := copyMap(app.fqdnOwners)
+	app.RUnlock()
+	gotRegistry, err := app.registry.List()
+	if err != nil {
+		t.Fatalf("registry.List: %v", err)
+	}
+
+	assertEqual(t, "idToDomains", gotDomains, wantDomains)
+	assertEqual(t, "idToIp", gotIPs, wantIPs)
+	assertEqual(t, "fqdnOwners", gotOwners, wantOwners)
+	assertEqual(t, "registry", gotRegistry, wantRegistry)
+}
+
+func copyMap[V any](m map[string]V) map[string]V {
+	copied := make(map[string]V, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
+
+// assertEqual fails when got and want print differently.  Maps print with sorted keys.
+func assertEqual(t *testing.T, what string, got interface{}, want interface{}) {
+	t.Helper()
+	if g, w := fmt.Sprint(got), fmt.Sprint(want); g != w {
+		t.Errorf("%v = %v, want %v", what, g, w)
+	}
+}
@@ -0,0 +1,197 @@
+package cjsocks
+
+// Helpers for tests that run the socks5 server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// socksTestConfig returns the default configuration with the socks5 server on a unix socket in a temporary
+// directory, so tests don't compete for ports, and a docker host nothing listens on
+func socksTestConfig(t *testing.T) Config {
+	t.Helper()
+	cfg := testConfig(t)
+	cfg.UnixSocket = filepath.Join(t.TempDir(), "cjsocks.sock")
+	cfg.DockerHost = "unix://" + filepath.Join(t.TempDir(), "docker.sock")
+	return cfg
+}
+
+// startApp runs app until the returned function is called, which returns what Run returned
+func startApp(t *testing.T, app *App) func() error {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- app.Run(ctx) }()
+	stopped := false
+	stop := func() error {
+		if stopped {
+			return nil
+		}
+		stopped = true
+		cancel()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(15 * time.Second):
+			t.Fatal("Run didn't return after cancelling")
+			return nil
+		}
+	}
+	t.Cleanup(func() { stop() })
+	return stop
+}
+
+// dialSocks connects to addr through the socks5 server of cfg, retrying while it starts.  Names in addr are
+// sent to the server to resolve.
+func dialSocks(t *testing.T, cfg Config, addr string) net.Conn {
+	t.Helper()
+	conn, err := trySocks(cfg, addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Dial %v through socks5: %v", addr, err)
+	}
+	return conn
+}
+
+// trySocks connects to addr through the socks5 server of cfg, retrying for up to wait while the server starts
+func trySocks(cfg Config, addr string, wait time.Duration) (net.Conn, error) {
+	var auth *proxy.Auth
+	if cfg.SocksUser != "" {
+		auth = &proxy.Auth{User: cfg.SocksUser, Password: cfg.SocksPass}
+	}
+	dialer, err := proxy.SOCKS5(cfg.listenNetwork(), cfg.listenAddr(), auth, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		conn, err := dialer.Dial("tcp", addr)
+		// Refused by the server rather than not listening yet
+		if err == nil || time.Now().After(deadline) || !isNotListening(err) {
+			return conn, err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// freeTCPPort returns a loopback TCP port nothing listens on
+func freeTCPPort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// isNotListening reports whether err is from dialing a socks5 server that isn't listening yet
+func isNotListening(err error) bool {
+	return errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// echoServer accepts connections on a loopback port and sends back what it reads
+func echoServer(t *testing.T) net.Listener {
+	t.Helper()
+	return testServer(t, func(conn net.Conn) { io.Copy(conn, conn) })
+}
+
+// testServer accepts connections on a loopback port and hands each to handle, closing it afterwards
+func testServer(t *testing.T, handle func(conn net.Conn)) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+// echo writes message to conn and fails unless it is read back
+func echo(t *testing.T, conn net.Conn, message string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	reply := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(reply) != message {
+		t.Errorf("echo = %q, want %q", reply, message)
+	}
+}
+
+// waitFor polls cond until it is true, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// logBuffer collects the JSON log lines of the default logger, see captureLogs
+type logBuffer struct {
+	sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buffer.Write(p)
+}
+
+// records returns the attributes of the log records with message msg, in the order they were logged
+func (b *logBuffer) records(msg string) []map[string]interface{} {
+	b.Lock()
+	defer b.Unlock()
+	records := []map[string]interface{}{}
+	for _, line := range strings.Split(b.buffer.String(), "\n") {
+		var record map[string]interface{}
+		if json.Unmarshal([]byte(line), &record) == nil && record[slog.MessageKey] == msg {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// captureLogs sends the default logger's records at every level to the returned buffer until the test ends
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	logs := &logBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
@@ -0,0 +1,64 @@
+package cjsocks
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHooksFromMonitor(t *testing.T) {
+	f := newFakeDocker()
+	app := newTestApp(t, socksTestConfig(t))
+	app.dockerClient = func() (dockerAPI, error) { return f, nil }
+	// The hooks run on the docker event loop
+	calls := make(chan string, 10)
+	app.hooks.OnContainerStart = func(domains []string, ip string) { calls <- "start " + ip + " " + domains[0] }
+	app.hooks.OnContainerStop = func(domains []string) { calls <- "stop " + domains[0] }
+	app.hooks.OnDomainsUpdated = func() { calls <- "updated" }
+	startApp(t, app)
+	waitFor(t, "the docker events listener", app.ready.Load)
+
+	next := func() string {
+		t.Helper()
+		select {
+		case call := <-calls:
+			return call
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a hook")
+			return ""
+		}
+	}
+	// Registering the running containers on connecting reports an update even with none
+	for len(calls) > 0 {
+		<-calls
+	}
+
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+	f.send(fakeEvent("start", "web1"))
+	assertEqual(t, "hooks on start", []string{next(), next()}, []string{"start 172.17.0.2 web.container", "updated"})
+	f.send(fakeEvent("die", "web1"))
+	assertEqual(t, "hooks on die", []string{next(), next()}, []string{"stop web.container", "updated"})
+}
+
+func TestHooks(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", map[string]string{label_cj_aliases: "www"}))
+
+	// Unset hooks are skipped
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	app.handleEvent(f, fakeEvent("die", "web1"))
+
+	var calls []string
+	app.hooks.OnContainerStart = func(domains []string, ip string) {
+		calls = append(calls, fmt.Sprint("start ", domains, " ", ip))
+	}
+	app.hooks.OnContainerStop = func(domains []string) { calls = append(calls, fmt.Sprint("stop ", domains)) }
+	app.hooks.OnDomainsUpdated = func() { calls = append(calls, "updated") }
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	app.handleEvent(f, fakeEvent("die", "web1"))
+	assertEqual(t, "hooks", calls, []string{
+		"start [web.container www.container] 172.17.0.2", "updated",
+		"stop [web.container www.container]", "updated",
+	})
+}
@@ -0,0 +1,70 @@
+package cjsocks
+
+// A name for the docker host (-host-alias, default "host.cjsocks"), like host.docker.internal.  It resolves to
+// -host-address when that is set, or else the gateway of the cj network.
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+const default_host_alias string = "host.cjsocks"
+
+// host_alias_id stands in for a container ID when registering the host alias
+const host_alias_id string = "host:"
+
+// setHostIP records the address the host alias resolves to, unless -host-address already chose one
+func (app *App) setHostIP(ip string) {
+	app.Lock()
+	defer app.Unlock()
+	if app.hostIP == "" {
+		app.hostIP = ip
+	}
+}
+
+// registerHostAlias registers the host alias once the host's address is known.  A container that holds the
+// name keeps it, whatever the collision policy, so it is called again on every reconnect and resync to take the
+// name once the container is gone.
+func (app *App) registerHostAlias() {
+	app.RLock()
+	alias, ip := app.hostAlias, app.hostIP
+	owners := app.fqdnOwners[strings.ToLower(alias)]
+	app.RUnlock()
+	if alias == "" || ip == "" {
+		return
+	}
+	if len(owners) > 0 && !containsString(owners, host_alias_id) {
+		slog.Warn("Host alias is taken by a container", "fqdn", alias, "container_id", owners[0])
+		return
+	}
+	var meta containerMeta
+	if parsed := net.ParseIP(ip); parsed.To4() != nil {
+		meta.v4 = parsed
+	} else {
+		meta.v6 = parsed
+	}
+	if len(app.registerContainer(host_alias_id, meta, []string{alias}, ip)) == 0 {
+		slog.Warn("Host alias is taken by a container", "fqdn", alias, "ip", ip)
+	}
+}
+
+// networkGateway returns the first gateway of a network, preferring IPv4, or "" if it has none
+func networkGateway(ipam docker.IPAMOptions) string {
+	gateway := ""
+	for _, config := range ipam.Config {
+		ip := net.ParseIP(config.Gateway)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			return ip.String()
+		}
+		if gateway == "" {
+			gateway = ip.String()
+		}
+	}
+	return gateway
+}
@@ -0,0 +1,91 @@
+package cjsocks
+
+import (
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestHostAliasKeepsContainerName(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.HostAddress = "192.168.1.10"
+	app := newTestApp(t, cfg)
+	host := registration{ID: host_alias_id, ip: "192.168.1.10", domains: []string{default_host_alias}}
+	app.registerHostAlias()
+	assertRegistered(t, app, host)
+
+	// A container with the name takes it over under the default collision policy, and keeps it from then on
+	web := registration{ID: "web1", ip: "172.17.0.2", domains: []string{default_host_alias}}
+	app.registerContainer(web.ID, containerMeta{}, web.domains, web.ip)
+	app.registerHostAlias()
+	assertRegistered(t, app, web, registration{ID: host_alias_id, ip: "192.168.1.10"})
+}
+
+func TestHostAliasOnResync(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.HostAddress = "192.168.1.10"
+	app := newTestApp(t, cfg)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", map[string]string{label_cj_aliases: default_host_alias}))
+	if err := registerRunningContainers(app, f); err != nil {
+		t.Fatalf("registerRunningContainers: %v", err)
+	}
+	web := registration{ID: "web1", ip: "172.17.0.2", domains: []string{"web.container", default_host_alias}}
+	assertRegistered(t, app, web)
+
+	if _, err := app.resync(f); err != nil {
+		t.Fatalf("resync: %v", err)
+	}
+	assertRegistered(t, app, web)
+
+	// The host gets the name once the container is gone
+	f.removeContainer("web1")
+	if _, err := app.resync(f); err != nil {
+		t.Fatalf("resync: %v", err)
+	}
+	assertRegistered(t, app, registration{ID: host_alias_id, ip: "192.168.1.10", domains: []string{default_host_alias}})
+}
+
+func TestHostAliasGateway(t *testing.T) {
+	tests := []struct {
+		name        string
+		hostAlias   string
+		hostAddress string
+		wantName    string
+		want        string
+	}{
+		{name: "cj network gateway", wantName: default_host_alias, want: "172.30.0.1"},
+		{name: "host address over the gateway", hostAddress: "192.168.1.10", wantName: default_host_alias, want: "192.168.1.10"},
+		{name: "configured alias", hostAlias: "Docker.Host.", wantName: "docker.host", want: "172.30.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.StrictResolve = true
+			cfg.HostAddress = tt.hostAddress
+			if tt.hostAlias != "" {
+				cfg.HostAlias = tt.hostAlias
+			}
+			app := newTestApp(t, cfg)
+			f := newFakeDocker()
+			f.networks[cfg.CJNetworkName] = &docker.Network{
+				Name:   cfg.CJNetworkName,
+				Driver: "bridge",
+				Labels: map[string]string{"description": cj_network_description},
+				IPAM: docker.IPAMOptions{Config: []docker.IPAMConfig{
+					{Subnet: "fd00:30::/64", Gateway: "fd00:30::1"},
+					{Subnet: "172.30.0.0/16", Gateway: "172.30.0.1"},
+				}},
+			}
+			if err := createNetwork(app, f); err != nil {
+				t.Fatalf("createNetwork: %v", err)
+			}
+			if err := registerRunningContainers(app, f); err != nil {
+				t.Fatalf("registerRunningContainers: %v", err)
+			}
+			if got := resolveIP(app, tt.wantName); got != tt.want {
+				t.Errorf("%v resolved to %q, want %v", tt.wantName, got, tt.want)
+			}
+		})
+	}
+}
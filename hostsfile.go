@@ -0,0 +1,111 @@
+package cjsocks
+
+// Hosts file updater.  Keeps a block of container entries in a hosts file so the names resolve
+// on machines that can't use the socks5 proxy or the DNS server.
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const hosts_begin_marker string = "# cjsocks BEGIN"
+const hosts_end_marker string = "# cjsocks END"
+
+type hostsFileUpdater struct {
+	sync.Mutex // Serializes rewrites of the file
+	path       string
+}
+
+// update replaces the managed block of the hosts file with domains.  Lines outside the block are kept as is.
+// The file is created if it doesn't exist.
+func (h *hostsFileUpdater) update(domains map[string]string) error {
+	h.Lock()
+	defer h.Unlock()
+
+	mode := os.FileMode(0644)
+	content, err := os.ReadFile(h.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if info, err := os.Stat(h.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	return writeFileAtomic(h.path, []byte(replaceHostsBlock(string(content), domains)), mode)
+}
+
+// replaceHostsBlock returns content with the block between the cjsocks markers replaced by one line per domain.
+// The block is appended if content doesn't have one yet.
+func replaceHostsBlock(content string, domains map[string]string) string {
+	fqdns := make([]string, 0, len(domains))
+	for fqdn := range domains {
+		// Hosts files don't support wildcards
+		if !strings.HasPrefix(fqdn, "*.") {
+			fqdns = append(fqdns, fqdn)
+		}
+	}
+	sort.Strings(fqdns)
+
+	block := []string{hosts_begin_marker}
+	for _, fqdn := range fqdns {
+		block = append(block, domains[fqdn]+"\t"+fqdn)
+	}
+	block = append(block, hosts_end_marker)
+
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	if content == "" {
+		lines = nil
+	}
+	begin, end := -1, -1
+	for i, line := range lines {
+		if begin < 0 && strings.TrimSpace(line) == hosts_begin_marker {
+			begin = i
+		} else if begin >= 0 && strings.TrimSpace(line) == hosts_end_marker {
+			end = i
+			break
+		}
+	}
+
+	var result []string
+	if begin >= 0 && end >= 0 {
+		result = append(result, lines[:begin]...)
+		result = append(result, block...)
+		result = append(result, lines[end+1:]...)
+	} else {
+		result = append(lines, block...)
+	}
+	return strings.Join(result, "\n") + "\n"
+}
+
+// writeFileAtomic replaces path by renaming a temporary file over it.  A bind mounted file (e.g. /etc/hosts
+// in a container) can't be replaced by a rename, so it is rewritten in place instead.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if errors.Is(err, syscall.EBUSY) {
+		return os.WriteFile(path, data, mode)
+	}
+	return err
+}
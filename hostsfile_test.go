@@ -0,0 +1,84 @@
+package cjsocks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHostsFileKeepsUserContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	before := "127.0.0.1\tlocalhost\n# my entries\n10.0.0.5\tnas.lan\n"
+	after := "\n192.168.1.20\tprinter.lan\n"
+	seeded := before + hosts_begin_marker + "\n172.17.0.9\told.container\n" + hosts_end_marker + after
+	if err := os.WriteFile(path, []byte(seeded), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	h := &hostsFileUpdater{path: path}
+	if err := h.update(map[string]string{"web.container": "172.17.0.2", "*.web.container": "172.17.0.2", "api.container": "172.17.0.3"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	// Only the block changed, wildcards left out
+	want := before + hosts_begin_marker + "\n172.17.0.3\tapi.container\n172.17.0.2\tweb.container\n" + hosts_end_marker + after
+	if string(content) != want {
+		t.Errorf("hosts file =\n%v\nwant\n%v", string(content), want)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("hosts file mode = %v, %v, want 0600 kept", info.Mode().Perm(), err)
+	}
+}
+
+func TestHostsFileCreated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	h := &hostsFileUpdater{path: path}
+	if err := h.update(map[string]string{"web.container": "172.17.0.2"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	want := hosts_begin_marker + "\n172.17.0.2\tweb.container\n" + hosts_end_marker + "\n"
+	if string(content) != want {
+		t.Errorf("hosts file =\n%v\nwant\n%v", string(content), want)
+	}
+}
+
+func TestHostsFileBlockReplaced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte("127.0.0.1\tlocalhost\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	h := &hostsFileUpdater{path: path}
+	for _, domains := range []map[string]string{
+		{"web.container": "172.17.0.2"},
+		{"web.container": "172.17.0.4", "api.container": "172.17.0.3"},
+		{"api.container": "172.17.0.3"},
+	} {
+		if err := h.update(domains); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if n := strings.Count(string(content), hosts_begin_marker); n != 1 {
+		t.Errorf("hosts file has %v blocks, want 1:\n%v", n, string(content))
+	}
+	want := "127.0.0.1\tlocalhost\n" + hosts_begin_marker + "\n172.17.0.3\tapi.container\n" + hosts_end_marker + "\n"
+	if string(content) != want {
+		t.Errorf("hosts file =\n%v\nwant\n%v", string(content), want)
+	}
+	// Nothing left behind by the atomic writes
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("directory has %v entries, want only the hosts file", len(entries))
+	}
+}
@@ -0,0 +1,71 @@
+package cjsocks
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestPreferIPv6(t *testing.T) {
+	dualStack := func(v4 string, v6 string) *docker.Container { return fakeDualStackContainer("web1", "web", v4, v6) }
+	tests := []struct {
+		name       string
+		container  *docker.Container
+		preferIPv6 bool
+		want       string
+		wantV4     string // The A answer, "" for none
+		wantV6     string // The AAAA answer, "" for none
+	}{
+		{"IPv6 only", dualStack("", "fd00::2"), false, "fd00::2", "", "fd00::2"},
+		{"IPv6 only preferring IPv6", dualStack("", "fd00::2"), true, "fd00::2", "", "fd00::2"},
+		{"both", dualStack("172.17.0.2", "fd00::2"), false, "172.17.0.2", "172.17.0.2", "fd00::2"},
+		{"both preferring IPv6", dualStack("172.17.0.2", "fd00::2"), true, "fd00::2", "172.17.0.2", "fd00::2"},
+		{"IPv4 only preferring IPv6", dualStack("172.17.0.2", ""), true, "172.17.0.2", "172.17.0.2", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.PreferIPv6 = tt.preferIPv6
+			app := newTestApp(t, cfg)
+			if got := getContainerIP(app, tt.container); got != tt.want {
+				t.Errorf("getContainerIP = %q, want %q", got, tt.want)
+			}
+
+			f := newFakeDocker()
+			f.addContainer(tt.container)
+			app.handleEvent(f, fakeEvent("start", "web1"))
+			_, ip, err := app.Resolve(context.Background(), "web.container")
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+			// The socks5 server picks the address family from the length
+			want := net.ParseIP(tt.want)
+			if ip4 := want.To4(); ip4 != nil {
+				want = ip4
+			}
+			if len(ip) != len(want) || !ip.Equal(want) {
+				t.Errorf("Resolve = %v (%v bytes), want %v (%v bytes)", ip, len(ip), want, len(want))
+			}
+
+			app.RLock()
+			v4, v6, _, _ := app.lookupFamilies("web.container")
+			app.RUnlock()
+			if got := ipString(v4); got != tt.wantV4 {
+				t.Errorf("A address = %q, want %q", got, tt.wantV4)
+			}
+			if got := ipString(v6); got != tt.wantV6 {
+				t.Errorf("AAAA address = %q, want %q", got, tt.wantV6)
+			}
+		})
+	}
+}
+
+// ipString returns ip as a string, or "" if it is nil
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
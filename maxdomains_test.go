@@ -0,0 +1,39 @@
+package cjsocks
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestMaxDomains(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.StrictResolve = true
+	cfg.MaxDomains = 2
+	app := newTestApp(t, cfg)
+	f := newFakeDocker()
+	for i, name := range []string{"web", "api", "db", "cache"} {
+		f.addContainer(fakeContainer(name+"1", name, "172.17.0."+strconv.Itoa(i+2), nil))
+	}
+	web := registration{ID: "web1", ip: "172.17.0.2", domains: []string{"web.container"}}
+	api := registration{ID: "api1", ip: "172.17.0.3", domains: []string{"api.container"}}
+	// Tracked without names, like a container whose names are kept by others
+	db := registration{ID: "db1", ip: "172.17.0.4", domains: []string{}}
+	cache := registration{ID: "cache1", ip: "172.17.0.5", domains: []string{"cache.container"}}
+
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	app.handleEvent(f, fakeEvent("start", "api1"))
+	app.handleEvent(f, fakeEvent("start", "db1"))
+	assertRegistered(t, app, web, api, db)
+	if got := resolveIP(app, "db.container"); got != "" {
+		t.Errorf("db.container resolved to %q over the limit, want nothing", got)
+	}
+
+	// Starting again doesn't count the names already registered
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	assertRegistered(t, app, web, api, db)
+
+	// Removing a container frees its names
+	app.handleEvent(f, fakeEvent("destroy", "api1"))
+	app.handleEvent(f, fakeEvent("start", "cache1"))
+	assertRegistered(t, app, web, db, cache)
+}
@@ -0,0 +1,73 @@
+package cjsocks
+
+// Prometheus metrics served on the admin HTTP server at /metrics.
+// Written in the text exposition format directly to avoid pulling in the Prometheus client.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+type metrics struct {
+	sync.Mutex
+	resolveTotal      map[string]uint64 // By result: hit (container name), miss (fell through to system DNS), rejected (strict mode), error, or denied (also counted as a hit or miss)
+	dockerEventsTotal map[string]uint64 // By docker event action
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		resolveTotal:      make(map[string]uint64),
+		dockerEventsTotal: make(map[string]uint64),
+	}
+}
+
+func (m *metrics) incResolve(result string) {
+	m.Lock()
+	m.resolveTotal[result]++
+	m.Unlock()
+}
+
+func (m *metrics) incDockerEvent(action string) {
+	m.Lock()
+	m.dockerEventsTotal[action]++
+	m.Unlock()
+}
+
+// handleMetrics writes the metrics in the Prometheus text format
+func (app *App) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	app.RLock()
+	domainsActive := len(app.fqdnOwners)
+	app.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	app.metrics.Lock()
+	defer app.metrics.Unlock()
+
+	fmt.Fprintln(w, "# HELP cjsocks_resolve_total Socks5 name resolutions by result.")
+	fmt.Fprintln(w, "# TYPE cjsocks_resolve_total counter")
+	writeCounters(w, "cjsocks_resolve_total", "result", app.metrics.resolveTotal)
+
+	fmt.Fprintln(w, "# HELP cjsocks_domains_active Number of registered container FQDNs.")
+	fmt.Fprintln(w, "# TYPE cjsocks_domains_active gauge")
+	fmt.Fprintf(w, "cjsocks_domains_active %d\n", domainsActive)
+
+	fmt.Fprintln(w, "# HELP cjsocks_docker_events_total Docker events received by action.")
+	fmt.Fprintln(w, "# TYPE cjsocks_docker_events_total counter")
+	writeCounters(w, "cjsocks_docker_events_total", "action", app.metrics.dockerEventsTotal)
+}
+
+// writeCounters writes one sample per label value, sorted so the output is stable
+func writeCounters(w io.Writer, name string, label string, counters map[string]uint64) {
+	values := make([]string, 0, len(counters))
+	for value := range counters {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", name, label, strconv.Quote(value), counters[value])
+	}
+}
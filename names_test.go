@@ -0,0 +1,406 @@
+package cjsocks
+
+import (
+	"fmt"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestWildcard(t *testing.T) {
+	app := newStrictTestApp(t)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("myservice1", "myservice", "172.17.0.2", map[string]string{label_cj_flag_wildcard: "true"}))
+	f.addContainer(fakeContainer("api1", "api", "172.17.0.3", nil))
+	app.handleEvent(f, fakeEvent("start", "myservice1"))
+	app.handleEvent(f, fakeEvent("start", "api1"))
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"myservice.container", "172.17.0.2"},
+		{"tenant1.myservice.container", "172.17.0.2"},
+		{"TENANT1.MyService.container.", "172.17.0.2"},
+		{"a.b.tenant1.myservice.container", "172.17.0.2"},
+		// Stripping labels stops at the wildcard base
+		{"container", ""},
+		{"other.container", ""},
+		{"tenant1.other.container", ""},
+		{"tenant1myservice.container", ""},
+		// Containers without the label only get their own names
+		{"api.container", "172.17.0.3"},
+		{"tenant1.api.container", ""},
+	}
+	for _, tt := range tests {
+		if got := resolveIP(app, tt.name); got != tt.want {
+			t.Errorf("%v resolved to %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	app.handleEvent(f, fakeEvent("destroy", "myservice1"))
+	if got := resolveIP(app, "tenant1.myservice.container"); got != "" {
+		t.Errorf("tenant1.myservice.container resolved to %q after the container was removed, want nothing", got)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	app := newStrictTestApp(t)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", map[string]string{label_cj_aliases: "www, shop.example.com,"}))
+	app.handleEvent(f, fakeEvent("start", "web1"))
+
+	assertRegistered(t, app, registration{ID: "web1", ip: "172.17.0.2", domains: []string{"web.container", "www.container", "shop.example.com"}})
+	// Bare aliases get the base domain, aliases with a dot are used as they are
+	for _, name := range []string{"web.container", "www.container", "shop.example.com"} {
+		if got := resolveIP(app, name); got != "172.17.0.2" {
+			t.Errorf("%v resolved to %q, want 172.17.0.2", name, got)
+		}
+	}
+	for _, name := range []string{"www", "shop.example.com.container"} {
+		if got := resolveIP(app, name); got != "" {
+			t.Errorf("%v resolved to %q, want nothing", name, got)
+		}
+	}
+}
+
+func TestNetworkSuffix(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.StrictResolve = true
+	cfg.NetworkSuffix = true
+	app := newTestApp(t, cfg)
+	f := newFakeDocker()
+	// onNetwork returns a container called web with address ip on the network called network
+	onNetwork := func(ID string, network string, ip string) *docker.Container {
+		container := fakeContainer(ID, "web", "", nil)
+		container.NetworkSettings.Networks = map[string]docker.ContainerNetwork{network: {IPAddress: ip}}
+		return container
+	}
+	f.addContainer(onNetwork("front1", "frontend", "172.18.0.2"))
+	f.addContainer(onNetwork("back1", "Backend_Net", "172.19.0.2"))
+	// Not reached on a network, so there is none to put in its names
+	f.addContainer(fakeContainer("fixed1", "fixed", "", map[string]string{label_cj_ip: "10.0.0.5"}))
+	for _, ID := range []string{"front1", "back1", "fixed1"} {
+		app.handleEvent(f, fakeEvent("start", ID))
+	}
+
+	assertRegistered(t, app,
+		registration{ID: "front1", ip: "172.18.0.2", domains: []string{"web.frontend.container"}},
+		registration{ID: "back1", ip: "172.19.0.2", domains: []string{"web.backend-net.container"}},
+		registration{ID: "fixed1", ip: "10.0.0.5", domains: []string{"fixed.container"}},
+	)
+	for name, want := range map[string]string{"web.frontend.container": "172.18.0.2", "web.backend-net.container": "172.19.0.2", "web.container": ""} {
+		if got := resolveIP(app, name); got != want {
+			t.Errorf("%v resolved to %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestMixedCaseNames(t *testing.T) {
+	app := newStrictTestApp(t)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "MyService", "172.17.0.2", map[string]string{label_cj_aliases: "WWW.Example.COM"}))
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	app.registerContainer("api1", containerMeta{}, []string{"API.Container"}, "172.17.0.3")
+
+	for name, want := range map[string]string{
+		"myservice.container": "172.17.0.2",
+		"MyService.Container": "172.17.0.2",
+		"MYSERVICE.CONTAINER": "172.17.0.2",
+		"www.example.com":     "172.17.0.2",
+		"Www.Example.Com.":    "172.17.0.2",
+		"api.container":       "172.17.0.3",
+		"api.CONTAINER":       "172.17.0.3",
+	} {
+		if got := resolveIP(app, name); got != want {
+			t.Errorf("%v resolved to %q, want %q", name, got, want)
+		}
+	}
+
+	// Removed whatever case they were registered with
+	app.handleEvent(f, fakeEvent("destroy", "web1"))
+	app.removeContainer("api1")
+	for _, name := range []string{"MyService.Container", "www.example.com", "API.Container"} {
+		if got := resolveIP(app, name); got != "" {
+			t.Errorf("%v resolved to %q after the container was removed, want nothing", name, got)
+		}
+	}
+	assertRegistered(t, app)
+}
+
+func TestBaseDomainLabel(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   []string
+	}{
+		{"alone", map[string]string{label_cj_base_domain: "test"}, []string{"web.test"}},
+		{"with a subdomain", map[string]string{label_cj_base_domain: "test", label_cj_subdomain: "api"}, []string{"web.api.test"}},
+		{"with a compose project", map[string]string{label_cj_base_domain: "test", label_docker_compose_project: "shop"}, []string{"web.shop.test"}},
+		{"domain name label wins", map[string]string{label_cj_base_domain: "test", label_cj_domain: "other"}, []string{"web.other"}},
+		{"replaces every base domain", map[string]string{label_cj_base_domain: "test."}, []string{"web.test"}},
+		{"empty", map[string]string{label_cj_base_domain: ""}, []string{"web.container", "web.local"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.BaseDomain = "container,local"
+			app := newTestApp(t, cfg)
+			container := fakeContainer("web1", "web", "172.17.0.2", tt.labels)
+			assertEqual(t, "getDomains", app.getDomains(container), tt.want)
+		})
+	}
+}
+
+func TestShortNameCollision(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   string // The address web resolves to
+	}{
+		{collision_policy_first, "172.17.0.2"},
+		{collision_policy_last, "172.17.0.3"},
+		{collision_policy_error, "172.17.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.StrictResolve = true
+			cfg.RegisterShortNames = true
+			cfg.ShortNameCollision = tt.policy
+			app := newTestApp(t, cfg)
+			f := newFakeDocker()
+			// The same service in two compose projects, so only the short name is shared
+			f.addContainer(fakeContainer("shop1", "shop-web-1", "172.17.0.2", map[string]string{label_docker_compose_service: "web", label_docker_compose_project: "shop"}))
+			f.addContainer(fakeContainer("blog1", "blog-web-1", "172.17.0.3", map[string]string{label_docker_compose_service: "web", label_docker_compose_project: "blog"}))
+			app.handleEvent(f, fakeEvent("start", "shop1"))
+			app.handleEvent(f, fakeEvent("start", "blog1"))
+
+			if got := resolveIP(app, "web"); got != tt.want {
+				t.Errorf("web resolved to %q, want %v", got, tt.want)
+			}
+			for name, want := range map[string]string{"web.shop.container": "172.17.0.2", "web.blog.container": "172.17.0.3"} {
+				if got := resolveIP(app, name); got != want {
+					t.Errorf("%v resolved to %q, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.IgnoreNameRegex = `-(init|migrate)-[0-9]+$`
+	app := newTestApp(t, cfg)
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   []string
+	}{
+		{"web", map[string]string{label_cj_flag_ignore: "true"}, []string{}},
+		{"shop-migrate-1", nil, []string{}},
+		{"web", map[string]string{label_cj_flag_ignore: "false"}, []string{"web.container"}},
+		{"shop-web-1", nil, []string{"shop-web-1.container"}},
+	}
+	for _, tt := range tests {
+		container := fakeContainer(tt.name+"1", tt.name, "172.17.0.2", tt.labels)
+		assertEqual(t, tt.name+" getDomains with labels "+fmt.Sprint(tt.labels), app.getDomains(container), tt.want)
+	}
+
+	// Never registered, even when started
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("sidecar1", "sidecar", "172.17.0.3", map[string]string{label_cj_flag_ignore: "true"}))
+	app.handleEvent(f, fakeEvent("start", "sidecar1"))
+	if got := resolveIP(app, "sidecar.container"); got != "" {
+		t.Errorf("sidecar.container resolved to %q, want an ignored container to have no name", got)
+	}
+}
+
+func TestReplicaNames(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		cfg := testConfig(t)
+		cfg.StrictResolve = true
+		cfg.RegisterReplicaNames = enabled
+		app := newTestApp(t, cfg)
+		f := newFakeDocker()
+		for i, ip := range []string{"172.17.0.2", "172.17.0.3"} {
+			number := fmt.Sprint(i + 1)
+			f.addContainer(fakeContainer("web"+number, "shop-web-"+number, ip, map[string]string{
+				label_docker_compose_service:          "web",
+				label_docker_compose_project:          "shop",
+				label_docker_compose_container_number: number,
+			}))
+			app.handleEvent(f, fakeEvent("start", "web"+number))
+		}
+		// Without the label there is no number to add
+		assertEqual(t, "getDomains without a container number", app.getDomains(fakeContainer("api1", "api", "172.17.0.4", nil)), []string{"api.container"})
+
+		want := map[string]string{"web-1.shop.container": "172.17.0.2", "web-2.shop.container": "172.17.0.3"}
+		if !enabled {
+			want = map[string]string{"web-1.shop.container": "", "web-2.shop.container": ""}
+		}
+		for name, ip := range want {
+			if got := resolveIP(app, name); got != ip {
+				t.Errorf("replica names %v: %v resolved to %q, want %q", enabled, name, got, ip)
+			}
+		}
+		// The shared service name stays
+		if got := resolveIP(app, "web.shop.container"); got == "" {
+			t.Errorf("replica names %v: web.shop.container doesn't resolve", enabled)
+		}
+	}
+}
+
+func TestBaseDomainNormalized(t *testing.T) {
+	tests := []struct {
+		baseDomain string
+		want       []string
+	}{
+		{" .Container. ", []string{"container"}},
+		{"Test.Internal", []string{"test.internal"}},
+		{"..", []string{default_base_domain}},
+		{"bad_domain!", []string{default_base_domain}},
+	}
+	for _, tt := range tests {
+		cfg := testConfig(t)
+		cfg.BaseDomain = tt.baseDomain
+		app := newTestApp(t, cfg)
+		assertEqual(t, fmt.Sprintf("base domains for %q", tt.baseDomain), app.baseDomains, tt.want)
+	}
+
+	// Domains from labels too
+	app := newTestApp(t, testConfig(t))
+	container := fakeContainer("web1", "web", "172.17.0.2", map[string]string{label_cj_subdomain: " .API. ", label_cj_domain: "Example.Test."})
+	assertEqual(t, "getDomains", app.getDomains(container), []string{"web.api.example.test"})
+}
+
+func TestMultipleBaseDomains(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.StrictResolve = true
+	cfg.BaseDomain = "container, local,Container."
+	app := newTestApp(t, cfg)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", map[string]string{label_cj_subdomain: "api"}))
+	app.handleEvent(f, fakeEvent("start", "web1"))
+
+	assertRegistered(t, app, registration{ID: "web1", ip: "172.17.0.2", domains: []string{"web.api.container", "web.api.local"}})
+	for _, name := range []string{"web.api.container", "web.api.local"} {
+		if got := resolveIP(app, name); got != "172.17.0.2" {
+			t.Errorf("%v resolved to %q, want 172.17.0.2", name, got)
+		}
+	}
+}
+
+func TestHostNameLabelCollision(t *testing.T) {
+	const warning = "Two containers have the same host name label"
+	logs := captureLogs(t)
+	app := newTestApp(t, testConfig(t))
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web-a", "172.17.0.2", map[string]string{label_cj_hostname: "web", label_cj_aliases: "www"}))
+	f.addContainer(fakeContainer("web2", "web-b", "172.17.0.3", map[string]string{label_cj_hostname: "web", label_cj_aliases: "www"}))
+	// Same generated name, but no label
+	f.addContainer(fakeContainer("api1", "api", "172.17.0.4", nil))
+	f.addContainer(fakeContainer("api2", "api", "172.17.0.5", nil))
+	for _, ID := range []string{"web1", "web2", "api1", "api2"} {
+		app.handleEvent(f, fakeEvent("start", ID))
+	}
+
+	// Once per container, not once per name
+	warnings := logs.records(warning)
+	if len(warnings) != 1 {
+		t.Fatalf("%q logged %v times, want once for the label collision", warning, len(warnings))
+	}
+	assertEqual(t, "warning", []interface{}{warnings[0]["level"], warnings[0]["host_name"], warnings[0]["container_id"], warnings[0]["other_container_id"]},
+		[]interface{}{"WARN", "web", "web2", "web1"})
+}
+
+func TestProjectFilter(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.StrictResolve = true
+	cfg.ProjectFilter = []string{"shop", "Blog"}
+	app := newTestApp(t, cfg)
+	f := newFakeDocker()
+	for _, project := range []string{"shop", "blog", "other", ""} {
+		labels := map[string]string{label_docker_compose_service: "web"}
+		if project != "" {
+			labels[label_docker_compose_project] = project
+		}
+		ID := "web-" + project
+		f.addContainer(fakeContainer(ID, ID, "172.17.0.2", labels))
+		app.handleEvent(f, fakeEvent("start", ID))
+	}
+	for name, want := range map[string]string{
+		"web.shop.container":  "172.17.0.2",
+		"web.blog.container":  "172.17.0.2", // Project names ignore case
+		"web.other.container": "",
+		"web.container":       "", // Not from a compose project
+	} {
+		if got := resolveIP(app, name); got != want {
+			t.Errorf("%v resolved to %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestComposeOneOff(t *testing.T) {
+	app := newStrictTestApp(t)
+	f := newFakeDocker()
+	compose := func(name string, labels map[string]string) map[string]string {
+		labels[label_docker_compose_service] = name
+		labels[label_docker_compose_project] = "shop"
+		return labels
+	}
+	f.addContainer(fakeContainer("web1", "shop-web-1", "172.17.0.2", compose("web", map[string]string{})))
+	f.addContainer(fakeContainer("run1", "shop-web-run-1a2b3c", "172.17.0.9", compose("web", map[string]string{label_docker_compose_oneoff: "True"})))
+	// Given its own name, a one-off container gets it
+	f.addContainer(fakeContainer("run2", "shop-web-run-4d5e6f", "172.17.0.10", compose("web", map[string]string{label_docker_compose_oneoff: "True", label_cj_hostname: "migrate"})))
+	for _, ID := range []string{"web1", "run1", "run2"} {
+		app.handleEvent(f, fakeEvent("start", ID))
+	}
+	for name, want := range map[string]string{"web.shop.container": "172.17.0.2", "migrate.shop.container": "172.17.0.10"} {
+		if got := resolveIP(app, name); got != want {
+			t.Errorf("%v resolved to %q, want %v", name, got, want)
+		}
+	}
+}
+
+func TestEmptyHostName(t *testing.T) {
+	const warning = "Skipping container without a usable host name"
+	logs := captureLogs(t)
+	app := newTestApp(t, testConfig(t))
+	for _, name := range []string{"", ".", " "} {
+		container := fakeContainer("empty1", name, "172.17.0.2", nil)
+		assertEqual(t, fmt.Sprintf("getDomains for a container called %q", container.Name), app.getDomains(container), []string{})
+	}
+	if got := len(logs.records(warning)); got != 3 {
+		t.Errorf("%q logged %v times, want 3", warning, got)
+	}
+
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("empty1", "", "172.17.0.2", nil))
+	app.handleEvent(f, fakeEvent("start", "empty1"))
+	assertEqual(t, "names after starting it", app.Domains(), map[string]string{})
+}
+
+func TestDockerSuffixAlias(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		cfg := testConfig(t)
+		cfg.StrictResolve = true
+		cfg.DockerSuffixAlias = enabled
+		app := newTestApp(t, cfg)
+		f := newFakeDocker()
+		f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+		// The raw container name, not the compose service
+		f.addContainer(fakeContainer("api1", "shop-api-1", "172.17.0.3", map[string]string{label_docker_compose_service: "api", label_docker_compose_project: "shop"}))
+		app.handleEvent(f, fakeEvent("start", "web1"))
+		app.handleEvent(f, fakeEvent("start", "api1"))
+
+		want := map[string]string{"web.container": "172.17.0.2", "web.docker": "172.17.0.2", "api.shop.container": "172.17.0.3", "shop-api-1.docker": "172.17.0.3"}
+		if !enabled {
+			want["web.docker"], want["shop-api-1.docker"] = "", ""
+		}
+		for name, ip := range want {
+			if got := resolveIP(app, name); got != ip {
+				t.Errorf("docker suffix alias %v: %v resolved to %q, want %q", enabled, name, got, ip)
+			}
+		}
+	}
+}
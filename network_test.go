@@ -0,0 +1,271 @@
+package cjsocks
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// failingCreate is a fake daemon whose CreateNetwork fails with err
+type failingCreate struct {
+	*fakeDocker
+	err error
+}
+
+func (f failingCreate) CreateNetwork(opts docker.CreateNetworkOptions) (*docker.Network, error) {
+	return nil, f.err
+}
+
+func TestCreateNetwork(t *testing.T) {
+	const notOurs = "Network already exists but was not created by cjsocks"
+	const overlay = "Network is an overlay network.  Containers can only join it if it is attachable"
+	tests := []struct {
+		name     string
+		existing *docker.Network // Already on the daemon, or nil
+		err      error           // From CreateNetwork, nil for the fake's own behaviour
+		wantErr  bool
+		warnings []string
+	}{
+		{name: "created"},
+		{name: "created earlier by cjsocks", existing: &docker.Network{Driver: "bridge", Labels: map[string]string{"description": cj_network_description}}},
+		{name: "created by someone else", existing: &docker.Network{Driver: "bridge"}, warnings: []string{notOurs}},
+		{name: "overlay", existing: &docker.Network{Driver: "overlay", Labels: map[string]string{"description": cj_network_description}}, warnings: []string{overlay}},
+		{name: "server error", err: &docker.Error{Status: http.StatusInternalServerError, Message: "boom"}, wantErr: true},
+		{name: "connection error", err: errors.New("connection refused"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			cfg := testConfig(t)
+			app := newTestApp(t, cfg)
+			f := newFakeDocker()
+			if tt.existing != nil {
+				tt.existing.Name = cfg.CJNetworkName
+				f.networks[cfg.CJNetworkName] = tt.existing
+			}
+			var client dockerAPI = f
+			if tt.err != nil {
+				client = failingCreate{fakeDocker: f, err: tt.err}
+			}
+
+			err := createNetwork(app, client)
+			if tt.wantErr {
+				if err == nil || !errors.Is(err, tt.err) {
+					t.Errorf("createNetwork = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("createNetwork = %v, want the network used", err)
+			}
+			if _, err := f.NetworkInfo(cfg.CJNetworkName); err != nil {
+				t.Errorf("network missing: %v", err)
+			}
+			for _, msg := range []string{notOurs, overlay} {
+				want := 0
+				for _, warning := range tt.warnings {
+					if warning == msg {
+						want = 1
+					}
+				}
+				if got := len(logs.records(msg)); got != want {
+					t.Errorf("%q logged %v times, want %v", msg, got, want)
+				}
+			}
+		})
+	}
+}
+
+// onNetworks returns a running container called web with an address on each of networks, by network name
+func onNetworks(networks map[string]string, labels map[string]string) *docker.Container {
+	container := fakeContainer("web1", "web", "", labels)
+	container.NetworkSettings.Networks = map[string]docker.ContainerNetwork{}
+	for network, ip := range networks {
+		container.NetworkSettings.Networks[network] = docker.ContainerNetwork{IPAddress: ip}
+	}
+	return container
+}
+
+func TestNetworkPriority(t *testing.T) {
+	networks := map[string]string{"alpha": "172.18.0.2", "backend": "172.19.0.2", "frontend": "172.20.0.2"}
+	tests := []struct {
+		name     string
+		priority []string
+		cj       bool // Also on the cj network
+		want     string
+	}{
+		{name: "highest priority", priority: []string{"frontend", "backend"}, want: "172.20.0.2"},
+		{name: "priority ignores case", priority: []string{"Backend"}, want: "172.19.0.2"},
+		{name: "priority names no network", priority: []string{"missing", "backend"}, want: "172.19.0.2"},
+		{name: "sorted by name without priority", want: "172.18.0.2"},
+		{name: "cj network first", priority: []string{"frontend"}, cj: true, want: "172.30.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.NetworkPriority = tt.priority
+			app := newTestApp(t, cfg)
+			on := copyMap(networks)
+			if tt.cj {
+				on[cfg.CJNetworkName] = "172.30.0.2"
+			}
+			// Whatever order the map is iterated in
+			for i := 0; i < 20; i++ {
+				if got := getContainerIP(app, onNetworks(on, nil)); got != tt.want {
+					t.Fatalf("getContainerIP = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNetworkLabel(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.NetworkPriority = []string{"frontend"}
+	app := newTestApp(t, cfg)
+	networks := map[string]string{"backend": "172.19.0.2", "frontend": "172.20.0.2", cfg.CJNetworkName: "172.30.0.2"}
+	tests := []struct {
+		label string
+		want  string
+	}{
+		{"backend", "172.19.0.2"}, // Over the cj network and -network-priority
+		{"missing", "172.30.0.2"}, // Not on it, so the usual order
+		{"", "172.30.0.2"},        // No label
+	}
+	for _, tt := range tests {
+		labels := map[string]string{}
+		if tt.label != "" {
+			labels[label_cj_network] = tt.label
+		}
+		if got := getContainerIP(app, onNetworks(networks, labels)); got != tt.want {
+			t.Errorf("getContainerIP with network label %q = %v, want %v", tt.label, got, tt.want)
+		}
+	}
+}
+
+func TestCheckNetwork(t *testing.T) {
+	const missing = "Could not inspect network.  Containers may have no IP on it, so their IPs come from other networks and may not be reachable"
+	logs := captureLogs(t)
+	cfg := testConfig(t)
+	cfg.NoCreateNetwork = true
+	app := newTestApp(t, cfg)
+	f := newFakeDocker()
+
+	// Expected to exist, but doesn't.  Still not fatal.
+	if err := createNetwork(app, f); err != nil {
+		t.Fatalf("createNetwork = %v, want a missing network only logged", err)
+	}
+	warnings := logs.records(missing)
+	if len(warnings) != 1 || warnings[0]["network"] != cfg.CJNetworkName {
+		t.Errorf("%q logged as %v, want once for %v", missing, warnings, cfg.CJNetworkName)
+	}
+
+	f.networks[cfg.CJNetworkName] = &docker.Network{
+		Name:   cfg.CJNetworkName,
+		Driver: "bridge",
+		Labels: map[string]string{"description": cj_network_description},
+		IPAM:   docker.IPAMOptions{Config: []docker.IPAMConfig{{Subnet: "172.30.0.0/16"}}},
+	}
+	if err := createNetwork(app, f); err != nil {
+		t.Fatalf("createNetwork: %v", err)
+	}
+	used := logs.records("Using network")
+	if len(used) != 1 || used[0]["driver"] != "bridge" || fmt.Sprint(used[0]["subnets"]) != "[172.30.0.0/16]" {
+		t.Errorf("Using network logged as %v, want the driver and subnet", used)
+	}
+	if got := len(logs.records(missing)); got != 1 {
+		t.Errorf("%q logged %v times once the network exists, want no more", missing, got)
+	}
+}
+
+func TestPublishedOnAllInterfaces(t *testing.T) {
+	tests := []struct {
+		name        string
+		hostAddress string
+		dockerHost  string
+		hostIP      string // Of the port binding
+		want        string
+	}{
+		{name: "host address", hostAddress: "192.168.1.10", hostIP: "0.0.0.0", want: "192.168.1.10"},
+		{name: "IPv6 unspecified", hostAddress: "192.168.1.10", hostIP: "::", want: "192.168.1.10"},
+		{name: "tcp docker host", dockerHost: "tcp://192.168.1.20:2376", hostIP: "0.0.0.0", want: "192.168.1.20"},
+		{name: "host address over the docker host", hostAddress: "192.168.1.10", dockerHost: "tcp://192.168.1.20:2376", hostIP: "0.0.0.0", want: "192.168.1.10"},
+		{name: "unix docker host", hostIP: "0.0.0.0", want: "0.0.0.0"},
+		{name: "one interface", hostAddress: "192.168.1.10", hostIP: "127.0.0.1", want: "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.HostAddress = tt.hostAddress
+			if tt.dockerHost != "" {
+				cfg.DockerHost = tt.dockerHost
+			}
+			app := newTestApp(t, cfg)
+			// Only reachable through a published port, like a container on the host network
+			container := onNetworks(map[string]string{"host": ""}, nil)
+			container.NetworkSettings.Ports = map[docker.Port][]docker.PortBinding{"80/tcp": {{HostIP: tt.hostIP, HostPort: "8080"}}}
+			if got := getContainerIP(app, container); got != tt.want {
+				t.Errorf("getContainerIP = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPLabel(t *testing.T) {
+	logs := captureLogs(t)
+	app := newStrictTestApp(t)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("fixed1", "fixed", "172.17.0.2", map[string]string{label_cj_ip: " 203.0.113.5 "}))
+	f.addContainer(fakeContainer("fixed61", "fixed6", "172.17.0.3", map[string]string{label_cj_ip: "2001:db8::5"}))
+	f.addContainer(fakeContainer("bad1", "bad", "172.17.0.4", map[string]string{label_cj_ip: "not-an-ip"}))
+	for _, ID := range []string{"fixed1", "fixed61", "bad1"} {
+		app.handleEvent(f, fakeEvent("start", ID))
+	}
+	for name, want := range map[string]string{
+		"fixed.container":  "203.0.113.5",
+		"fixed6.container": "2001:db8::5",
+		"bad.container":    "172.17.0.4", // Ignored
+	} {
+		if got := resolveIP(app, name); got != want {
+			t.Errorf("%v resolved to %q, want %v", name, got, want)
+		}
+	}
+	warnings := logs.records("Ignoring invalid ip label")
+	if len(warnings) == 0 || warnings[0]["container_id"] != "bad1" || warnings[0]["value"] != "not-an-ip" {
+		t.Errorf("invalid ip label logged as %v, want a warning for bad1", warnings)
+	}
+}
+
+func TestSharedNetworkFirst(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("Hostname: %v", err)
+	}
+	cfg := testConfig(t)
+	cfg.NetworkPriority = []string{"other"}
+	app := newTestApp(t, cfg)
+	f := newFakeDocker()
+	// cjsocks's own container is only on the shared network, so it can't reach the cj network address
+	self := fakeContainer(hostname, "cjsocks", "", nil)
+	self.NetworkSettings.Networks = map[string]docker.ContainerNetwork{"Shared": {IPAddress: "172.21.0.9"}}
+	f.addContainer(self)
+	web := onNetworks(map[string]string{cfg.CJNetworkName: "172.30.0.2", "shared": "172.21.0.2", "other": "172.22.0.2"}, nil)
+	f.addContainer(web)
+
+	if got := getContainerIP(app, web); got != "172.30.0.2" {
+		t.Errorf("getContainerIP before inspecting own container = %v, want the cj network's 172.30.0.2", got)
+	}
+	if err := registerRunningContainers(app, f); err != nil {
+		t.Fatalf("registerRunningContainers: %v", err)
+	}
+	if got := getContainerIP(app, web); got != "172.21.0.2" {
+		t.Errorf("getContainerIP = %v, want the shared network's 172.21.0.2", got)
+	}
+	if got := resolveIP(app, "web.container"); got != "172.21.0.2" {
+		t.Errorf("web.container resolved to %q, want 172.21.0.2", got)
+	}
+}
@@ -0,0 +1,53 @@
+package cjsocks
+
+// The networks cjsocks's own container is attached to.  A container is only reachable on a network cjsocks
+// shares with it, so those networks are preferred when picking a container's address.
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// refreshOwnNetworks inspects cjsocks's own container and remembers its networks.  Outside a container nothing
+// is preferred, since the host reaches every local network.
+func (app *App) refreshOwnNetworks(client dockerAPI) {
+	container, err := inspectSelf(client)
+	if err != nil {
+		slog.Debug("Not preferring shared networks, probably not running in a container", "error", err)
+		return
+	}
+	networks := make(map[string]bool, len(container.NetworkSettings.Networks))
+	names := make([]string, 0, len(container.NetworkSettings.Networks))
+	for networkname := range container.NetworkSettings.Networks {
+		networks[strings.ToLower(networkname)] = true
+		names = append(names, networkname)
+	}
+	app.selfID.Store(container.ID)
+	app.ownNetworks.Store(&networks)
+	slog.Debug("Preferring networks shared with own container", "container_id", container.ID, "networks", names)
+}
+
+// isSelf reports whether ID is cjsocks's own container
+func (app *App) isSelf(ID string) bool {
+	selfID, _ := app.selfID.Load().(string)
+	return selfID != "" && selfID == ID
+}
+
+// sharedFirst moves the networks cjsocks is also attached to ahead of the others, keeping their order otherwise.
+// order is returned as is when cjsocks's own networks aren't known.
+func (app *App) sharedFirst(order []string) []string {
+	own := app.ownNetworks.Load()
+	if own == nil || len(*own) == 0 {
+		return order
+	}
+	shared := make([]string, 0, len(order))
+	others := []string{}
+	for _, networkname := range order {
+		if (*own)[strings.ToLower(networkname)] {
+			shared = append(shared, networkname)
+		} else {
+			others = append(others, networkname)
+		}
+	}
+	return append(shared, others...)
+}
@@ -0,0 +1,61 @@
+package cjsocks
+
+// Port rewriting for the port_map label.  The socks5 server resolves the requested name with Resolve, then asks
+// its Rewriter for the address to dial, then checks its rules and dials.  Resolve stores the port map of the
+// container a name resolved to in the request context, and portRewriter applies it to the requested port.
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/haxii/socks5"
+)
+
+type portMapKey struct{}
+
+// portRewriter implements socks5.AddressRewriter with the port map and upstream port Resolve stored in ctx
+type portRewriter struct{}
+
+func (portRewriter) Rewrite(ctx context.Context, req *socks5.Request) (context.Context, *socks5.AddrSpec) {
+	ports, _ := ctx.Value(portMapKey{}).(map[int]int)
+	port, ok := ports[req.DestAddr.Port]
+	// The upstream label's port applies to the ports the port map leaves alone
+	if !ok {
+		port, ok = ctx.Value(upstreamPortKey{}).(int)
+	}
+	if !ok || port == req.DestAddr.Port {
+		return ctx, req.DestAddr
+	}
+	slog.Debug("Rewriting destination port", "fqdn", req.DestAddr.FQDN, "port", req.DestAddr.Port, "to", port)
+	return ctx, &socks5.AddrSpec{FQDN: req.DestAddr.FQDN, IP: req.DestAddr.IP, Port: port}
+}
+
+// labelPortMap returns the ports to rewrite from a container's port_map label, e.g. "80:8080,443:8443", or nil
+// if there is none.  Invalid entries are logged and skipped.
+func labelPortMap(ID string, labels map[string]string) map[int]int {
+	value := labels[label_cj_port_map]
+	if value == "" {
+		return nil
+	}
+	ports := make(map[int]int)
+	for _, entry := range splitList(value) {
+		from, to, ok := strings.Cut(entry, ":")
+		fromPort, fromErr := strconv.Atoi(strings.TrimSpace(from))
+		toPort, toErr := strconv.Atoi(strings.TrimSpace(to))
+		if !ok || fromErr != nil || toErr != nil || !validPort(fromPort) || !validPort(toPort) {
+			slog.Warn("Ignoring invalid port_map entry, expected port:port", "container_id", ID, "label", label_cj_port_map, "entry", entry)
+			continue
+		}
+		ports[fromPort] = toPort
+	}
+	if len(ports) == 0 {
+		return nil
+	}
+	return ports
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
@@ -0,0 +1,52 @@
+package cjsocks
+
+import (
+	"context"
+	"testing"
+
+	"github.com/haxii/socks5"
+)
+
+func TestLabelPortMap(t *testing.T) {
+	tests := []struct {
+		label string
+		want  map[int]int
+	}{
+		{label: "", want: nil},
+		{label: "80:8080", want: map[int]int{80: 8080}},
+		{label: "80:8080, 443:8443", want: map[int]int{80: 8080, 443: 8443}},
+		{label: "80:8080,http:8080,443,0:1,70000:80", want: map[int]int{80: 8080}},
+		{label: "bad", want: nil},
+	}
+	for _, tt := range tests {
+		got := labelPortMap("web1", map[string]string{label_cj_port_map: tt.label})
+		assertEqual(t, "labelPortMap("+tt.label+")", got, tt.want)
+	}
+}
+
+func TestPortRewrite(t *testing.T) {
+	app := newStrictTestApp(t)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", map[string]string{label_cj_port_map: "80:8080"}))
+	app.handleEvent(f, fakeEvent("start", "web1"))
+
+	// Resolvers set with SetResolver may pass nil
+	ctx, ip, err := app.Resolve(nil, "web.container")
+	if err != nil || ip.String() != "172.17.0.2" {
+		t.Fatalf("Resolve(nil, web.container) = %v, %v, want 172.17.0.2", ip, err)
+	}
+	for _, tt := range []struct{ port, want int }{{80, 8080}, {443, 443}} {
+		req := &socks5.Request{DestAddr: &socks5.AddrSpec{FQDN: "web.container", IP: ip, Port: tt.port}}
+		if _, addr := (portRewriter{}).Rewrite(ctx, req); addr.Port != tt.want {
+			t.Errorf("Rewrite port %v = %v, want %v", tt.port, addr.Port, tt.want)
+		}
+	}
+
+	// Names without the label keep their port
+	app.registerContainer("api1", containerMeta{}, []string{"api.container"}, "172.17.0.3")
+	ctx, ip, _ = app.Resolve(context.Background(), "api.container")
+	req := &socks5.Request{DestAddr: &socks5.AddrSpec{FQDN: "api.container", IP: ip, Port: 80}}
+	if _, addr := (portRewriter{}).Rewrite(ctx, req); addr.Port != 80 {
+		t.Errorf("Rewrite port 80 of api.container = %v, want 80", addr.Port)
+	}
+}
@@ -0,0 +1,57 @@
+package cjsocks
+
+// Connection rate limiting for -max-conns-per-sec.  Protects the containers behind the proxy from connection storms.
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate events per second on average, and bursts of up to rate at once
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take removes a token if one is available.  Otherwise it returns how long until the next one.
+func (b *tokenBucket) take() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// rateLimitedListener delays accepting connections past the bucket's rate.  Waiting connections queue in the
+// listen backlog, so clients are slowed down rather than refused.
+type rateLimitedListener struct {
+	net.Listener
+	bucket *tokenBucket
+}
+
+func (l rateLimitedListener) Accept() (net.Conn, error) {
+	for {
+		delay := l.bucket.take()
+		if delay == 0 {
+			return l.Listener.Accept()
+		}
+		slog.Debug("Throttling socks5 connections", "delay", delay)
+		time.Sleep(delay)
+	}
+}
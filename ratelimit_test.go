@@ -0,0 +1,28 @@
+package cjsocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaxConnsPerSec(t *testing.T) {
+	logs := captureLogs(t)
+	cfg := socksTestConfig(t)
+	cfg.MaxConnsPerSec = 10
+	startApp(t, newTestApp(t, cfg))
+	target := echoServer(t).Addr().String()
+
+	// A burst of 10 goes straight through, the next 10 get one token each every 100ms
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		conn := dialSocks(t, cfg, target)
+		echo(t, conn, "ping")
+		conn.Close()
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("20 connections took %v at 10 per second, want them throttled to about a second", elapsed)
+	}
+	if len(logs.records("Throttling socks5 connections")) == 0 {
+		t.Error("no connections were throttled")
+	}
+}
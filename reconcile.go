@@ -0,0 +1,96 @@
+package cjsocks
+
+// Periodic reconciliation (-reconcile-interval).  Events can be missed, e.g. while the event stream reconnects
+// or when the daemon drops them under load, so the registered containers are compared with the running ones
+// every so often.
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+const default_reconcile_interval = 60 * time.Second
+
+// reconcile registers running containers that are missing, moves containers whose IP changed and removes
+// containers that are no longer running.  The names of containers that didn't change are left alone, so it
+// doesn't disturb resolution or hand names over between colliding containers.  With relabel, as for resync, the
+// names of every registered container are recomputed from its labels too.
+func (app *App) reconcile(client dockerAPI, relabel bool) error {
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: false})
+	if err != nil {
+		return err
+	}
+	added, moved, removed := 0, 0, 0
+	running := make(map[string]bool, len(containers))
+	for _, listed := range containers {
+		container, err := client.InspectContainer(listed.ID)
+		if err != nil {
+			slog.Warn("Could not inspect container", "container_id", listed.ID, "error", err)
+			// Keep its names rather than removing a container that may well be running
+			running[listed.ID] = true
+			continue
+		}
+		if !container.State.Running {
+			continue
+		}
+		running[container.ID] = true
+		app.cancelRemoval(container.ID)
+
+		app.RLock()
+		_, registered := app.idToDomains[container.ID]
+		oldIP, paused := app.idToIp[container.ID], app.paused[container.ID]
+		app.RUnlock()
+		if !registered {
+			if app.addInspected(container, "start") {
+				slog.Info("Reconcile registered a missed container", "container_id", container.ID)
+				app.setPaused(container.ID, container.State.Paused)
+				added++
+			}
+			continue
+		}
+		if relabel {
+			app.updateInspected(container)
+			continue
+		}
+		if ip := getContainerIP(app, container); ip != oldIP {
+			slog.Info("Reconcile found a container whose IP changed", "container_id", container.ID, "old_ip", oldIP, "ip", ip)
+			app.refreshContainer(client, container.ID)
+			moved++
+		}
+		if container.State.Paused != paused {
+			app.setPaused(container.ID, container.State.Paused)
+		}
+	}
+
+	app.RLock()
+	orphans := []string{}
+	for ID := range app.idToDomains {
+		// Swarm services and the host alias aren't containers
+		if strings.HasPrefix(ID, service_id_prefix) || ID == host_alias_id {
+			continue
+		}
+		if !running[ID] {
+			orphans = append(orphans, ID)
+		}
+	}
+	app.RUnlock()
+	for _, ID := range orphans {
+		// Left for -removal-grace to remove
+		if app.removals.pending(ID) {
+			continue
+		}
+		domains := app.dropContainer(ID, "stop")
+		slog.Info("Reconcile removed a container that isn't running", "container_id", ID, "fqdns", domains)
+		removed++
+	}
+
+	if added+moved+removed > 0 {
+		slog.Info("Reconciled containers", "added", added, "moved", moved, "removed", removed)
+	} else {
+		slog.Debug("Reconciled containers, nothing changed", "running", len(running))
+	}
+	return nil
+}
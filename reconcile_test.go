@@ -0,0 +1,16 @@
+package cjsocks
+
+import "testing"
+
+func TestReconcile(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+	// Registered, but its die event was missed
+	app.registerContainer("gone1", containerMeta{}, []string{"gone.container"}, "172.17.0.3")
+
+	if err := app.reconcile(f, false); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	assertRegistered(t, app, registration{ID: "web1", ip: "172.17.0.2", domains: []string{"web.container"}})
+}
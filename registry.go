@@ -0,0 +1,198 @@
+package cjsocks
+
+// Where the FQDN to IP map is kept.  In memory by default, or in Redis (-registry redis://...) so several
+// cjsocks instances, and entries added by hand, share the same names.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redis_registry_key is the Redis hash holding the FQDN to IP map
+const redis_registry_key string = "cjsocks:domains"
+
+// redis_timeout bounds each Redis command, so an unreachable server doesn't stall resolution
+const redis_timeout = 2 * time.Second
+
+// registry_cache_ttl and registry_cache_size bound the lookups in a shared registry that are cached locally
+const registry_cache_ttl = 5 * time.Second
+const registry_cache_size = 1024
+
+// Registry stores the IP registered for each lower case FQDN.  Implementations must be safe for concurrent use.
+type Registry interface {
+	Set(fqdn string, ip string) error
+	Delete(fqdn string) error
+	Get(fqdn string) (string, error) // "" if fqdn isn't registered
+	List() (map[string]string, error)
+}
+
+// newRegistry returns the registry for rawURL.  "" keeps the names in memory.
+func newRegistry(rawURL string) (Registry, error) {
+	if rawURL == "" {
+		return newMemoryRegistry(), nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry %q: %w", rawURL, err)
+	}
+	switch u.Scheme {
+	case "memory":
+		return newMemoryRegistry(), nil
+	case "redis", "rediss":
+		r, err := newRedisRegistry(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		return newCachedRegistry(r, registry_cache_ttl, registry_cache_size), nil
+	}
+	return nil, fmt.Errorf("unsupported registry %q: use redis://host:port/db", rawURL)
+}
+
+// memoryRegistry keeps the names in a map, private to this instance
+type memoryRegistry struct {
+	sync.RWMutex
+	domains map[string]string
+}
+
+func newMemoryRegistry() *memoryRegistry {
+	return &memoryRegistry{domains: make(map[string]string)}
+}
+
+func (r *memoryRegistry) Set(fqdn string, ip string) error {
+	r.Lock()
+	defer r.Unlock()
+	r.domains[fqdn] = ip
+	return nil
+}
+
+func (r *memoryRegistry) Delete(fqdn string) error {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.domains, fqdn)
+	return nil
+}
+
+func (r *memoryRegistry) Get(fqdn string) (string, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.domains[fqdn], nil
+}
+
+func (r *memoryRegistry) List() (map[string]string, error) {
+	r.RLock()
+	defer r.RUnlock()
+	domains := make(map[string]string, len(r.domains))
+	for fqdn, ip := range r.domains {
+		domains[fqdn] = ip
+	}
+	return domains, nil
+}
+
+// cachedRegistry caches the lookups of a shared registry, names it doesn't have included, so resolving a name
+// that isn't a container doesn't wait on Redis each time.  Changes made through it are seen straight away, and
+// changes made by other instances once the cached lookup expires.
+type cachedRegistry struct {
+	Registry
+	cache *resolveCache // An empty IP is a name the registry doesn't have
+}
+
+func newCachedRegistry(r Registry, ttl time.Duration, size int) *cachedRegistry {
+	return &cachedRegistry{Registry: r, cache: newResolveCache(ttl, size)}
+}
+
+func (r *cachedRegistry) Set(fqdn string, ip string) error {
+	if err := r.Registry.Set(fqdn, ip); err != nil {
+		r.cache.drop(fqdn)
+		return err
+	}
+	r.cache.put(fqdn, registryIP(ip))
+	return nil
+}
+
+func (r *cachedRegistry) Delete(fqdn string) error {
+	if err := r.Registry.Delete(fqdn); err != nil {
+		r.cache.drop(fqdn)
+		return err
+	}
+	r.cache.put(fqdn, net.IP{})
+	return nil
+}
+
+func (r *cachedRegistry) Get(fqdn string) (string, error) {
+	if ip := r.cache.get(fqdn); ip != nil {
+		if len(ip) == 0 {
+			return "", nil
+		}
+		return ip.String(), nil
+	}
+	ip, err := r.Registry.Get(fqdn)
+	if err != nil {
+		return "", err
+	}
+	r.cache.put(fqdn, registryIP(ip))
+	return ip, nil
+}
+
+// registryIP parses an IP from the registry for the cache.  Anything that isn't an address, "" included, is
+// cached as a name the registry doesn't have.
+func registryIP(ip string) net.IP {
+	if addr := net.ParseIP(ip); addr != nil {
+		return addr
+	}
+	return net.IP{}
+}
+
+// redisRegistry keeps the names in a Redis hash shared by every instance using the same server
+type redisRegistry struct {
+	client *redis.Client
+}
+
+// newRedisRegistry connects to the Redis server at rawURL and checks it answers
+func newRedisRegistry(rawURL string) (*redisRegistry, error) {
+	options, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry %q: %w", rawURL, err)
+	}
+	r := &redisRegistry{client: redis.NewClient(options)}
+	ctx, cancel := context.WithTimeout(context.Background(), redis_timeout)
+	defer cancel()
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		r.client.Close()
+		return nil, fmt.Errorf("could not reach the registry at %v: %w", options.Addr, err)
+	}
+	return r, nil
+}
+
+func (r *redisRegistry) Set(fqdn string, ip string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redis_timeout)
+	defer cancel()
+	return r.client.HSet(ctx, redis_registry_key, fqdn, ip).Err()
+}
+
+func (r *redisRegistry) Delete(fqdn string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redis_timeout)
+	defer cancel()
+	return r.client.HDel(ctx, redis_registry_key, fqdn).Err()
+}
+
+func (r *redisRegistry) Get(fqdn string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redis_timeout)
+	defer cancel()
+	ip, err := r.client.HGet(ctx, redis_registry_key, fqdn).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return ip, err
+}
+
+func (r *redisRegistry) List() (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redis_timeout)
+	defer cancel()
+	return r.client.HGetAll(ctx, redis_registry_key).Result()
+}
@@ -0,0 +1,183 @@
+package cjsocks
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockRegistry is an in memory Registry that records the calls made to it
+type mockRegistry struct {
+	*memoryRegistry
+	sync.Mutex
+	calls []string
+	err   error // Returned by every call when set
+}
+
+func newMockRegistry() *mockRegistry {
+	return &mockRegistry{memoryRegistry: newMemoryRegistry()}
+}
+
+func (r *mockRegistry) record(call string) error {
+	r.Lock()
+	defer r.Unlock()
+	r.calls = append(r.calls, call)
+	return r.err
+}
+
+// takeCalls returns the calls made since the last takeCalls
+func (r *mockRegistry) takeCalls() []string {
+	r.Lock()
+	defer r.Unlock()
+	calls := r.calls
+	r.calls = nil
+	return calls
+}
+
+func (r *mockRegistry) Set(fqdn string, ip string) error {
+	if err := r.record("Set " + fqdn + " " + ip); err != nil {
+		return err
+	}
+	return r.memoryRegistry.Set(fqdn, ip)
+}
+
+func (r *mockRegistry) Delete(fqdn string) error {
+	if err := r.record("Delete " + fqdn); err != nil {
+		return err
+	}
+	return r.memoryRegistry.Delete(fqdn)
+}
+
+func (r *mockRegistry) Get(fqdn string) (string, error) {
+	if err := r.record("Get " + fqdn); err != nil {
+		return "", err
+	}
+	return r.memoryRegistry.Get(fqdn)
+}
+
+func (r *mockRegistry) List() (map[string]string, error) {
+	if err := r.record("List"); err != nil {
+		return nil, err
+	}
+	return r.memoryRegistry.List()
+}
+
+// newMockRegistryApp returns an App keeping its names in a mockRegistry
+func newMockRegistryApp(t *testing.T) (*App, *mockRegistry) {
+	t.Helper()
+	app := newTestApp(t, testConfig(t))
+	registry := newMockRegistry()
+	app.registry = registry
+	return app, registry
+}
+
+func TestRegistryRegisterAndRemove(t *testing.T) {
+	app, registry := newMockRegistryApp(t)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", map[string]string{label_cj_aliases: "www"}))
+
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	assertEqual(t, "calls after start", registry.takeCalls(), []string{"Set web.container 172.17.0.2", "Set www.container 172.17.0.2"})
+
+	app.handleEvent(f, fakeEvent("die", "web1"))
+	assertEqual(t, "calls after die", registry.takeCalls(), []string{"Delete web.container", "Delete www.container"})
+	assertRegistered(t, app)
+}
+
+func TestRegistryReplicaMoves(t *testing.T) {
+	app, registry := newMockRegistryApp(t)
+	labels := map[string]string{label_docker_compose_project: "proj", label_docker_compose_service: "web"}
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "proj-web-1", "172.17.0.2", labels))
+	f.addContainer(fakeContainer("web2", "proj-web-2", "172.17.0.3", labels))
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	app.handleEvent(f, fakeEvent("start", "web2"))
+	registry.takeCalls()
+
+	// The shared name moves to the replica still running rather than disappearing
+	app.handleEvent(f, fakeEvent("die", "web1"))
+	assertEqual(t, "calls after die", registry.takeCalls(), []string{"Set web.proj.container 172.17.0.3"})
+	assertRegistered(t, app, registration{ID: "web2", ip: "172.17.0.3", domains: []string{"web.proj.container"}})
+}
+
+func TestRegistryResync(t *testing.T) {
+	app, registry := newMockRegistryApp(t)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+	f.addContainer(fakeContainer("api1", "api", "172.17.0.3", nil))
+	if err := registerRunningContainers(app, f); err != nil {
+		t.Fatalf("registerRunningContainers: %v", err)
+	}
+	// api1 went away without an event
+	f.removeContainer("api1")
+	registry.takeCalls()
+
+	count, err := app.resync(f)
+	if err != nil {
+		t.Fatalf("resync: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("resync = %v names, want 1", count)
+	}
+	// Names that didn't change keep resolving throughout
+	assertEqual(t, "calls during resync", registry.takeCalls(), []string{"Set web.container 172.17.0.2", "Delete api.container"})
+	assertRegistered(t, app, registration{ID: "web1", ip: "172.17.0.2", domains: []string{"web.container"}})
+}
+
+func TestRegistryLookupsFromOtherInstances(t *testing.T) {
+	app, registry := newMockRegistryApp(t)
+	app.strictResolve = true
+	// Registered by hand or by another instance
+	registry.memoryRegistry.Set("legacy.container", "10.0.0.5")
+
+	_, ip, err := app.Resolve(context.Background(), "legacy.container")
+	if err != nil || ip.String() != "10.0.0.5" {
+		t.Errorf("Resolve(legacy.container) = %v, %v, want 10.0.0.5", ip, err)
+	}
+
+	// A registry that can't be reached leaves the name unresolved rather than failing everything
+	registry.err = errors.New("registry is down")
+	if _, _, err := app.Resolve(context.Background(), "other.container"); err == nil {
+		t.Errorf("Resolve(other.container) with a failing registry = nil error, want not found")
+	}
+}
+
+func TestCachedRegistry(t *testing.T) {
+	backend := newMockRegistry()
+	backend.memoryRegistry.Set("other.container", "10.0.0.5")
+	r := newCachedRegistry(backend, time.Minute, 10)
+
+	// Repeated lookups, of names the registry has and doesn't have, only reach it once
+	for i := 0; i < 3; i++ {
+		if ip, err := r.Get("other.container"); ip != "10.0.0.5" || err != nil {
+			t.Errorf("Get(other.container) = %q, %v, want 10.0.0.5", ip, err)
+		}
+		if ip, err := r.Get("example.com"); ip != "" || err != nil {
+			t.Errorf("Get(example.com) = %q, %v, want not registered", ip, err)
+		}
+	}
+	assertEqual(t, "backend calls", backend.takeCalls(), []string{"Get other.container", "Get example.com"})
+
+	// Changes made through the cache are seen straight away
+	r.Set("example.com", "10.0.0.6")
+	if ip, _ := r.Get("example.com"); ip != "10.0.0.6" {
+		t.Errorf("Get(example.com) after Set = %q, want 10.0.0.6", ip)
+	}
+	r.Delete("other.container")
+	if ip, _ := r.Get("other.container"); ip != "" {
+		t.Errorf("Get(other.container) after Delete = %q, want not registered", ip)
+	}
+	assertEqual(t, "backend calls", backend.takeCalls(), []string{"Set example.com 10.0.0.6", "Delete other.container"})
+
+	// A failed change isn't cached
+	backend.err = errors.New("registry is down")
+	if err := r.Set("example.com", "10.0.0.7"); err == nil {
+		t.Errorf("Set with a failing backend = nil error")
+	}
+	backend.err = nil
+	if ip, _ := r.Get("example.com"); ip != "10.0.0.6" {
+		t.Errorf("Get(example.com) after a failed Set = %q, want 10.0.0.6", ip)
+	}
+}
@@ -0,0 +1,75 @@
+package cjsocks
+
+// Delayed removal of stopped containers (-removal-grace).  A crash looping container dies and starts again
+// within milliseconds, so its names are kept for the grace period instead of flapping in and out of DNS.
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// pendingRemovals holds a timer for each stopped container whose names are waiting to be removed
+type pendingRemovals struct {
+	sync.Mutex // Also held while a timer removes the names, so a start cancelling it waits for the removal
+	grace      time.Duration
+	timers     map[string]*time.Timer
+}
+
+func newPendingRemovals(grace time.Duration) *pendingRemovals {
+	return &pendingRemovals{grace: grace, timers: make(map[string]*time.Timer)}
+}
+
+// scheduleRemoval removes the names of container ID after the grace period, or straight away without one.
+// A second stop event for the same container restarts the wait.
+func (app *App) scheduleRemoval(ID string) {
+	if app.removals.grace <= 0 {
+		domains := app.dropContainer(ID, "stop")
+		slog.Debug("Removed domains", "container_id", ID, "fqdns", domains)
+		return
+	}
+	p := app.removals
+	p.Lock()
+	defer p.Unlock()
+	if timer, ok := p.timers[ID]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(p.grace, func() {
+		p.Lock()
+		defer p.Unlock()
+		// Cancelled, or replaced by a later stop event
+		if p.timers[ID] != timer {
+			return
+		}
+		delete(p.timers, ID)
+		domains := app.dropContainer(ID, "stop")
+		slog.Debug("Removed domains after the grace period", "container_id", ID, "fqdns", domains)
+	})
+	p.timers[ID] = timer
+	slog.Debug("Removing domains after the grace period", "container_id", ID, "grace", p.grace)
+}
+
+// pending reports whether the names of container ID are waiting for the grace period to end
+func (p *pendingRemovals) pending(ID string) bool {
+	p.Lock()
+	defer p.Unlock()
+	_, ok := p.timers[ID]
+	return ok
+}
+
+// cancelRemoval keeps the names of container ID that started again within the grace period.  Returns false
+// if no removal was pending.
+func (app *App) cancelRemoval(ID string) bool {
+	p := app.removals
+	p.Lock()
+	defer p.Unlock()
+	timer, ok := p.timers[ID]
+	if !ok {
+		return false
+	}
+	timer.Stop()
+	delete(p.timers, ID)
+	slog.Debug("Container started again within the grace period, keeping its domains", "container_id", ID)
+	return true
+}
@@ -0,0 +1,34 @@
+package cjsocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRemovalGrace(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.StrictResolve = true
+	cfg.RemovalGrace = Duration{200 * time.Millisecond}
+	app := newTestApp(t, cfg)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+	app.handleEvent(f, fakeEvent("start", "web1"))
+
+	// Started again within the grace period, the name never goes away
+	app.handleEvent(f, fakeEvent("die", "web1"))
+	if got := resolveIP(app, "web.container"); got != "172.17.0.2" {
+		t.Errorf("web.container resolved to %q during the grace period, want 172.17.0.2", got)
+	}
+	app.handleEvent(f, fakeEvent("start", "web1"))
+	time.Sleep(2 * cfg.RemovalGrace.Duration)
+	if got := resolveIP(app, "web.container"); got != "172.17.0.2" {
+		t.Errorf("web.container resolved to %q after starting again, want 172.17.0.2", got)
+	}
+	if app.removals.pending("web1") {
+		t.Error("removal of web1 still pending after it started again")
+	}
+
+	// Otherwise it goes once the grace period is over
+	app.handleEvent(f, fakeEvent("die", "web1"))
+	waitFor(t, "web.container to be removed", func() bool { return resolveIP(app, "web.container") == "" })
+}
@@ -0,0 +1,84 @@
+package cjsocks
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// resolveCache caches system DNS lookups for names that aren't containers so repeated
+// connections to the same external host don't query DNS every time.  It holds at most size
+// names and evicts the least recently used one to make room.
+type resolveCache struct {
+	sync.Mutex
+	ttl     time.Duration // 0 disables caching
+	size    int           // 0 disables caching
+	entries map[string]*list.Element
+	lru     *list.List // Of *resolveCacheEntry, most recently used first
+}
+
+type resolveCacheEntry struct {
+	name    string
+	ip      net.IP
+	expires time.Time
+}
+
+func newResolveCache(ttl time.Duration, size int) *resolveCache {
+	return &resolveCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached IP for name, or nil if it isn't cached or has expired.
+func (c *resolveCache) get(name string) net.IP {
+	c.Lock()
+	defer c.Unlock()
+	element, ok := c.entries[name]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*resolveCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(element)
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return entry.ip
+}
+
+func (c *resolveCache) put(name string, ip net.IP) {
+	if c.ttl <= 0 || c.size <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	entry := &resolveCacheEntry{name: name, ip: ip, expires: time.Now().Add(c.ttl)}
+	if element, ok := c.entries[name]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[name] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// drop forgets the cached IP for name
+func (c *resolveCache) drop(name string) {
+	c.Lock()
+	defer c.Unlock()
+	if element, ok := c.entries[name]; ok {
+		c.remove(element)
+	}
+}
+
+// remove drops an element.  The caller must hold the lock.
+func (c *resolveCache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*resolveCacheEntry).name)
+}
@@ -0,0 +1,106 @@
+package cjsocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResolveCache(t *testing.T) {
+	upstream, queries := staticDNSServer(t, map[string]string{"api.example.com.": "203.0.113.7", "web.container.": "203.0.113.9"})
+	cfg := testConfig(t)
+	cfg.UpstreamDNS = []string{upstream}
+	cfg.ResolveCacheTTL = Duration{200 * time.Millisecond}
+	app := newTestApp(t, cfg)
+
+	// However many queries one lookup takes, e.g. A and AAAA, the cached lookups take none
+	for i := 0; i < 3; i++ {
+		if got := resolveIP(app, "api.example.com"); got != "203.0.113.7" {
+			t.Fatalf("api.example.com resolved to %q, want 203.0.113.7", got)
+		}
+	}
+	perLookup := queries.Load()
+	if perLookup == 0 {
+		t.Fatal("the upstream DNS server wasn't queried")
+	}
+
+	time.Sleep(2 * cfg.ResolveCacheTTL.Duration)
+	if got := resolveIP(app, "api.example.com"); got != "203.0.113.7" {
+		t.Fatalf("api.example.com resolved to %q after expiry, want 203.0.113.7", got)
+	}
+	if got := queries.Load(); got != 2*perLookup {
+		t.Errorf("%v upstream queries after the cached entry expired, want %v", got, 2*perLookup)
+	}
+
+	// Container names never go upstream or to the cache
+	app.registerContainer("web1", containerMeta{}, []string{"web.container"}, "172.17.0.2")
+	before := queries.Load()
+	for i := 0; i < 2; i++ {
+		if got := resolveIP(app, "web.container"); got != "172.17.0.2" {
+			t.Errorf("web.container resolved to %q, want the container's 172.17.0.2", got)
+		}
+	}
+	if got := queries.Load(); got != before {
+		t.Errorf("resolving a container name made %v upstream queries", got-before)
+	}
+	if cached := app.resolveCache.get("web.container"); cached != nil {
+		t.Errorf("web.container cached as %v", cached)
+	}
+}
+
+func TestResolveCacheDisabled(t *testing.T) {
+	upstream, queries := staticDNSServer(t, map[string]string{"api.example.com.": "203.0.113.7"})
+	cfg := testConfig(t)
+	cfg.UpstreamDNS = []string{upstream}
+	cfg.ResolveCacheTTL = Duration{0}
+	app := newTestApp(t, cfg)
+	for i := 0; i < 2; i++ {
+		if _, _, err := app.Resolve(context.Background(), "api.example.com"); err != nil {
+			t.Fatalf("Resolve: %v", err)
+		}
+	}
+	first := queries.Load() / 2
+	if first == 0 || queries.Load() != 2*first {
+		t.Errorf("%v upstream queries for 2 lookups without a cache, want the same number for each", queries.Load())
+	}
+}
+
+func TestResolveCacheEviction(t *testing.T) {
+	c := newResolveCache(time.Minute, 3)
+	for i := 1; i <= 3; i++ {
+		c.put(fmt.Sprintf("host%d.example.com", i), net.IPv4(203, 0, 113, byte(i)))
+	}
+	// Used, so host2 is now the least recently used
+	c.get("host1.example.com")
+	c.put("host4.example.com", net.IPv4(203, 0, 113, 4))
+	c.put("host5.example.com", net.IPv4(203, 0, 113, 5))
+
+	for name, want := range map[string]string{
+		"host1.example.com": "203.0.113.1",
+		"host2.example.com": "<nil>",
+		"host3.example.com": "<nil>",
+		"host4.example.com": "203.0.113.4",
+		"host5.example.com": "203.0.113.5",
+	} {
+		if got := c.get(name).String(); got != want {
+			t.Errorf("get(%v) = %v, want %v", name, got, want)
+		}
+	}
+	if len(c.entries) != 3 || c.lru.Len() != 3 {
+		t.Errorf("%v entries, %v in the LRU list, want 3", len(c.entries), c.lru.Len())
+	}
+
+	// Container names aren't in the cache, so they can't be evicted
+	cfg := testConfig(t)
+	cfg.ResolveCacheSize = 1
+	app := newTestApp(t, cfg)
+	app.registerContainer("web1", containerMeta{}, []string{"web.container"}, "172.17.0.2")
+	for _, name := range []string{"host1.example.com", "host2.example.com"} {
+		app.resolveCache.put(name, net.IPv4(203, 0, 113, 1))
+	}
+	if got := resolveIP(app, "web.container"); got != "172.17.0.2" {
+		t.Errorf("web.container resolved to %q with the cache full, want 172.17.0.2", got)
+	}
+}
@@ -0,0 +1,54 @@
+package cjsocks
+
+// Errors returned by Resolve, so callers can tell a name that doesn't exist from a refused destination or
+// a DNS server that didn't answer.
+
+import (
+	"errors"
+	"net"
+)
+
+// ResolveReason is why a name could not be resolved
+type ResolveReason int
+
+const (
+	ResolveNotFound        ResolveReason = iota + 1 // No container has the name and DNS doesn't know it, or its containers are paused
+	ResolveDenied                                   // The name resolved to an address the allow and deny lists refuse
+	ResolveUpstreamFailure                          // The upstream DNS servers or the system resolver failed
+)
+
+func (r ResolveReason) String() string {
+	switch r {
+	case ResolveNotFound:
+		return "not found"
+	case ResolveDenied:
+		return "denied"
+	case ResolveUpstreamFailure:
+		return "upstream failure"
+	}
+	return "unknown"
+}
+
+// ResolveError is the error Resolve returns.  Err is the underlying error, also available with errors.Unwrap.
+type ResolveError struct {
+	Name   string
+	Reason ResolveReason
+	Err    error
+}
+
+func (e *ResolveError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ResolveError) Unwrap() error {
+	return e.Err
+}
+
+// lookupError classifies an error from lookupHost.  Names DNS reports as missing are ResolveNotFound.
+func lookupError(name string, err error) *ResolveError {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return &ResolveError{Name: name, Reason: ResolveNotFound, Err: err}
+	}
+	return &ResolveError{Name: name, Reason: ResolveUpstreamFailure, Err: err}
+}
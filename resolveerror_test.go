@@ -0,0 +1,95 @@
+package cjsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// nxdomainServer starts a DNS server on a loopback port that answers every query with NXDOMAIN
+func nxdomainServer(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+func TestResolveErrorReasons(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    func(t *testing.T, cfg *Config)
+		setup  func(app *App)
+		lookup string
+		want   ResolveReason
+	}{
+		{
+			name:   "denied",
+			cfg:    func(t *testing.T, cfg *Config) { cfg.DenyCIDR = []string{"10.0.0.0/8"} },
+			setup:  func(app *App) { app.registerContainer("web1", containerMeta{}, []string{"web.container"}, "10.1.2.3") },
+			lookup: "web.container",
+			want:   ResolveDenied,
+		},
+		{
+			name:   "unreachable upstream",
+			cfg:    func(t *testing.T, cfg *Config) { cfg.UpstreamDNS = []string{"127.0.0.1:1"} },
+			lookup: "example.com",
+			want:   ResolveUpstreamFailure,
+		},
+		{
+			name:   "unknown name",
+			cfg:    func(t *testing.T, cfg *Config) { cfg.UpstreamDNS = []string{nxdomainServer(t)} },
+			lookup: "missing.example.com",
+			want:   ResolveNotFound,
+		},
+		{
+			name:   "unknown name with strict resolution",
+			cfg:    func(t *testing.T, cfg *Config) { cfg.StrictResolve = true },
+			lookup: "missing.example.com",
+			want:   ResolveNotFound,
+		},
+		{
+			name: "paused container",
+			setup: func(app *App) {
+				app.registerContainer("web1", containerMeta{}, []string{"web.container"}, "172.17.0.2")
+				app.setPaused("web1", true)
+			},
+			lookup: "web.container",
+			want:   ResolveNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			if tt.cfg != nil {
+				tt.cfg(t, &cfg)
+			}
+			app := newTestApp(t, cfg)
+			if tt.setup != nil {
+				tt.setup(app)
+			}
+			_, ip, err := app.Resolve(context.Background(), tt.lookup)
+			var resolveErr *ResolveError
+			if !errors.As(err, &resolveErr) {
+				t.Fatalf("Resolve(%q) = %v, %v, want a *ResolveError", tt.lookup, ip, err)
+			}
+			if resolveErr.Reason != tt.want {
+				t.Errorf("Resolve(%q) reason = %v (%v), want %v", tt.lookup, resolveErr.Reason, err, tt.want)
+			}
+			if resolveErr.Name != tt.lookup {
+				t.Errorf("Resolve(%q) error name = %q", tt.lookup, resolveErr.Name)
+			}
+		})
+	}
+}
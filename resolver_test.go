@@ -0,0 +1,63 @@
+package cjsocks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+)
+
+// stubResolver resolves every name to 127.0.0.1 and records the names
+type stubResolver struct {
+	sync.Mutex
+	names []string
+}
+
+func (r *stubResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.names = append(r.names, name)
+	return ctx, net.IPv4(127, 0, 0, 1), nil
+}
+
+func TestSetResolver(t *testing.T) {
+	cfg := socksTestConfig(t)
+	app := newTestApp(t, cfg)
+	stub := &stubResolver{}
+	app.SetResolver(stub)
+	startApp(t, app)
+
+	_, port, _ := net.SplitHostPort(echoServer(t).Addr().String())
+	conn := dialSocks(t, cfg, net.JoinHostPort("stub.test", port))
+	defer conn.Close()
+	echo(t, conn, "ping")
+
+	stub.Lock()
+	defer stub.Unlock()
+	assertEqual(t, "resolved names", stub.names, []string{"stub.test"})
+}
+
+func TestSetResolverFallsBack(t *testing.T) {
+	app := newTestApp(t, testConfig(t))
+	app.registerContainer("web1", containerMeta{}, []string{"web.container"}, "172.17.0.2")
+	// A resolver that only knows one name and leaves the rest to the App
+	app.SetResolver(resolverFunc(func(ctx context.Context, name string) (context.Context, net.IP, error) {
+		if name == "special.test" {
+			return ctx, net.IPv4(10, 0, 0, 1), nil
+		}
+		return app.Resolve(ctx, name)
+	}))
+	for name, want := range map[string]string{"special.test": "10.0.0.1", "web.container": "172.17.0.2"} {
+		_, ip, err := app.resolver.Resolve(context.Background(), name)
+		if err != nil || ip.String() != want {
+			t.Errorf("Resolve(%q) = %v, %v, want %v", name, ip, err, want)
+		}
+	}
+}
+
+// resolverFunc makes a function a Resolver
+type resolverFunc func(ctx context.Context, name string) (context.Context, net.IP, error)
+
+func (f resolverFunc) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return f(ctx, name)
+}
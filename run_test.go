@@ -0,0 +1,328 @@
+package cjsocks
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestRunUntilDockerIsReachable(t *testing.T) {
+	f := newFakeDocker()
+	f.setPingErr(errors.New("fake docker daemon is unreachable"))
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+	cfg := socksTestConfig(t)
+	app := newTestApp(t, cfg)
+	app.dockerClient = func() (dockerAPI, error) { return f, nil }
+	stop := startApp(t, app)
+
+	// The socks5 server serves names that aren't containers meanwhile
+	conn := dialSocks(t, cfg, echoServer(t).Addr().String())
+	echo(t, conn, "ping")
+	conn.Close()
+	if n := f.called("CreateNetwork"); n != 0 {
+		t.Errorf("CreateNetwork called %v times while docker was unreachable", n)
+	}
+	assertRegistered(t, app)
+
+	f.setPingErr(nil)
+	waitFor(t, "the docker events listener", app.ready.Load)
+	if n := f.called("CreateNetwork"); n != 1 {
+		t.Errorf("CreateNetwork called %v times, want 1", n)
+	}
+	if _, err := f.NetworkInfo(cfg.CJNetworkName); err != nil {
+		t.Errorf("cj network wasn't created: %v", err)
+	}
+	web := registration{ID: "web1", ip: "172.17.0.2", domains: []string{"web.container"}}
+	assertRegistered(t, app, web)
+
+	f.addContainer(fakeContainer("api1", "api", "172.17.0.3", nil))
+	f.send(fakeEvent("start", "api1"))
+	waitFor(t, "the start event", func() bool {
+		app.RLock()
+		defer app.RUnlock()
+		return len(app.idToDomains["api1"]) > 0
+	})
+	assertRegistered(t, app, web, registration{ID: "api1", ip: "172.17.0.3", domains: []string{"api.container"}})
+
+	if err := stop(); err != nil {
+		t.Errorf("Run = %v, want nil", err)
+	}
+	if n := f.listening(); n != 0 {
+		t.Errorf("%v event listeners left after Run returned", n)
+	}
+}
+
+func TestRunRetriesBindingAnAddressInUse(t *testing.T) {
+	logs := captureLogs(t)
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer taken.Close()
+	cfg := socksTestConfig(t)
+	cfg.UnixSocket = ""
+	cfg.ListenIP = "127.0.0.1"
+	cfg.Port = taken.Addr().(*net.TCPAddr).Port
+	cfg.BindRetries = 5
+	cfg.BindRetryDelay = Duration{50 * time.Millisecond}
+	startApp(t, newTestApp(t, cfg))
+
+	waitFor(t, "a retry", func() bool { return len(logs.records("Address is in use")) > 0 })
+	taken.Close()
+	conn := dialSocks(t, cfg, echoServer(t).Addr().String())
+	echo(t, conn, "ping")
+	conn.Close()
+}
+
+func TestRunGivesUpBindingAnAddressInUse(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer taken.Close()
+	cfg := socksTestConfig(t)
+	cfg.UnixSocket = ""
+	cfg.ListenIP = "127.0.0.1"
+	cfg.Port = taken.Addr().(*net.TCPAddr).Port
+	cfg.BindRetries = 2
+	cfg.BindRetryDelay = Duration{10 * time.Millisecond}
+
+	err = newTestApp(t, cfg).Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "could not listen on "+cfg.listenAddr()) || !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("Run = %v, want the address in use reported", err)
+	}
+}
+
+func TestRunReconnectsToEvents(t *testing.T) {
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", nil))
+	cfg := socksTestConfig(t)
+	app := newTestApp(t, cfg)
+	app.dockerClient = func() (dockerAPI, error) { return f, nil }
+	startApp(t, app)
+	waitFor(t, "the docker events listener", app.ready.Load)
+
+	f.dropListeners()
+	waitFor(t, "the event stream to be noticed closed", func() bool { return !app.ready.Load() })
+	// Missed while disconnected
+	f.addContainer(fakeContainer("api1", "api", "172.17.0.3", nil))
+	waitFor(t, "the docker events listener to reconnect", app.ready.Load)
+	if n := f.called("AddEventListener"); n != 2 {
+		t.Errorf("AddEventListener called %v times, want 2", n)
+	}
+	if n := f.listening(); n != 1 {
+		t.Errorf("%v event listeners after reconnecting, want 1", n)
+	}
+	web := registration{ID: "web1", ip: "172.17.0.2", domains: []string{"web.container"}}
+	api := registration{ID: "api1", ip: "172.17.0.3", domains: []string{"api.container"}}
+	assertRegistered(t, app, web, api)
+
+	// Events arrive on the new listener
+	f.addContainer(fakeContainer("db1", "db", "172.17.0.4", nil))
+	f.send(fakeEvent("start", "db1"))
+	waitFor(t, "the start event", func() bool {
+		app.RLock()
+		defer app.RUnlock()
+		return len(app.idToDomains["db1"]) > 0
+	})
+}
+
+func TestDockerHost(t *testing.T) {
+	t.Setenv("DOCKER_HOST", "tcp://docker.internal:2375")
+	for args, want := range map[string]string{
+		"": "tcp://docker.internal:2375",
+		"-docker-host=unix:///run/user/docker.sock": "unix:///run/user/docker.sock",
+	} {
+		cfg, err := ParseFlags(strings.Fields(args))
+		if err != nil {
+			t.Fatalf("ParseFlags(%v): %v", args, err)
+		}
+		if cfg.DockerHost != want {
+			t.Errorf("ParseFlags(%v) docker host = %q, want %q", args, cfg.DockerHost, want)
+		}
+	}
+
+	cfg := socksTestConfig(t)
+	cfg.DockerHost = "ftp://docker.internal"
+	err := newTestApp(t, cfg).Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), `invalid docker endpoint "ftp://docker.internal"`) {
+		t.Errorf("Run = %v, want the invalid docker endpoint reported", err)
+	}
+
+	// Unreachable is only a warning, see TestRunWithoutDocker
+	logs := captureLogs(t)
+	cfg = socksTestConfig(t)
+	startApp(t, newTestApp(t, cfg))
+	waitFor(t, "the unreachable daemon to be reported", func() bool {
+		for _, record := range logs.records("Could not reach the docker daemon.  Container names won't resolve until it is reachable (is the docker socket mounted?  Use -docker-host or DOCKER_HOST to change it)") {
+			if record["docker_host"] == cfg.DockerHost && record["error"] != nil {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// writeCertificate writes a self signed client certificate and its key to dir and returns their paths
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cjsocks"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestDockerTLS(t *testing.T) {
+	// A docker daemon that only answers clients presenting a certificate
+	var clientCerts atomic.Int64
+	daemon := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCerts.Add(int64(len(r.TLS.PeerCertificates)))
+		w.Write([]byte("OK"))
+	}))
+	daemon.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	daemon.StartTLS()
+	defer daemon.Close()
+
+	certPath := t.TempDir()
+	certFile, keyFile := writeCertificate(t, certPath)
+	caFile := filepath.Join(certPath, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: daemon.Certificate().Raw}), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// The certificates default to DOCKER_CERT_PATH when DOCKER_TLS_VERIFY is set
+	t.Setenv("DOCKER_TLS_VERIFY", "1")
+	t.Setenv("DOCKER_CERT_PATH", certPath)
+	t.Setenv("DOCKER_HOST", "tcp://"+daemon.Listener.Addr().String())
+	cfg, err := ParseFlags(nil)
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	assertEqual(t, "docker TLS files", []string{cfg.DockerTLSCert, cfg.DockerTLSKey, cfg.DockerTLSCA}, []string{certFile, keyFile, caFile})
+	client, err := newDockerClient(cfg)
+	if err != nil {
+		t.Fatalf("newDockerClient: %v", err)
+	}
+	if err := pingDocker(cfg, client); err != nil {
+		t.Fatalf("pingDocker: %v", err)
+	}
+	if clientCerts.Load() == 0 {
+		t.Error("the docker daemon got no client certificate")
+	}
+
+	// Missing files fail before contacting the daemon
+	missing := cfg
+	missing.DockerTLSKey = ""
+	if _, err := newDockerClient(missing); err == nil || !strings.Contains(err.Error(), "-docker-tls-key is not set") {
+		t.Errorf("newDockerClient without a key = %v, want the missing key reported", err)
+	}
+	missing = cfg
+	missing.DockerTLSCA = filepath.Join(certPath, "missing.pem")
+	if _, err := newDockerClient(missing); err == nil || !strings.Contains(err.Error(), "-docker-tls-ca") {
+		t.Errorf("newDockerClient with a missing CA file = %v, want the missing file reported", err)
+	}
+}
+
+func TestDockerTimeout(t *testing.T) {
+	// A docker daemon that never answers
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer daemon.Close()
+	client, err := docker.NewClient(daemon.URL)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	logs := captureLogs(t)
+	timeout := 200 * time.Millisecond
+	slow := withDockerTimeout(client, timeout)
+
+	calls := map[string]func() error{
+		"inspect container": func() error { _, err := slow.InspectContainer("web1"); return err },
+		"list containers":   func() error { _, err := slow.ListContainers(docker.ListContainersOptions{}); return err },
+		"ping":              slow.Ping,
+	}
+	for name, call := range calls {
+		start := time.Now()
+		if err := call(); err == nil {
+			t.Errorf("%v = nil error from a daemon that never answers", name)
+		}
+		if elapsed := time.Since(start); elapsed > 10*timeout {
+			t.Errorf("%v abandoned after %v, want about %v", name, elapsed, timeout)
+		}
+	}
+	var logged []string
+	for _, record := range logs.records("Docker call timed out") {
+		logged = append(logged, fmt.Sprint(record["call"]))
+	}
+	sort.Strings(logged)
+	assertEqual(t, "timed out calls logged", logged, []string{"inspect container", "list containers", "ping"})
+}
+
+func TestUnixSocket(t *testing.T) {
+	cfg := socksTestConfig(t)
+	// Left behind by a cjsocks that didn't shut down cleanly
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: cfg.UnixSocket, Net: "unix"})
+	if err != nil {
+		t.Fatalf("ListenUnix: %v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	startApp(t, newTestApp(t, cfg))
+	conn := dialSocks(t, cfg, echoServer(t).Addr().String())
+	defer conn.Close()
+	echo(t, conn, "ping")
+
+	info, err := os.Stat(cfg.UnixSocket)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != unix_socket_mode {
+		t.Errorf("socket mode = %v, want a socket with permissions %v", info.Mode(), unix_socket_mode)
+	}
+}
@@ -0,0 +1,121 @@
+package cjsocks
+
+// Label selectors for -label-selector, a subset of the Kubernetes syntax.  A selector is a comma separated
+// list of requirements that must all match:
+//   key=value, key==value  the label is set to value
+//   key!=value             the label is missing or set to something else
+//   key in (a,b)           the label is set to one of the values
+//   key notin (a,b)        the label is missing or set to none of the values
+//   key                    the label is set
+//   !key                   the label is missing
+
+import (
+	"fmt"
+	"strings"
+)
+
+type labelSelector []labelRequirement
+
+type labelRequirement struct {
+	key    string
+	op     string // One of =, !=, in, notin, exists or !exists
+	values []string
+}
+
+// parseLabelSelector parses a selector.  An empty selector matches every container.
+func parseLabelSelector(selector string) (labelSelector, error) {
+	var requirements labelSelector
+	for _, part := range splitSelector(selector) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		requirement, err := parseLabelRequirement(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label selector %q: %w", selector, err)
+		}
+		requirements = append(requirements, requirement)
+	}
+	return requirements, nil
+}
+
+// splitSelector splits a selector at the commas that aren't inside the parentheses of an in or notin list
+func splitSelector(selector string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, selector[start:])
+}
+
+func parseLabelRequirement(part string) (labelRequirement, error) {
+	if i := strings.Index(part, "!="); i >= 0 {
+		return newLabelRequirement(part[:i], "!=", part[i+2:])
+	}
+	if i := strings.Index(part, "=="); i >= 0 {
+		return newLabelRequirement(part[:i], "=", part[i+2:])
+	}
+	if i := strings.Index(part, "="); i >= 0 {
+		return newLabelRequirement(part[:i], "=", part[i+1:])
+	}
+	if fields := strings.Fields(part); len(fields) >= 2 && (fields[1] == "in" || fields[1] == "notin") {
+		list := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(part[len(fields[0]):]), fields[1]))
+		if !strings.HasPrefix(list, "(") || !strings.HasSuffix(list, ")") {
+			return labelRequirement{}, fmt.Errorf("%q needs a parenthesized list of values", part)
+		}
+		values := []string{}
+		for _, value := range strings.Split(list[1:len(list)-1], ",") {
+			values = append(values, strings.TrimSpace(value))
+		}
+		return labelRequirement{key: fields[0], op: fields[1], values: values}, nil
+	}
+	key, op := part, "exists"
+	if strings.HasPrefix(key, "!") {
+		key, op = strings.TrimSpace(key[1:]), "!exists"
+	}
+	if key == "" || strings.ContainsAny(key, " ()!") {
+		return labelRequirement{}, fmt.Errorf("%q is not a label requirement", part)
+	}
+	return labelRequirement{key: key, op: op}, nil
+}
+
+func newLabelRequirement(key string, op string, value string) (labelRequirement, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return labelRequirement{}, fmt.Errorf("missing label name before %v", op)
+	}
+	return labelRequirement{key: key, op: op, values: []string{strings.TrimSpace(value)}}, nil
+}
+
+// matches reports whether labels meet every requirement
+func (s labelSelector) matches(labels map[string]string) bool {
+	for _, requirement := range s {
+		value, ok := labels[requirement.key]
+		var match bool
+		switch requirement.op {
+		case "=", "in":
+			match = ok && containsString(requirement.values, value)
+		case "!=", "notin":
+			match = !ok || !containsString(requirement.values, value)
+		case "exists":
+			match = ok
+		case "!exists":
+			match = !ok
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package cjsocks
+
+import "testing"
+
+func TestLabelSelector(t *testing.T) {
+	web := map[string]string{"tier": "web", "env": "prod"}
+	db := map[string]string{"tier": "db"}
+	none := map[string]string{}
+	tests := []struct {
+		selector string
+		match    []map[string]string
+		noMatch  []map[string]string
+	}{
+		{selector: "", match: []map[string]string{web, db, none}},
+		{selector: "tier=web", match: []map[string]string{web}, noMatch: []map[string]string{db, none}},
+		{selector: "tier == web", match: []map[string]string{web}, noMatch: []map[string]string{db, none}},
+		{selector: "tier!=web", match: []map[string]string{db, none}, noMatch: []map[string]string{web}},
+		{selector: "tier in (web, db)", match: []map[string]string{web, db}, noMatch: []map[string]string{none}},
+		{selector: "tier notin (web)", match: []map[string]string{db, none}, noMatch: []map[string]string{web}},
+		{selector: "env", match: []map[string]string{web}, noMatch: []map[string]string{db, none}},
+		{selector: "!env", match: []map[string]string{db, none}, noMatch: []map[string]string{web}},
+		{selector: "env=prod,tier in (web,api)", match: []map[string]string{web}, noMatch: []map[string]string{db, none}},
+		{selector: "tier in (db,api), !env", match: []map[string]string{db}, noMatch: []map[string]string{web, none}},
+	}
+	for _, tt := range tests {
+		selector, err := parseLabelSelector(tt.selector)
+		if err != nil {
+			t.Errorf("parseLabelSelector(%q): %v", tt.selector, err)
+			continue
+		}
+		for _, labels := range tt.match {
+			if !selector.matches(labels) {
+				t.Errorf("%q doesn't match %v, want a match", tt.selector, labels)
+			}
+		}
+		for _, labels := range tt.noMatch {
+			if selector.matches(labels) {
+				t.Errorf("%q matches %v, want no match", tt.selector, labels)
+			}
+		}
+	}
+}
+
+func TestLabelSelectorCommasInParentheses(t *testing.T) {
+	selector, err := parseLabelSelector("tier in (web,api,db),env")
+	if err != nil {
+		t.Fatalf("parseLabelSelector: %v", err)
+	}
+	assertEqual(t, "requirements", len(selector), 2)
+	assertEqual(t, "values", selector[0].values, []string{"web", "api", "db"})
+}
+
+func TestLabelSelectorInvalid(t *testing.T) {
+	for _, selector := range []string{
+		"=web",
+		"!=web",
+		"tier in web",
+		"tier in (web",
+		"tier notin web)",
+		"two words",
+		"!",
+		"tier=web,(x)",
+	} {
+		if _, err := parseLabelSelector(selector); err == nil {
+			t.Errorf("parseLabelSelector(%q) = nil error, want invalid", selector)
+		}
+	}
+}
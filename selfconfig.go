@@ -0,0 +1,114 @@
+package cjsocks
+
+// Options from the labels of the cjsocks container itself, e.g. in a compose file:
+//   labels:
+//     org.cj-tools.hosts.config.base_domain: test
+// They only set options that no flag, environment variable or config file key set, so those win.
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// label_cj_config_prefix starts the labels configuring cjsocks when set on its own container.  The rest of the
+// label is the option's config file key.
+const label_cj_config_prefix string = "org.cj-tools.hosts.config."
+
+// selfOptions are the options the labels can set: their config file key, flag and environment variable
+var selfOptions = []struct{ key, flag, env string }{
+	{"base_domain", "basedomain", "CJ_BASE_DOMAIN"},
+	{"cj_network", "cj-network", "CJ_NETWORK"},
+	{"auto_add", "autoadd", "CJ_AUTO_ADD"},
+}
+
+// explicitOptions returns the keys of the options the labels can set that were set on the command line in fs,
+// in the config file (fileKeys) or in the environment.  Set to its default value still counts.
+func explicitOptions(fs *flag.FlagSet, fileKeys map[string]bool) map[string]bool {
+	flags := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { flags[f.Name] = true })
+	explicit := map[string]bool{}
+	for _, option := range selfOptions {
+		if flags[option.flag] || fileKeys[option.key] || os.Getenv(option.env) != "" {
+			explicit[option.key] = true
+		}
+	}
+	return explicit
+}
+
+// SelfConfig returns cfg with the options set by the labels on the container cjsocks runs in, except those
+// ParseFlags found set elsewhere.  Outside a container, or when docker can't be reached, cfg is returned unchanged.
+func SelfConfig(cfg Config) Config {
+	client, err := newDockerClient(cfg)
+	if err != nil {
+		slog.Debug("Not reading labels on own container", "error", err)
+		return cfg
+	}
+	return selfConfig(cfg, withDockerTimeout(client, cfg.DockerTimeout.Duration))
+}
+
+// selfConfig returns cfg with the options set by the labels on the container cjsocks runs in, inspected with client
+func selfConfig(cfg Config, client dockerAPI) Config {
+	container, err := inspectSelf(client)
+	if err != nil {
+		slog.Debug("Not reading labels on own container, probably not running in a container", "error", err)
+		return cfg
+	}
+	return applySelfLabels(cfg, container.ID, container.Config.Labels)
+}
+
+// inspectSelf inspects the container cjsocks runs in.  Docker sets the host name to the short container ID
+// unless one was configured, so this fails outside a container and in one with its own host name.
+func inspectSelf(client dockerAPI) (*docker.Container, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	container, err := client.InspectContainer(hostname)
+	if err != nil {
+		return nil, fmt.Errorf("could not inspect container %q: %w", hostname, err)
+	}
+	return container, nil
+}
+
+// applySelfLabels sets the options in labels that weren't set explicitly in cfg
+func applySelfLabels(cfg Config, ID string, labels map[string]string) Config {
+	for label, value := range labels {
+		key, ok := strings.CutPrefix(label, label_cj_config_prefix)
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		log := slog.With("container_id", ID, "label", label, "value", value)
+		switch key {
+		case "base_domain":
+			if !cfg.explicit[key] && value != "" {
+				cfg.BaseDomain = value
+				log.Info("Using base domain from own container label")
+			}
+		case "cj_network":
+			if !cfg.explicit[key] && value != "" {
+				cfg.CJNetworkName = value
+				log.Info("Using network from own container label")
+			}
+		case "auto_add":
+			autoAdd, err := strconv.ParseBool(value)
+			if err != nil {
+				log.Warn("Ignoring invalid auto_add label on own container, must be true or false")
+				continue
+			}
+			if !cfg.explicit[key] {
+				cfg.AutoAdd = autoAdd
+				log.Info("Using auto add from own container label")
+			}
+		default:
+			log.Warn("Ignoring unknown config label on own container")
+		}
+	}
+	return cfg
+}
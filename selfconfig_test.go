@@ -0,0 +1,119 @@
+package cjsocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSelfConfig(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("Hostname: %v", err)
+	}
+	labels := map[string]string{
+		label_cj_config_prefix + "base_domain": "test",
+		label_cj_config_prefix + "cj_network":  "labelled",
+		label_cj_config_prefix + "auto_add":    "false",
+	}
+	configFile := filepath.Join(t.TempDir(), "cjsocks.yaml")
+	if err := os.WriteFile(configFile, []byte("auto_add: true\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	type options struct {
+		baseDomain string
+		cjNetwork  string
+		autoAdd    bool
+	}
+	tests := []struct {
+		name      string
+		args      []string
+		env       map[string]string
+		container bool // Whether cjsocks runs in a container with the labels
+		want      options
+	}{
+		{
+			name:      "labels set the options nothing else set",
+			container: true,
+			want:      options{"test", "labelled", false},
+		},
+		{
+			name:      "flag set to its default",
+			args:      []string{"-basedomain", default_base_domain},
+			container: true,
+			want:      options{default_base_domain, "labelled", false},
+		},
+		{
+			name:      "environment",
+			env:       map[string]string{"CJ_NETWORK": default_cj_network_name},
+			container: true,
+			want:      options{"test", default_cj_network_name, false},
+		},
+		{
+			name:      "config file",
+			args:      []string{"-config", configFile},
+			container: true,
+			want:      options{"test", "labelled", true},
+		},
+		{
+			name: "not in a container",
+			want: options{default_base_domain, default_cj_network_name, default_auto_add_to_cjnetwork},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, option := range selfOptions {
+				t.Setenv(option.env, tt.env[option.env])
+			}
+			cfg, err := ParseFlags(tt.args)
+			if err != nil {
+				t.Fatalf("ParseFlags: %v", err)
+			}
+			f := newFakeDocker()
+			if tt.container {
+				f.addContainer(fakeContainer(hostname, "cjsocks", "172.17.0.10", labels))
+			}
+			cfg = selfConfig(cfg, f)
+			got := options{cfg.BaseDomain, cfg.CJNetworkName, cfg.AutoAdd}
+			if got != tt.want {
+				t.Errorf("options = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelfConfigPrinted(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("Hostname: %v", err)
+	}
+	for _, option := range selfOptions {
+		t.Setenv(option.env, "")
+	}
+	cfg, err := ParseFlags([]string{"-print-config", "-cj-network", "flagged"})
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	f := newFakeDocker()
+	f.addContainer(fakeContainer(hostname, "cjsocks", "172.17.0.10", map[string]string{
+		label_cj_config_prefix + "base_domain": "test",
+		label_cj_config_prefix + "cj_network":  "labelled",
+	}))
+	var out bytes.Buffer
+	if err := PrintConfig(&out, selfConfig(cfg, f)); err != nil {
+		t.Fatalf("PrintConfig: %v", err)
+	}
+	var got struct {
+		BaseDomain string `json:"base_domain"`
+		CJNetwork  string `json:"cj_network"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("PrintConfig wrote invalid JSON %q: %v", out.String(), err)
+	}
+	if got.BaseDomain != "test" || got.CJNetwork != "flagged" {
+		t.Errorf("printed base_domain %q and cj_network %q, want the label's \"test\" and the flag's \"flagged\"", got.BaseDomain, got.CJNetwork)
+	}
+}
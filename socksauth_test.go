@@ -0,0 +1,38 @@
+package cjsocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSocksAuth(t *testing.T) {
+	flags, err := ParseFlags([]string{"-socks-user", "user", "-socks-pass", "secret"})
+	if err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	cfg := socksTestConfig(t)
+	cfg.SocksUser, cfg.SocksPass = flags.SocksUser, flags.SocksPass
+	startApp(t, newTestApp(t, cfg))
+	target := echoServer(t).Addr().String()
+
+	conn := dialSocks(t, cfg, target)
+	echo(t, conn, "ping")
+	conn.Close()
+
+	for _, tt := range []struct {
+		name string
+		user string
+		pass string
+	}{
+		{"bad password", "user", "wrong"},
+		{"unknown user", "other", "secret"},
+		{"no credentials", "", ""},
+	} {
+		bad := cfg
+		bad.SocksUser, bad.SocksPass = tt.user, tt.pass
+		if conn, err := trySocks(bad, target, time.Second); err == nil {
+			conn.Close()
+			t.Errorf("%v: handshake succeeded, want it rejected", tt.name)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package cjsocks
+
+// Traffic through the socks5 proxy by destination, served on the admin HTTP server at /stats.
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/haxii/socks5"
+)
+
+type trafficStats struct {
+	sync.Mutex
+	byFQDN map[string]*fqdnTraffic // By the name the client asked for, or the IP when it sent one
+}
+
+// fqdnTraffic counts the connections to one destination and the bytes copied each way.  The counters are
+// updated without the trafficStats lock while connections are open.
+type fqdnTraffic struct {
+	Connections atomic.Uint64
+	BytesIn     atomic.Uint64 // From the destination to the client
+	BytesOut    atomic.Uint64 // From the client to the destination
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{byFQDN: make(map[string]*fqdnTraffic)}
+}
+
+// destination returns the counters for fqdn, adding them on first use
+func (s *trafficStats) destination(fqdn string) *fqdnTraffic {
+	s.Lock()
+	defer s.Unlock()
+	traffic, ok := s.byFQDN[fqdn]
+	if !ok {
+		traffic = new(fqdnTraffic)
+		s.byFQDN[fqdn] = traffic
+	}
+	return traffic
+}
+
+// trafficTotals is a snapshot of fqdnTraffic for the JSON response
+type trafficTotals struct {
+	Connections uint64 `json:"connections"`
+	BytesIn     uint64 `json:"bytes_in"`
+	BytesOut    uint64 `json:"bytes_out"`
+}
+
+// totals returns the counters of every destination so far
+func (s *trafficStats) totals() map[string]trafficTotals {
+	s.Lock()
+	defer s.Unlock()
+	totals := make(map[string]trafficTotals, len(s.byFQDN))
+	for fqdn, traffic := range s.byFQDN {
+		totals[fqdn] = trafficTotals{
+			Connections: traffic.Connections.Load(),
+			BytesIn:     traffic.BytesIn.Load(),
+			BytesOut:    traffic.BytesOut.Load(),
+		}
+	}
+	return totals
+}
+
+// statsDial wraps dial to count the traffic of each connection by the destination of the connect request
+// stored in ctx by accessLogRules
+func statsDial(stats *trafficStats, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return conn, err
+		}
+		fqdn := addr
+		if req, ok := ctx.Value(accessLogRequestKey{}).(*socks5.Request); ok && req.DestAddr != nil {
+			if req.DestAddr.FQDN != "" {
+				fqdn = strings.TrimSuffix(strings.ToLower(req.DestAddr.FQDN), ".")
+			} else if req.DestAddr.IP != nil {
+				fqdn = req.DestAddr.IP.String()
+			}
+		}
+		traffic := stats.destination(fqdn)
+		traffic.Connections.Add(1)
+		return &countingConn{Conn: conn, traffic: traffic}, nil
+	}
+}
+
+// countingConn adds the bytes read from and written to the destination to its counters
+type countingConn struct {
+	net.Conn
+	traffic *fqdnTraffic
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.traffic.BytesIn.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.traffic.BytesOut.Add(uint64(n))
+	return n, err
+}
+
+// CloseWrite half closes the connection like *net.TCPConn, which the socks5 server does when the client is done sending
+func (c *countingConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
+
+// handleStats writes the connections and bytes proxied to each destination as JSON.  The keys are sorted by FQDN.
+func (app *App) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, app.stats.totals())
+}
@@ -0,0 +1,64 @@
+package cjsocks
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	cfg := socksTestConfig(t)
+	app := newTestApp(t, cfg)
+	app.registerContainer("web1", containerMeta{}, []string{"web.container"}, "127.0.0.1")
+	startApp(t, app)
+	// Reads a 5 byte request and answers with 12 bytes
+	server := testServer(t, func(conn net.Conn) {
+		request := make([]byte, 5)
+		if _, err := io.ReadFull(conn, request); err == nil {
+			conn.Write([]byte("greetings!!!"))
+		}
+	})
+	port := strconv.Itoa(server.Addr().(*net.TCPAddr).Port)
+
+	exchange := func(addr string) {
+		t.Helper()
+		conn := dialSocks(t, cfg, addr)
+		defer conn.Close()
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 12)); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	exchange(net.JoinHostPort("WEB.container", port))
+	exchange(net.JoinHostPort("web.container", port))
+	exchange(net.JoinHostPort("127.0.0.1", port))
+
+	want := map[string]trafficTotals{
+		"web.container": {Connections: 2, BytesIn: 24, BytesOut: 10},
+		"127.0.0.1":     {Connections: 1, BytesIn: 12, BytesOut: 5},
+	}
+	waitFor(t, "the traffic to be counted", func() bool {
+		w := httptest.NewRecorder()
+		app.handleStats(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /stats = %v %v, want 200", w.Code, w.Body)
+		}
+		var got map[string]trafficTotals
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("GET /stats body %q: %v", w.Body, err)
+		}
+		return len(got) == len(want) && got["web.container"] == want["web.container"] && got["127.0.0.1"] == want["127.0.0.1"]
+	})
+
+	w := httptest.NewRecorder()
+	app.handleStats(w, httptest.NewRequest(http.MethodPost, "/stats", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /stats = %v, want %v", w.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,146 @@
+package cjsocks
+
+// Swarm services (-swarm).  A service is reached on its virtual IP rather than the IPs of its tasks, so each
+// service gets a name of its own: the host name label or the service name, under its stack and each base domain.
+// The same filters as for containers apply.  Listing services needs a connection to a swarm manager.
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/docker/docker/api/types/swarm"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// service_id_prefix keeps the IDs of services apart from container IDs in the registered names
+const service_id_prefix string = "service:"
+
+// label_docker_stack_namespace names the stack a service was deployed with, which prefixes its name, e.g. the
+// web service of stack shop is shop_web
+const label_docker_stack_namespace string = "com.docker.stack.namespace"
+
+// registerServices registers the name of every swarm service with a virtual IP, and drops the services that were
+// removed meanwhile
+func registerServices(app *App, client dockerAPI) error {
+	services, err := client.ListServices(docker.ListServicesOptions{})
+	if err != nil {
+		return err
+	}
+	networkID := app.cjnetworkID(client)
+	listed := make(map[string]bool, len(services))
+	for i := range services {
+		listed[service_id_prefix+services[i].ID] = true
+		app.addService(&services[i], networkID, "")
+	}
+
+	app.RLock()
+	removed := []string{}
+	for ID := range app.idToDomains {
+		if strings.HasPrefix(ID, service_id_prefix) && !listed[ID] {
+			removed = append(removed, ID)
+		}
+	}
+	app.RUnlock()
+	for _, ID := range removed {
+		app.dropContainer(ID, "stop")
+	}
+	return nil
+}
+
+// handleServiceEvent registers a service when it is created or updated and drops it when it is removed
+func (app *App) handleServiceEvent(client dockerAPI, event *docker.APIEvents) {
+	log := slog.With("event", event.Action, "service_id", event.Actor.ID)
+	switch event.Action {
+	case "create", "update":
+		log.Debug("Docker event")
+		service, err := client.InspectService(event.Actor.ID)
+		if err != nil {
+			log.Warn("Could not inspect service", "error", err)
+			return
+		}
+		action := "start"
+		if event.Action == "update" {
+			action = "update"
+		}
+		app.addService(service, app.cjnetworkID(client), action)
+	case "remove":
+		log.Debug("Docker event")
+		app.dropContainer(service_id_prefix+event.Actor.ID, "stop")
+	}
+}
+
+// addService registers the names of service on its virtual IP.  A service that lost its virtual IP, e.g. after
+// switching to dnsrr endpoint mode, is dropped.
+func (app *App) addService(service *swarm.Service, networkID string, action string) {
+	ID := service_id_prefix + service.ID
+	ip := serviceVIP(service, networkID)
+	if ip == "" {
+		slog.Debug("Skipping service without a virtual IP", "service_id", service.ID, "name", service.Spec.Name)
+		app.dropContainer(ID, "stop")
+		return
+	}
+	labels := service.Spec.Labels
+	stack := labels[label_docker_stack_namespace]
+	if app.ignored(ID, service.Spec.Name, stack, labels) {
+		app.dropContainer(ID, "stop")
+		return
+	}
+	// Like compose services, stack services are named after the service under the stack, e.g. web.shop.container
+	hostname, prefix := strings.ToLower(labels[label_cj_hostname]), ""
+	if hostname == "" {
+		hostname = strings.ToLower(service.Spec.Name)
+		if name, ok := strings.CutPrefix(hostname, strings.ToLower(stack)+"_"); stack != "" && ok {
+			hostname, prefix = name, strings.ToLower(stack)+"."
+		}
+	}
+	baseDomains := app.baseDomains
+	if domain := labelDomain(ID, labels, label_cj_base_domain); domain != "" {
+		baseDomains = []string{domain}
+	}
+	domains := []string{}
+	for _, baseDomain := range baseDomains {
+		domains = append(domains, hostname+"."+prefix+baseDomain)
+	}
+	domains = validDomains(ID, domains)
+	meta := labelMeta(ID, labels)
+	if parsed := net.ParseIP(ip); parsed.To4() != nil {
+		meta.v4 = parsed
+	} else {
+		meta.v6 = parsed
+	}
+	domains = app.registerContainer(ID, meta, domains, ip)
+	if len(domains) > 0 {
+		app.hooks.containerStarted(domains, ip)
+		app.hooks.domainsUpdated()
+		app.events.emit(action, ID, domains, ip)
+	}
+}
+
+// serviceVIP returns the virtual IP of service on the network with networkID, or its first virtual IP when it
+// has none there.  "" if the service has no virtual IP.
+func serviceVIP(service *swarm.Service, networkID string) string {
+	ip := ""
+	for _, vip := range service.Endpoint.VirtualIPs {
+		addr, _, _ := strings.Cut(vip.Addr, "/") // Addresses carry the network's prefix length
+		if net.ParseIP(addr) == nil {
+			continue
+		}
+		if networkID != "" && vip.NetworkID == networkID {
+			return addr
+		}
+		if ip == "" {
+			ip = addr
+		}
+	}
+	return ip
+}
+
+// cjnetworkID returns the ID of the cjsocks network, or "" if it can't be inspected
+func (app *App) cjnetworkID(client dockerAPI) string {
+	network, err := client.NetworkInfo(app.cjnetworkName)
+	if err != nil {
+		return ""
+	}
+	return network.ID
+}
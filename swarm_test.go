@@ -0,0 +1,79 @@
+package cjsocks
+
+import (
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// serviceEvent returns a swarm service event
+func serviceEvent(action string, ID string) *docker.APIEvents {
+	return &docker.APIEvents{Type: "service", Action: action, Actor: docker.APIActor{ID: ID, Attributes: map[string]string{}}}
+}
+
+func TestServiceStartAndRemove(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Swarm = true
+	app := newTestApp(t, cfg)
+	f := newFakeDocker()
+	f.addService(fakeService("svc1", "api", "10.0.1.5/24", nil))
+	if err := registerServices(app, f); err != nil {
+		t.Fatalf("registerServices: %v", err)
+	}
+	api := registration{ID: service_id_prefix + "svc1", ip: "10.0.1.5", domains: []string{"api.container"}}
+	assertRegistered(t, app, api)
+
+	f.addService(fakeService("svc2", "shop_web", "10.0.1.6/24", map[string]string{label_docker_stack_namespace: "shop"}))
+	app.handleEvent(f, serviceEvent("create", "svc2"))
+	web := registration{ID: service_id_prefix + "svc2", ip: "10.0.1.6", domains: []string{"web.shop.container"}}
+	assertRegistered(t, app, api, web)
+
+	f.removeService("svc2")
+	app.handleEvent(f, serviceEvent("remove", "svc2"))
+	assertRegistered(t, app, api)
+
+	// Removed while the events weren't being listened to
+	f.removeService("svc1")
+	if err := registerServices(app, f); err != nil {
+		t.Fatalf("registerServices: %v", err)
+	}
+	assertRegistered(t, app)
+}
+
+func TestServiceFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     func(cfg *Config)
+		service string
+		labels  map[string]string
+		want    []string
+	}{
+		{name: "ignore label", service: "api", labels: map[string]string{label_cj_flag_ignore: "true"}},
+		{name: "ignore name regex", cfg: func(cfg *Config) { cfg.IgnoreNameRegex = "^shop_" }, service: "shop_web", labels: map[string]string{label_docker_stack_namespace: "shop"}},
+		{name: "project filter", cfg: func(cfg *Config) { cfg.ProjectFilter = []string{"other"} }, service: "shop_web", labels: map[string]string{label_docker_stack_namespace: "shop"}},
+		{name: "project filter match", cfg: func(cfg *Config) { cfg.ProjectFilter = []string{"shop"} }, service: "shop_web", labels: map[string]string{label_docker_stack_namespace: "shop"}, want: []string{"web.shop.container"}},
+		{name: "label selector", cfg: func(cfg *Config) { cfg.LabelSelector = "tier=web" }, service: "api", labels: map[string]string{"tier": "db"}},
+		{name: "invalid name", service: "api", labels: map[string]string{label_cj_hostname: "bad_name"}},
+		{name: "invalid name without a stack", service: "shop_web"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.Swarm = true
+			if tt.cfg != nil {
+				tt.cfg(&cfg)
+			}
+			app := newTestApp(t, cfg)
+			f := newFakeDocker()
+			f.addService(fakeService("svc1", tt.service, "10.0.1.5/24", tt.labels))
+			if err := registerServices(app, f); err != nil {
+				t.Fatalf("registerServices: %v", err)
+			}
+			want := map[string]string{}
+			for _, domain := range tt.want {
+				want[domain] = "10.0.1.5"
+			}
+			assertEqual(t, "names", app.Domains(), want)
+		})
+	}
+}
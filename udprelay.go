@@ -0,0 +1,130 @@
+package cjsocks
+
+// The UDP relay for -enable-udp.  The socks5 library has one, but it can't be stopped: it never closes its socket
+// and spins on read errors once the socket is closed.  This one stops with Run.
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/haxii/socks5"
+)
+
+const udp_reply_timeout time.Duration = 5 * time.Second // How long the relay waits for the destination to answer a datagram
+const udp_max_packet int = 64 * 1024
+
+// serveSocks serves socks5 connections accepted from listener until it fails.  Unlike server.Serve it doesn't
+// start the library's UDP relay, even when the config has a BindPort.
+func serveSocks(server *socks5.Server, listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+// relayUDP relays the datagrams clients send to conn until ctx is cancelled, which also closes conn.  Each
+// datagram is sent to the destination in its socks5 UDP header, resolving names with resolver, and the first
+// datagram the destination answers with is sent back.
+func relayUDP(ctx context.Context, conn *net.UDPConn, resolver Resolver) {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	for {
+		buffer := make([]byte, udp_max_packet)
+		n, client, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("Could not read from the UDP relay", "error", err)
+			continue
+		}
+		go func() {
+			if err := relayDatagram(ctx, conn, client, buffer[:n], resolver); err != nil {
+				slog.Debug("Could not relay UDP datagram", "client", client.String(), "error", err)
+			}
+		}()
+	}
+}
+
+// relayDatagram sends one datagram from client to its destination and the answer back
+func relayDatagram(ctx context.Context, conn *net.UDPConn, client *net.UDPAddr, packet []byte, resolver Resolver) error {
+	header, dest, data, err := parseUDPHeader(packet)
+	if err != nil {
+		return err
+	}
+	if dest.FQDN != "" {
+		_, ip, err := resolver.Resolve(ctx, dest.FQDN)
+		if err != nil {
+			return fmt.Errorf("could not resolve %v: %w", dest.FQDN, err)
+		}
+		dest.IP = ip
+	}
+
+	target, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dest.IP, Port: dest.Port})
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	target.SetDeadline(time.Now().Add(udp_reply_timeout))
+	if _, err := target.Write(data); err != nil {
+		return err
+	}
+	reply := make([]byte, len(header)+udp_max_packet)
+	copy(reply, header)
+	n, err := target.Read(reply[len(header):])
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteToUDP(reply[:len(header)+n], client)
+	return err
+}
+
+// parseUDPHeader splits a socks5 UDP datagram into its header, the destination in the header and the data.
+// Fragments aren't supported.
+func parseUDPHeader(packet []byte) ([]byte, socks5.AddrSpec, []byte, error) {
+	var dest socks5.AddrSpec
+	// RSV (2 bytes), FRAG, ATYP
+	if len(packet) < 4 {
+		return nil, dest, nil, fmt.Errorf("short UDP header, %v bytes", len(packet))
+	}
+	if packet[0] != 0 || packet[1] != 0 {
+		return nil, dest, nil, fmt.Errorf("invalid UDP header reserved bytes %v", packet[:2])
+	}
+	if packet[2] != 0 {
+		return nil, dest, nil, errors.New("UDP fragments aren't supported")
+	}
+	end := 4
+	switch packet[3] {
+	case socks5.AddressIPv4:
+		end += net.IPv4len
+	case socks5.AddressIPv6:
+		end += net.IPv6len
+	case socks5.AddressDomainName:
+		if len(packet) < 5 {
+			return nil, dest, nil, fmt.Errorf("short UDP header, %v bytes", len(packet))
+		}
+		end += 1 + int(packet[4])
+	default:
+		return nil, dest, nil, fmt.Errorf("unknown UDP header address type %v", packet[3])
+	}
+	if len(packet) < end+2 {
+		return nil, dest, nil, fmt.Errorf("short UDP header, %v bytes", len(packet))
+	}
+	if packet[3] == socks5.AddressDomainName {
+		dest.FQDN = string(packet[5:end])
+	} else {
+		dest.IP = net.IP(packet[4:end])
+	}
+	dest.Port = int(binary.BigEndian.Uint16(packet[end : end+2]))
+	return packet[:end+2], dest, packet[end+2:], nil
+}
@@ -0,0 +1,48 @@
+package cjsocks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseUDPHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		want   string // The destination, "" when the header is invalid
+		data   string
+	}{
+		{"ipv4", []byte{0, 0, 0, 1, 127, 0, 0, 1, 0, 53, 'h', 'i'}, "127.0.0.1:53", "hi"},
+		{"ipv6", append(append([]byte{0, 0, 0, 4}, net.ParseIP("fd00::2")...), 1, 0, 'h', 'i'), "[fd00::2]:256", "hi"},
+		{"name", append([]byte{0, 0, 0, 3, 13}, "web.container\x00\x35hi"...), "web.container:53", "hi"},
+		{"no data", []byte{0, 0, 0, 1, 127, 0, 0, 1, 0, 53}, "127.0.0.1:53", ""},
+		{"empty", []byte{}, "", ""},
+		{"reserved bytes set", []byte{0, 1, 0, 1, 127, 0, 0, 1, 0, 53}, "", ""},
+		{"fragment", []byte{0, 0, 1, 1, 127, 0, 0, 1, 0, 53}, "", ""},
+		{"unknown address type", []byte{0, 0, 0, 2, 127, 0, 0, 1, 0, 53}, "", ""},
+		{"short address", []byte{0, 0, 0, 1, 127, 0, 0}, "", ""},
+		{"short port", []byte{0, 0, 0, 1, 127, 0, 0, 1, 0}, "", ""},
+		{"short name", []byte{0, 0, 0, 3}, "", ""},
+		{"name longer than the packet", append([]byte{0, 0, 0, 3, 20}, "web\x00\x35"...), "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, dest, data, err := parseUDPHeader(tt.packet)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("parseUDPHeader = %v, want an error", dest.Address())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseUDPHeader: %v", err)
+			}
+			if got := dest.Address(); got != tt.want {
+				t.Errorf("destination = %v, want %v", got, tt.want)
+			}
+			if string(data) != tt.data || len(header)+len(data) != len(tt.packet) {
+				t.Errorf("header, data = %v, %q, want the %q at the end of the packet", header, data, tt.data)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package cjsocks
+
+// Upstream DNS servers for names that aren't containers.  Inside a container the system resolver is
+// usually docker's embedded DNS (127.0.0.11), which may not see the host's DNS servers.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+const upstream_dns_timeout time.Duration = 5 * time.Second // Per server
+
+// upstreamResolver looks up names with each of its servers in turn until one answers
+type upstreamResolver struct {
+	servers   []string
+	resolvers []*net.Resolver
+}
+
+// newUpstreamResolver returns a resolver for servers given as host or host:port.  The port defaults to 53.
+func newUpstreamResolver(servers []string) (*upstreamResolver, error) {
+	u := &upstreamResolver{}
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		if _, port, _ := net.SplitHostPort(server); port == "" {
+			return nil, fmt.Errorf("invalid upstream DNS server %q", server)
+		}
+		addr := server
+		u.servers = append(u.servers, addr)
+		u.resolvers = append(u.resolvers, &net.Resolver{
+			PreferGo: true, // The cgo resolver ignores Dial
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		})
+	}
+	return u, nil
+}
+
+// lookup returns an address for name, preferring IPv4 like net.ResolveIPAddr.  The next server is only
+// tried when a server fails, not when it reports that the name doesn't exist.
+func (u *upstreamResolver) lookup(ctx context.Context, name string) (net.IP, error) {
+	if ctx == nil {
+		ctx = context.Background() // Resolvers set with SetResolver may pass nil
+	}
+	var err error
+	for i, resolver := range u.resolvers {
+		var ips []net.IP
+		lookupCtx, cancel := context.WithTimeout(ctx, upstream_dns_timeout)
+		ips, err = resolver.LookupIP(lookupCtx, "ip", name)
+		cancel()
+		if err == nil {
+			for _, ip := range ips {
+				if ip4 := ip.To4(); ip4 != nil {
+					return ip4, nil
+				}
+			}
+			return ips[0], nil
+		}
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, err
+		}
+		slog.Debug("Upstream DNS server failed", "server", u.servers[i], "fqdn", name, "error", err)
+	}
+	return nil, err
+}
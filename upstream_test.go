@@ -0,0 +1,42 @@
+package cjsocks
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestUpstreamDNS(t *testing.T) {
+	upstream, queries := staticDNSServer(t, map[string]string{"api.example.com.": "203.0.113.7"})
+	down := "127.0.0.1:" + strconv.Itoa(freeUDPPort(t))
+	cfg := testConfig(t)
+	cfg.UpstreamDNS = []string{down, upstream}
+	cfg.ResolveCacheTTL = Duration{0}
+	app := newTestApp(t, cfg)
+
+	// The first server is down, so the next one answers
+	if got := resolveIP(app, "api.example.com"); got != "203.0.113.7" {
+		t.Errorf("api.example.com resolved to %q, want 203.0.113.7", got)
+	}
+	if queries.Load() == 0 {
+		t.Error("the upstream DNS server wasn't queried")
+	}
+
+	// A server saying the name doesn't exist is an answer, not a failure
+	cfg.UpstreamDNS = []string{nxdomainServer(t), upstream}
+	app = newTestApp(t, cfg)
+	before := queries.Load()
+	if got := resolveIP(app, "api.example.com"); got != "" {
+		t.Errorf("api.example.com resolved to %q, want the first server's NXDOMAIN", got)
+	}
+	if got := queries.Load(); got != before {
+		t.Errorf("%v queries to the next server after NXDOMAIN, want none", got-before)
+	}
+}
+
+func TestNewUpstreamResolver(t *testing.T) {
+	u, err := newUpstreamResolver([]string{"10.0.0.1", "10.0.0.2:5353", "fd00::1", "[fd00::2]:5353"})
+	if err != nil {
+		t.Fatalf("newUpstreamResolver: %v", err)
+	}
+	assertEqual(t, "servers", u.servers, []string{"10.0.0.1:53", "10.0.0.2:5353", "[fd00::1]:53", "[fd00::2]:5353"})
+}
@@ -0,0 +1,64 @@
+package cjsocks
+
+// The upstream label, for a container standing in for an external endpoint, e.g. a SaaS API or a legacy VM.
+// "org.cj-tools.hosts.upstream=api.example.com:443" makes the container's names resolve to api.example.com,
+// looked up when the name is resolved, and sends every connection to port 443.  The port is optional.
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// upstreamPortKey holds the port of the upstream label in the request context, for portRewriter
+type upstreamPortKey struct{}
+
+// labelUpstream returns the host and port of a container's upstream label.  The port is 0 when the label has
+// none, and the host "" when there is no valid label.
+func labelUpstream(ID string, labels map[string]string) (string, int) {
+	value := strings.TrimSpace(labels[label_cj_upstream])
+	if value == "" {
+		return "", 0
+	}
+	host, port := value, 0
+	// A bare IPv6 address has colons but no port
+	if h, p, err := net.SplitHostPort(value); err == nil {
+		n, err := strconv.Atoi(p)
+		if err != nil || !validPort(n) {
+			slog.Warn("Ignoring upstream label with an invalid port, expected host or host:port", "container_id", ID, "label", label_cj_upstream, "value", value)
+			return "", 0
+		}
+		host, port = h, n
+	}
+	if net.ParseIP(host) != nil {
+		return host, port
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if err := validateFQDN(host); err != nil {
+		slog.Warn("Ignoring upstream label with an invalid host, expected host or host:port", "container_id", ID, "label", label_cj_upstream, "value", value, "error", err)
+		return "", 0
+	}
+	return host, port
+}
+
+// upstreamAddress returns the address of an upstream host, looking up names like other names that aren't
+// containers
+func (app *App) upstreamAddress(ctx context.Context, host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4, nil
+		}
+		return ip, nil
+	}
+	if cached := app.resolveCache.get(host); cached != nil {
+		return cached, nil
+	}
+	addr, err := app.lookupHost(ctx, host)
+	if err != nil {
+		return nil, lookupError(host, err)
+	}
+	app.resolveCache.put(host, addr)
+	return addr, nil
+}
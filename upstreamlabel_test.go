@@ -0,0 +1,93 @@
+package cjsocks
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/haxii/socks5"
+	"github.com/miekg/dns"
+)
+
+// staticDNSServer starts a DNS server on a loopback port that answers A queries for the names in answers and
+// NXDOMAIN for everything else.  It returns its address and the number of queries it has answered.
+func staticDNSServer(t *testing.T, answers map[string]string) (string, *atomic.Int64) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	queries := new(atomic.Int64)
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		ip, ok := answers[dns.CanonicalName(q.Name)]
+		switch {
+		case !ok:
+			m.Rcode = dns.RcodeNameError
+		case q.Qtype == dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(ip),
+			})
+		}
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String(), queries
+}
+
+func TestLabelUpstream(t *testing.T) {
+	tests := []struct {
+		label string
+		host  string
+		port  int
+	}{
+		{label: "api.example.com", host: "api.example.com"},
+		{label: "API.Example.com.:443", host: "api.example.com", port: 443},
+		{label: "203.0.113.7:8443", host: "203.0.113.7", port: 8443},
+		{label: "2001:db8::1", host: "2001:db8::1"},
+		{label: "api.example.com:http"},
+		{label: "-bad.example.com"},
+	}
+	for _, tt := range tests {
+		host, port := labelUpstream("web1", map[string]string{label_cj_upstream: tt.label})
+		if host != tt.host || port != tt.port {
+			t.Errorf("labelUpstream(%q) = %q, %v, want %q, %v", tt.label, host, port, tt.host, tt.port)
+		}
+	}
+}
+
+func TestUpstreamLabel(t *testing.T) {
+	cfg := testConfig(t)
+	upstream, _ := staticDNSServer(t, map[string]string{"api.example.com.": "203.0.113.7"})
+	cfg.UpstreamDNS = []string{upstream}
+	app := newTestApp(t, cfg)
+	f := newFakeDocker()
+	f.addContainer(fakeContainer("api1", "api", "172.17.0.2", map[string]string{label_cj_upstream: "api.example.com:443"}))
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.3", map[string]string{label_cj_upstream: "api.example.com"}))
+	app.handleEvent(f, fakeEvent("start", "api1"))
+	app.handleEvent(f, fakeEvent("start", "web1"))
+
+	tests := []struct {
+		name string
+		port int // Port the connection goes to when port 80 is requested
+	}{
+		{name: "api.container", port: 443},
+		{name: "web.container", port: 80},
+	}
+	for _, tt := range tests {
+		// Resolvers set with SetResolver may pass nil
+		ctx, ip, err := app.Resolve(nil, tt.name)
+		if err != nil || ip.String() != "203.0.113.7" {
+			t.Fatalf("Resolve(%v) = %v, %v, want the upstream's address 203.0.113.7", tt.name, ip, err)
+		}
+		req := &socks5.Request{DestAddr: &socks5.AddrSpec{FQDN: tt.name, IP: ip, Port: 80}}
+		if _, addr := (portRewriter{}).Rewrite(ctx, req); addr.Port != tt.port {
+			t.Errorf("Rewrite port 80 of %v = %v, want %v", tt.name, addr.Port, tt.port)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package cjsocks
+
+// Build information.  Set at build time, e.g.
+// go build -ldflags "-X github.com/king-perseus/cjsocks.version=1.2.0 -X github.com/king-perseus/cjsocks.commit=$(git rev-parse --short HEAD) -X github.com/king-perseus/cjsocks.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/cjsocks
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// getBuildInfo returns the build information.  The commit and date recorded by the go tool are used when
+// they weren't set with -ldflags.
+func getBuildInfo() buildInfo {
+	info := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+// WriteVersion writes the build information for -version
+func WriteVersion(w io.Writer) {
+	info := getBuildInfo()
+	fmt.Fprintf(w, "cjsocks %v (commit %v, built %v, %v)\n", info.Version, info.Commit, info.BuildDate, info.GoVersion)
+}
+
+// handleVersion writes the build information as JSON
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, getBuildInfo())
+}
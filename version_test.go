@@ -0,0 +1,41 @@
+package cjsocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	// As set with -ldflags -X
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.2.0", "abc1234", "2024-05-01T12:00:00Z"
+
+	var out bytes.Buffer
+	WriteVersion(&out)
+	want := "cjsocks 1.2.0 (commit abc1234, built 2024-05-01T12:00:00Z, " + runtime.Version() + ")\n"
+	if out.String() != want {
+		t.Errorf("WriteVersion = %q, want %q", out.String(), want)
+	}
+
+	w := httptest.NewRecorder()
+	handleVersion(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	var info buildInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("GET /version body %q: %v", w.Body, err)
+	}
+	assertEqual(t, "GET /version", info, buildInfo{Version: "1.2.0", Commit: "abc1234", BuildDate: "2024-05-01T12:00:00Z", GoVersion: runtime.Version()})
+
+	// Without -ldflags every field still says something
+	version, commit, buildDate = "dev", "", ""
+	info = getBuildInfo()
+	for field, value := range map[string]string{"version": info.Version, "commit": info.Commit, "build date": info.BuildDate, "go version": info.GoVersion} {
+		if strings.TrimSpace(value) == "" {
+			t.Errorf("%v is empty without -ldflags", field)
+		}
+	}
+}
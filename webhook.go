@@ -0,0 +1,95 @@
+package cjsocks
+
+// Webhook notifications.  POSTs each change to the registered names to -webhook-url so other tools can react.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const webhook_timeout = 5 * time.Second // For each POST
+const webhook_queue_size int = 100      // Changes waiting to be sent.  More are dropped so the event loop never waits.
+
+// webhookEvent is the JSON body of a webhook POST
+type webhookEvent struct {
+	Event string   `json:"event"` // "added" or "removed"
+	FQDNs []string `json:"fqdns"`
+	IP    string   `json:"ip,omitempty"` // Only known when the names are added
+}
+
+type webhook struct {
+	url    string
+	client *http.Client
+	events chan webhookEvent
+}
+
+// newWebhook returns a webhook that POSTs the events sent to it to rawURL, once run is called
+func newWebhook(rawURL string) *webhook {
+	return &webhook{
+		url:    rawURL,
+		client: &http.Client{Timeout: webhook_timeout},
+		events: make(chan webhookEvent, webhook_queue_size),
+	}
+}
+
+// validateWebhookURL fails unless rawURL is an http or https URL
+func validateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url %q: %w", rawURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url %q: must be http:// or https://", rawURL)
+	}
+	return nil
+}
+
+// send queues event without waiting.  It is dropped if the queue is full.
+func (w *webhook) send(event webhookEvent) {
+	select {
+	case w.events <- event:
+	default:
+		slog.Warn("Webhook queue is full, dropping event", "event", event.Event, "fqdns", event.FQDNs)
+	}
+}
+
+// run POSTs the queued events until ctx is cancelled, which also abandons the POST in progress
+func (w *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-w.events:
+			if err := w.post(ctx, event); err != nil && ctx.Err() == nil {
+				slog.Warn("Could not send webhook", "url", w.url, "event", event.Event, "error", err)
+			}
+		}
+	}
+}
+
+func (w *webhook) post(ctx context.Context, event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package cjsocks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// webhookServer returns an HTTP server that sends the bodies POSTed to it to the returned channel
+func webhookServer(t *testing.T) (*httptest.Server, chan webhookEvent) {
+	t.Helper()
+	events := make(chan webhookEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var event webhookEvent
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || json.Unmarshal(body, &event) != nil {
+			t.Errorf("webhook got %v %v %q", r.Method, r.Header.Get("Content-Type"), body)
+		}
+		events <- event
+	}))
+	t.Cleanup(server.Close)
+	return server, events
+}
+
+// nextWebhook returns the next event POSTed to the webhook server
+func nextWebhook(t *testing.T, events chan webhookEvent) webhookEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the webhook")
+		return webhookEvent{}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	server, events := webhookServer(t)
+	cfg := socksTestConfig(t)
+	cfg.WebhookURL = server.URL
+	app := newTestApp(t, cfg)
+	f := newFakeDocker()
+	app.dockerClient = func() (dockerAPI, error) { return f, nil }
+	startApp(t, app)
+	waitFor(t, "the docker events listener", app.ready.Load)
+
+	f.addContainer(fakeContainer("web1", "web", "172.17.0.2", map[string]string{label_cj_aliases: "www"}))
+	f.send(fakeEvent("start", "web1"))
+	got := nextWebhook(t, events)
+	assertEqual(t, "webhook on start", got, webhookEvent{Event: "added", FQDNs: []string{"web.container", "www.container"}, IP: "172.17.0.2"})
+
+	f.removeContainer("web1")
+	f.send(fakeEvent("destroy", "web1"))
+	got = nextWebhook(t, events)
+	assertEqual(t, "webhook on destroy", got, webhookEvent{Event: "removed", FQDNs: []string{"web.container", "www.container"}})
+}
+
+func TestWebhookStopsWithRun(t *testing.T) {
+	// Never answers until the test ends, so the POST is in progress when Run stops
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	w := newWebhook(server.URL)
+	w.send(webhookEvent{Event: "added", FQDNs: []string{"web.container"}, IP: "172.17.0.2"})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.run(ctx)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond) // For the POST to start
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("webhook worker still running after its context was cancelled")
+	}
+}